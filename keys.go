@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/raz-varren/lockdown/ld/v2"
+	"github.com/raz-varren/log"
+	"os"
+	"strings"
+)
+
+const (
+	// keygenCmd is the subcommand that generates a new identity
+	keygenCmd = "keygen"
+)
+
+var (
+	errKeygenArgs = errors.New("keygen doesn't take any arguments other than -o and -sign")
+)
+
+// stringList is a flag.Value that can be set more than once
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(s string) error {
+	*sl = append(*sl, s)
+	return nil
+}
+
+// loadRecipients parses each -recipient flag, which may either be an encoded
+// public key or a file containing one public key per line
+func loadRecipients(args []string) ([]v2.Recipient, error) {
+	recips := []v2.Recipient{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, v2.RecipientPrefix) {
+			r, err := v2.ParseRecipient(arg)
+			if err != nil {
+				return nil, err
+			}
+			recips = append(recips, r)
+			continue
+		}
+
+		f, err := os.Open(arg)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := v2.ReadRecipients(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+		recips = append(recips, rs...)
+	}
+	return recips, nil
+}
+
+// loadIdentities reads every identity file passed to -identity
+func loadIdentities(args []string) ([]*v2.Identity, error) {
+	ids := []*v2.Identity{}
+	for _, arg := range args {
+		f, err := os.Open(arg)
+		if err != nil {
+			destroyIdentities(ids)
+			return nil, err
+		}
+		fIds, err := v2.ReadIdentities(f)
+		f.Close()
+		if err != nil {
+			destroyIdentities(ids)
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+		ids = append(ids, fIds...)
+	}
+	return ids, nil
+}
+
+func destroyIdentities(ids []*v2.Identity) {
+	for _, id := range ids {
+		id.Destroy()
+	}
+}
+
+// loadSigner reads the signing key in the -sign file
+func loadSigner(path string) (*v2.SigningKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sk, err := v2.ReadSigningKey(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sk, nil
+}
+
+// loadTrusted reads every trusted public key file passed to -trust
+func loadTrusted(args []string) ([]v2.VerifyingKey, error) {
+	trusted := []v2.VerifyingKey{}
+	for _, arg := range args {
+		f, err := os.Open(arg)
+		if err != nil {
+			return nil, err
+		}
+		vks, err := v2.ReadVerifyingKeys(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+		trusted = append(trusted, vks...)
+	}
+	return trusted, nil
+}
+
+// keygen generates a new identity, or signing key with -sign, writing the private key
+// to the -o file, or stdout, and printing the public key so it can be handed out to others
+func keygen(args []string) {
+	fs := flag.NewFlagSet(keygenCmd, flag.ExitOnError)
+	out := fs.String("o", "", fuKeygenOut)
+	sign := fs.Bool("sign", false, fuKeygenSign)
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		log.Err.Fatalln(errKeygenArgs)
+	}
+
+	var pub, priv string
+	if *sign {
+		sk, err := v2.GenerateSigningKey()
+		if err != nil {
+			log.Err.Fatalln(err)
+		}
+		defer sk.Destroy()
+		pub, priv = sk.VerifyingKey().String(), sk.String()
+	} else {
+		id, err := v2.GenerateIdentity()
+		if err != nil {
+			log.Err.Fatalln(err)
+		}
+		defer id.Destroy()
+		pub, priv = id.Recipient().String(), id.String()
+	}
+
+	contents := fmt.Sprintf("# public key: %s\n%s\n", pub, priv)
+
+	if *out == "" {
+		fmt.Print(contents)
+		return
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Err.Fatalln(err)
+	}
+	if _, err = f.WriteString(contents); err != nil {
+		f.Close()
+		log.Err.Fatalln(err)
+	}
+	if err = f.Close(); err != nil {
+		log.Err.Fatalln(err)
+	}
+
+	fmt.Println("public key:", pub)
+}
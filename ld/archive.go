@@ -0,0 +1,333 @@
+package ld
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"github.com/raz-varren/lockdown/ld/v2"
+	"github.com/raz-varren/lockdown/ld/volume"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrArchiveNames  = errors.New("two of the paths to archive have the same name")
+	ErrArchiveEntry  = errors.New("archives can only hold regular files and directories")
+	ErrArchiveExists = errors.New("an entry of the archive already exists in the destination, nothing was extracted")
+)
+
+// ErrArchivePath is returned for an archive entry that would be extracted outside of its destination
+type ErrArchivePath struct {
+	Name string
+}
+
+func (e ErrArchivePath) Error() string {
+	return fmt.Sprintf("archive entry (%s) would be extracted outside of the destination", e.Name)
+}
+
+// ArchiveEntry is a file or directory in an archive. Name is its slash separated
+// path within the archive, starting with the name of the path it was archived from
+type ArchiveEntry struct {
+	v2.Metadata
+	Size int64
+}
+
+// WriteArchive writes a tar of the files and directory trees at paths to w. Each path is stored
+// under its own name, so paths must all have different names. The mode, times, and owner of every
+// file and directory are kept. Symlinks and special files are skipped.
+func WriteArchive(w io.Writer, paths ...string) error {
+	return writeArchive(w, nil, paths)
+}
+
+// writeArchive is WriteArchive, skipping the files skip returns true for
+func writeArchive(w io.Writer, skip func(fp string, info os.FileInfo) bool, paths []string) error {
+	tw := tar.NewWriter(w)
+
+	names := make(map[string]bool)
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		base := filepath.Base(p)
+		if names[base] {
+			return ErrArchiveNames
+		}
+		names[base] = true
+
+		err := filepath.Walk(p, func(fp string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil
+			}
+			if skip != nil && skip(fp, info) {
+				return nil
+			}
+
+			rel, err := filepath.Rel(p, fp)
+			if err != nil {
+				return err
+			}
+			return writeEntry(tw, fp, filepath.ToSlash(filepath.Join(base, rel)), info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// writeEntry writes the header and contents of the file at fp to tw as name
+func writeEntry(tw *tar.Writer, fp, name string, info os.FileInfo) error {
+	meta, err := v2.FileMeta(fp)
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Format = tar.FormatPAX
+	hdr.AccessTime = meta.AccessTime
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// EncryptArchive encrypts a tar of the files and directory trees at paths, as written by
+// WriteArchive, to fileOut. The tar is streamed straight into the encrypter, so it is never
+// written to disk, and the key is only derived once for the whole archive. The archive
+// itself has no metadata, since every entry carries its own. opts.Split splits the archive
+// into volumes, as described by EncryptFileOptions.
+func EncryptArchive(pass []byte, cp v1.CostParams, fileOut string, paths []string, opts v2.EncOptions) error {
+	opts.Meta = nil
+	opts.SkipMeta = true
+
+	absOut, err := filepath.Abs(fileOut)
+	if err != nil {
+		return err
+	}
+
+	encF, err := createFile(fileOut, opts)
+	if err != nil {
+		return err
+	}
+	defer encF.Close()
+
+	// the archive, or its volumes, may be inside one of the trees
+	skip := func(fp string, info os.FileInfo) bool {
+		abs, err := filepath.Abs(fp)
+		if err != nil {
+			return false
+		}
+		return abs == absOut || (opts.Split > 0 && strings.HasPrefix(abs, absOut+".") && volume.IsVolume(abs))
+	}
+
+	encW, err := NewEncOptions(pass, cp, encF, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := writeArchive(encW, skip, paths); err != nil {
+		encW.Close()
+		return err
+	}
+
+	return encW.Close()
+}
+
+// ReadArchive calls fn with each entry of the tar in r, along with a reader of its contents.
+// Every entry name is checked so it can't be extracted outside of a destination directory.
+// Once the last entry is read, the rest of r is read as well, so a decrypter has authenticated
+// all of its data by the time ReadArchive returns nil.
+func ReadArchive(r io.Reader, fn func(e ArchiveEntry, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			return ErrArchiveEntry
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || filepath.IsAbs(filepath.FromSlash(name)) {
+			return ErrArchivePath{Name: hdr.Name}
+		}
+
+		accessTime := hdr.AccessTime
+		if accessTime.IsZero() {
+			accessTime = hdr.ModTime
+		}
+		e := ArchiveEntry{
+			Metadata: v2.Metadata{
+				Name:       name,
+				Mode:       hdr.FileInfo().Mode(),
+				ModTime:    hdr.ModTime,
+				AccessTime: accessTime,
+				UID:        hdr.Uid,
+				GID:        hdr.Gid,
+			},
+			Size: hdr.Size,
+		}
+		if err := fn(e, tr); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// ListArchive decrypts the archive fileIn and returns its entries. The whole archive is
+// authenticated before the entries are returned.
+func ListArchive(pass []byte, fileIn string, opts v2.DecOptions) ([]ArchiveEntry, error) {
+	encFile, err := openFile(fileIn)
+	if err != nil {
+		return nil, err
+	}
+	defer encFile.Close()
+
+	decR, err := NewDecOptions(pass, encFile, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer decR.Close()
+
+	entries := []ArchiveEntry{}
+	err = ReadArchive(decR, func(e ArchiveEntry, r io.Reader) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ExtractArchive decrypts the archive fileIn and restores its entries into the directory dest,
+// which is created if it doesn't exist, and returns the entries. The entries are extracted to a
+// temp directory in dest, and only moved into place once the whole archive has been authenticated,
+// so nothing is left behind if the archive was tampered with. If any of the top level entries
+// already exist in dest, ErrArchiveExists is returned and nothing is moved. Unless opts.SkipMeta
+// is set, the mode, times, and owner of each entry are restored, as described by v2.DecryptFileOptions.
+// Entries whose metadata can't be restored are still extracted, and the first such failure is
+// returned as a v2.ErrMetaNotRestored along with the entries.
+func ExtractArchive(pass []byte, fileIn, dest string, opts v2.DecOptions) ([]ArchiveEntry, error) {
+	encFile, err := openFile(fileIn)
+	if err != nil {
+		return nil, err
+	}
+	defer encFile.Close()
+
+	decR, err := NewDecOptions(pass, encFile, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer decR.Close()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(dest, ".lockdown_extract_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	// the first entry whose metadata couldn't be restored, named by where it ends up in dest
+	var metaErr error
+	applyMeta := func(e ArchiveEntry) {
+		if opts.SkipMeta {
+			return
+		}
+		err := e.Apply(filepath.Join(tmp, filepath.FromSlash(e.Name)), !opts.SkipOwner)
+		if mErr, ok := err.(v2.ErrMetaNotRestored); ok && metaErr == nil {
+			mErr.Path = filepath.Join(dest, filepath.FromSlash(e.Name))
+			metaErr = mErr
+		}
+	}
+
+	// directories are restored last, since extracting their contents changes their times
+	entries := []ArchiveEntry{}
+	dirs := []ArchiveEntry{}
+	err = ReadArchive(decR, func(e ArchiveEntry, r io.Reader) error {
+		entries = append(entries, e)
+		fp := filepath.Join(tmp, filepath.FromSlash(e.Name))
+		if e.Mode.IsDir() {
+			dirs = append(dirs, e)
+			return os.MkdirAll(fp, 0700)
+		}
+		if err := os.MkdirAll(filepath.Dir(fp), 0700); err != nil {
+			return err
+		}
+		if err := extractFile(fp, r); err != nil {
+			return err
+		}
+		applyMeta(e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		applyMeta(dirs[i])
+	}
+
+	tops, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return nil, err
+	}
+	for _, top := range tops {
+		if _, err := os.Lstat(filepath.Join(dest, top.Name())); err == nil {
+			return nil, ErrArchiveExists
+		}
+	}
+	for _, top := range tops {
+		if err := os.Rename(filepath.Join(tmp, top.Name()), filepath.Join(dest, top.Name())); err != nil {
+			return nil, err
+		}
+	}
+	return entries, metaErr
+}
+
+// extractFile writes the contents of an archive entry to fp
+func extractFile(fp string, r io.Reader) error {
+	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package ld
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+const (
+	ArmorBegin = "-----BEGIN LOCKDOWN ENCRYPTED DATA-----"
+	ArmorEnd   = "-----END LOCKDOWN ENCRYPTED DATA-----"
+
+	// ArmorExt is added after the encrypted file extension of armored files
+	ArmorExt = "asc"
+
+	// armorLineLen is the number of base64 characters written on each line, a
+	// multiple of 4 so that every line decodes on its own
+	armorLineLen = 64
+
+	// armorPeek is how much of the start of the data is read when detecting armor.
+	// Only whitespace may come before ArmorBegin
+	armorPeek = 512
+
+	// armorMaxToken is the most of a line the reader decodes at once, so that armor
+	// whose base64 was pasted as one long line doesn't have to fit in a single token
+	armorMaxToken = 1024 * 32
+)
+
+var (
+	ErrNoArmor        = errors.New("no " + ArmorBegin + " line found")
+	ErrBadArmor       = errors.New("the armored data is malformed or incomplete")
+	ErrArmorChecksum  = errors.New("the armored data doesn't match its checksum, it was likely changed while being copied")
+	ErrArmorInPlace   = errors.New("armored files can't be rekeyed or upgraded in place, decrypt them and encrypt them again")
+	ErrArmorClosed    = errors.New("armor writer is already closed")
+	armorChecksumSize = base64.RawStdEncoding.EncodedLen(crc32.Size)
+)
+
+// NewArmorWriter returns an io.WriteCloser that writes the data written to it to w as
+// text: an ArmorBegin line, the data in lines of base64, a checksum line, and an ArmorEnd
+// line. The checksum is the crc32 of the data, so copying mistakes are caught before the
+// data is even decrypted.
+//
+// Close must be called on the returned io.WriteCloser to write the last line and the
+// checksum. Close also closes w, if w is an io.Closer, so it can be passed to the encrypters
+// in place of the file they write to.
+func NewArmorWriter(w io.Writer) (io.WriteCloser, error) {
+	if _, err := io.WriteString(w, ArmorBegin+"\n"); err != nil {
+		return nil, err
+	}
+
+	aw := &armorWriter{
+		lw:  &lineWriter{w: w},
+		crc: crc32.NewIEEE(),
+	}
+	aw.enc = base64.NewEncoder(base64.StdEncoding, aw.lw)
+	return aw, nil
+}
+
+type armorWriter struct {
+	lw     *lineWriter
+	enc    io.WriteCloser
+	crc    hash.Hash32
+	closed bool
+}
+
+func (aw *armorWriter) Write(p []byte) (int, error) {
+	if aw.closed {
+		return 0, ErrArmorClosed
+	}
+	aw.crc.Write(p)
+	return aw.enc.Write(p)
+}
+
+// Close flushes the last line of base64, then writes the checksum and ArmorEnd lines
+func (aw *armorWriter) Close() error {
+	if aw.closed {
+		return nil
+	}
+	aw.closed = true
+
+	err := aw.enc.Close()
+	if err == nil && aw.lw.col > 0 {
+		_, err = io.WriteString(aw.lw.w, "\n")
+	}
+	if err == nil {
+		sum := base64.RawStdEncoding.EncodeToString(aw.crc.Sum(nil))
+		_, err = io.WriteString(aw.lw.w, "="+sum+"\n"+ArmorEnd+"\n")
+	}
+
+	if c, ok := aw.lw.w.(io.Closer); ok {
+		if cErr := c.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// lineWriter breaks the base64 written to it into lines of armorLineLen characters
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := armorLineLen - lw.col
+		if c > len(p) {
+			c = len(p)
+		}
+		if _, err := lw.w.Write(p[:c]); err != nil {
+			return n, err
+		}
+		n += c
+		lw.col += c
+		p = p[c:]
+
+		if lw.col == armorLineLen {
+			if _, err := io.WriteString(lw.w, "\n"); err != nil {
+				return n, err
+			}
+			lw.col = 0
+		}
+	}
+	return n, nil
+}
+
+// NewArmorReader returns an io.Reader that decodes the armored data written by a
+// NewArmorWriter. Anything before the ArmorBegin line is skipped, and the lines of base64
+// don't need to keep their original length, so armor that was rewrapped or indented when
+// it was pasted still decodes. Read returns ErrArmorChecksum in place of io.EOF if the
+// data doesn't match its checksum, and ErrBadArmor if the data ends before the ArmorEnd line.
+// The base64 may also be on a single line of any length.
+func NewArmorReader(r io.Reader) (io.Reader, error) {
+	s := bufio.NewScanner(r)
+	s.Split(scanArmorLines)
+	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == ArmorBegin {
+			return &armorReader{s: s, crc: crc32.NewIEEE()}, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNoArmor
+}
+
+// scanArmorLines is bufio.ScanLines, except lines longer than armorMaxToken are
+// returned in tokens of armorMaxToken
+func scanArmorLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if advance == 0 && err == nil && len(data) >= armorMaxToken {
+		return armorMaxToken, data[:armorMaxToken], nil
+	}
+	return advance, token, err
+}
+
+type armorReader struct {
+	s       *bufio.Scanner
+	crc     hash.Hash32
+	pending string
+	sum     []byte
+	out     []byte
+	err     error
+}
+
+func (ar *armorReader) Read(p []byte) (int, error) {
+	for len(ar.out) == 0 {
+		if ar.err != nil {
+			return 0, ar.err
+		}
+		ar.err = ar.next()
+	}
+
+	n := copy(p, ar.out)
+	ar.out = ar.out[n:]
+	return n, nil
+}
+
+// next decodes the next line of the armor into out
+func (ar *armorReader) next() error {
+	if !ar.s.Scan() {
+		if err := ar.s.Err(); err != nil {
+			return err
+		}
+		return ErrBadArmor
+	}
+	line := strings.TrimSpace(ar.s.Text())
+
+	switch {
+	case line == ArmorEnd:
+		if ar.pending != "" || ar.sum == nil {
+			return ErrBadArmor
+		}
+		if !bytes.Equal(ar.sum, ar.crc.Sum(nil)) {
+			return ErrArmorChecksum
+		}
+		return io.EOF
+	case ar.sum != nil:
+		// nothing but the end line may follow the checksum
+		return ErrBadArmor
+	case len(line) == 1+armorChecksumSize && line[0] == '=':
+		sum, err := base64.RawStdEncoding.DecodeString(line[1:])
+		if err != nil {
+			return ErrBadArmor
+		}
+		ar.sum = sum
+		return nil
+	}
+
+	// only whole groups of 4 characters can be decoded
+	ar.pending += line
+	n := len(ar.pending) / 4 * 4
+	out, err := base64.StdEncoding.DecodeString(ar.pending[:n])
+	if err != nil {
+		return ErrBadArmor
+	}
+	ar.pending = ar.pending[n:]
+	ar.crc.Write(out)
+	ar.out = out
+	return nil
+}
+
+// isArmored returns true if b, the start of some data, is armored
+func isArmored(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte(ArmorBegin))
+}
+
+// peekArmor returns true if the data at the start of r is armored, and rewinds r
+func peekArmor(r io.ReadSeeker) (bool, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	b := make([]byte, armorPeek)
+	n, err := io.ReadFull(r, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return isArmored(b[:n]), nil
+}
@@ -0,0 +1,230 @@
+package ld
+
+import (
+	"fmt"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"github.com/raz-varren/lockdown/ld/v2"
+	"io"
+	"sync"
+)
+
+// Codec is one version of the encrypted format. Data is dispatched to the Codec
+// registered for the version bytes it starts with, so formats can be added with
+// Register without changing ld.
+//
+// The readers passed to a Codec are positioned at the start of the data, before
+// its version bytes.
+type Codec interface {
+	// Version is the version the data written by NewEnc starts with
+	Version() uint16
+
+	NewEnc(pass []byte, w io.Writer, opts CodecEncOptions) (io.WriteCloser, error)
+	NewDec(pass []byte, r io.ReadSeeker, opts CodecDecOptions) (io.ReadCloser, error)
+	NewSeekDec(pass []byte, r io.ReadSeeker, opts CodecDecOptions) (SeekDecrypter, error)
+
+	// ReadHeader reads the crypto header at the start of r, for inspecting a file without a password
+	ReadHeader(r io.Reader) (fmt.Stringer, error)
+}
+
+// StreamCodec is a Codec that can decrypt data as it streams in. NewStreamDec spools
+// the data of any other Codec to a temp file before decrypting it.
+type StreamCodec interface {
+	Codec
+	NewStreamDec(pass []byte, r io.Reader, opts CodecDecOptions) (io.ReadCloser, error)
+}
+
+// RekeyCodec is a Codec that can change the password of a file in place.
+// Rekey refuses files of any other Codec. The new key is derived with the
+// Cost of encOpts, and the old key is limited by the MaxCost of decOpts.
+type RekeyCodec interface {
+	Codec
+	Rekey(oldPass, newPass []byte, path string, encOpts CodecEncOptions, decOpts CodecDecOptions) error
+}
+
+// SeekDecrypter is a decrypter that can also Seek and ReadAt any offset of the plaintext,
+// as returned by NewSeekDec. v1.SeekDecrypter has the same methods, so the decrypters of
+// either package can be used as one.
+type SeekDecrypter interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+
+	// Size returns the size of the plaintext in bytes
+	Size() int64
+}
+
+// CodecEncOptions are the options a Codec encrypts with
+type CodecEncOptions struct {
+	// Cost is the key derivation cost passed to NewEncOptions, in whatever shape the
+	// Codec's KDF takes, such as the v1.CostParams of argon2id for the built in versions.
+	// A Codec uses its own default for a Cost of any type it doesn't know
+	Cost interface{}
+
+	// Format holds the options of the format being written, such as the v2.EncOptions
+	// passed to NewEncOptions. A Codec ignores a Format of any type it doesn't know
+	Format interface{}
+}
+
+// CodecDecOptions are the options a Codec decrypts with
+type CodecDecOptions struct {
+	// MaxCost is the highest key derivation cost the data may ask for before it
+	// is refused, as described by v2.DecOptions
+	MaxCost v1.CostParams
+
+	// Signed is set when only signed data may be decrypted. A Codec that can't
+	// check the signature of its data must refuse it with v2.ErrUnsigned
+	Signed bool
+
+	// Format holds the options of the format being read, such as the v2.DecOptions
+	// passed to NewDecOptions. A Codec ignores a Format of any type it doesn't know
+	Format interface{}
+}
+
+// codecEncOptions returns the options passed to a Codec for cp and opts
+func codecEncOptions(cp v1.CostParams, opts v2.EncOptions) CodecEncOptions {
+	return CodecEncOptions{Cost: cp, Format: opts}
+}
+
+// argon2Cost returns the argon2id cost of opts, or CostNormal if it has none
+func argon2Cost(opts CodecEncOptions) v1.CostParams {
+	if cp, ok := opts.Cost.(v1.CostParams); ok {
+		return cp
+	}
+	return v1.CostNormal
+}
+
+// codecDecOptions returns the options passed to a Codec for opts
+func codecDecOptions(opts v2.DecOptions) CodecDecOptions {
+	return CodecDecOptions{
+		MaxCost: opts.MaxCost,
+		Signed:  len(opts.Trusted) > 0,
+		Format:  opts,
+	}
+}
+
+type ErrVerRegistered struct {
+	ver uint16
+}
+
+func (e ErrVerRegistered) Error() string {
+	return fmt.Sprintf("a codec is already registered for version (%d)", e.ver)
+}
+
+var (
+	codecMu = &sync.RWMutex{}
+	codecs  = make(map[uint16]Codec)
+)
+
+func init() {
+	for _, c := range []Codec{v1Codec{}, v2Codec{}} {
+		if err := Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register makes c available for its version. ErrVerRegistered is returned,
+// and c is left out, if a Codec is already registered for that version.
+func Register(c Codec) error {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+
+	ver := c.Version()
+	if _, ok := codecs[ver]; ok {
+		return ErrVerRegistered{ver: ver}
+	}
+	codecs[ver] = c
+	Versions.Add(ver)
+	return nil
+}
+
+// Lookup returns the Codec registered for ver, or ErrVerMissing if there isn't one
+func Lookup(ver uint16) (Codec, error) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+
+	c, ok := codecs[ver]
+	if !ok {
+		return nil, ErrVerMissing{ver: ver}
+	}
+	return c, nil
+}
+
+// v1Codec is version 1. It only uses the password and the MaxCost of its options.
+// Version 1 files can't be signed, so they are refused when opts.Signed is set
+type v1Codec struct{}
+
+func (v1Codec) Version() uint16 {
+	return v1.Version
+}
+
+func (v1Codec) NewEnc(pass []byte, w io.Writer, opts CodecEncOptions) (io.WriteCloser, error) {
+	return v1.NewEnc(pass, argon2Cost(opts), w)
+}
+
+func (c v1Codec) NewDec(pass []byte, r io.ReadSeeker, opts CodecDecOptions) (io.ReadCloser, error) {
+	return c.NewSeekDec(pass, r, opts)
+}
+
+func (v1Codec) NewSeekDec(pass []byte, r io.ReadSeeker, opts CodecDecOptions) (SeekDecrypter, error) {
+	if opts.Signed {
+		return nil, v2.ErrUnsigned
+	}
+	return v1.NewSeekDecLimit(pass, r, opts.MaxCost)
+}
+
+func (v1Codec) ReadHeader(r io.Reader) (fmt.Stringer, error) {
+	hb := make([]byte, v1.LenHeader)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		return nil, err
+	}
+	return v1.ExtractCryptoHeader(hb), nil
+}
+
+// v2Codec is version 2. Its Format options are v2.EncOptions and v2.DecOptions
+type v2Codec struct{}
+
+// v2EncOptions returns the v2.EncOptions of opts
+func v2EncOptions(opts CodecEncOptions) v2.EncOptions {
+	o, _ := opts.Format.(v2.EncOptions)
+	return o
+}
+
+// v2DecOptions returns the v2.DecOptions of opts, limited to its MaxCost
+func v2DecOptions(opts CodecDecOptions) v2.DecOptions {
+	o, _ := opts.Format.(v2.DecOptions)
+	o.MaxCost = opts.MaxCost
+	return o
+}
+
+func (v2Codec) Version() uint16 {
+	return v2.Version
+}
+
+func (v2Codec) NewEnc(pass []byte, w io.Writer, opts CodecEncOptions) (io.WriteCloser, error) {
+	return v2.NewEncOptions(pass, argon2Cost(opts), w, v2EncOptions(opts))
+}
+
+func (v2Codec) NewDec(pass []byte, r io.ReadSeeker, opts CodecDecOptions) (io.ReadCloser, error) {
+	return v2.NewDecOptions(pass, r, v2DecOptions(opts))
+}
+
+func (v2Codec) NewSeekDec(pass []byte, r io.ReadSeeker, opts CodecDecOptions) (SeekDecrypter, error) {
+	return v2.NewSeekDecOptions(pass, r, v2DecOptions(opts))
+}
+
+func (v2Codec) NewStreamDec(pass []byte, r io.Reader, opts CodecDecOptions) (io.ReadCloser, error) {
+	return v2.NewDecOptions(pass, r, v2DecOptions(opts))
+}
+
+func (v2Codec) ReadHeader(r io.Reader) (fmt.Stringer, error) {
+	ch, err := v2.ReadCryptoHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (v2Codec) Rekey(oldPass, newPass []byte, path string, encOpts CodecEncOptions, decOpts CodecDecOptions) error {
+	return v2.Rekey(oldPass, newPass, argon2Cost(encOpts), decOpts.MaxCost, path)
+}
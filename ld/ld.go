@@ -4,15 +4,23 @@ import (
 	"errors"
 	"fmt"
 	"github.com/raz-varren/lockdown/ld/ldtools"
+	"github.com/raz-varren/lockdown/ld/parity"
 	"github.com/raz-varren/lockdown/ld/v1"
+	"github.com/raz-varren/lockdown/ld/v2"
+	"github.com/raz-varren/lockdown/ld/volume"
 	"io"
+	"os"
 )
 
 var (
-	// supported versions
-	Versions = ldtools.NewVersionMap(v1.Version)
+	// supported versions, every version with a registered Codec
+	Versions = ldtools.NewVersionMap()
 
-	ErrBadVer = errors.New("failed to read encryption version")
+	// the version NewEnc and EncryptFile write, and that files are upgraded to
+	LatestVersion = v2.Version
+
+	ErrBadVer        = errors.New("failed to read encryption version")
+	ErrVolumeInPlace = errors.New("split volumes can only be decrypted as files, starting from the first volume, and can't be rekeyed or upgraded in place")
 )
 
 type ErrVerMissing struct {
@@ -28,50 +36,330 @@ func (e ErrVerMissing) Error() string {
 //
 // Close must be called on the returned io.WriteCloser when finished writing
 // and before the underlying io.Writer is closed otherwise the WriteCloser will
-// not know when to write signatures of the encrypted data
+// not know when to write the final chunk of the encrypted data
 func NewEnc(pass []byte, cp v1.CostParams, w io.Writer) (io.WriteCloser, error) {
+	return NewEncOptions(pass, cp, w, v2.EncOptions{})
+}
+
+// NewEncOptions is NewEnc with the options of v2.NewEncOptions, such as encrypting
+// to a set of recipient public keys. The data is written as LatestVersion. When
+// opts.Parity is set, the encrypted data is wrapped with a parity.Writer, and when
+// opts.Armor is set, everything is written as text by NewArmorWriter
+func NewEncOptions(pass []byte, cp v1.CostParams, w io.Writer, opts v2.EncOptions) (io.WriteCloser, error) {
 	// ideally we can just replace this with newer versions to
 	// always keep users on the latest encryption standards
-	return v1.NewEnc(pass, cp, w)
+	c, err := Lookup(LatestVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Armor {
+		aw, err := NewArmorWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		w = aw
+	}
+
+	if opts.Parity > 0 {
+		pw, err := parity.NewWriter(w, opts.Parity)
+		if err != nil {
+			return nil, err
+		}
+		w = pw
+	}
+
+	return c.NewEnc(pass, w, codecEncOptions(cp, opts))
 }
 
 // NewDec returns an io.ReadCloser that will decrypt r. If the provided password is incorrect,
-// and ErrSigMismatch will be returned. ErrSigMismatch may also indicate the encrypted file was
-// tampered with, as there is no way to know if the key was wrong or the file is compromised.
+// version 2 data returns v2.ErrWrongPassword right after the key is derived, and ErrSigMismatch
+// means the data was tampered with. Version 1 data has no way to check the key on its own, so a
+// wrong password is only found once the whole file is verified, and is reported as ErrSigMismatch.
+//
+// r is dispatched to the Codec registered for its version bytes. Data with parity is
+// read through a parity.Reader, so any damage the parity can repair is repaired
+// before the data is authenticated. Armored data is decoded by NewArmorReader and
+// spooled to a temp file as described by NewStreamDec, since it can't be seeked. Version 1
+// data is fully verified before NewDec returns. Version 2 data is verified chunk by chunk
+// as it is read, so Read may also return ErrSigMismatch.
 //
 // The returned io.ReadCloser, must be closed once it is no longer needed,
 // in order to clear the derived key from protected memory.
 func NewDec(pass []byte, r io.ReadSeeker) (io.ReadCloser, error) {
-	b := make([]byte, 2)
-	_, err := r.Seek(0, io.SeekStart)
+	return NewDecOptions(pass, r, v2.DecOptions{})
+}
+
+// NewDecOptions is NewDec with the options of v2.NewDecOptions, such as identities to
+// try against the recipients of the file. Version 1 files only use the password and
+// opts.MaxCost. Files that cost more than opts.MaxCost to derive a key for are refused
+// with a v1.ErrCostLimit before the key is derived.
+func NewDecOptions(pass []byte, r io.ReadSeeker, opts v2.DecOptions) (io.ReadCloser, error) {
+	if armored, err := peekArmor(r); err != nil {
+		return nil, err
+	} else if armored {
+		ar, err := NewArmorReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return newSpoolDec(pass, ar, opts)
+	}
+
+	c, r, err := seekCodec(r)
 	if err != nil {
 		return nil, err
 	}
+	return c.NewDec(pass, r, codecDecOptions(opts))
+}
+
+// NewSeekDec is NewDec, except the returned SeekDecrypter can also Seek and ReadAt any offset
+// of the plaintext, so byte ranges of large files can be read without decrypting from the start.
+// Version 1 data is fully verified before NewSeekDec returns. Version 2 data has its header and
+// final chunk verified up front, and each other chunk is verified when it is first read.
+//
+// The returned SeekDecrypter, must be closed once it is no longer needed,
+// in order to clear the derived key from protected memory.
+func NewSeekDec(pass []byte, r io.ReadSeeker) (SeekDecrypter, error) {
+	return NewSeekDecOptions(pass, r, v2.DecOptions{})
+}
 
-	if _, err = io.ReadFull(r, b); err != nil {
-		return nil, ErrBadVer
+// NewSeekDecOptions is NewSeekDec with the options of NewDecOptions
+func NewSeekDecOptions(pass []byte, r io.ReadSeeker, opts v2.DecOptions) (SeekDecrypter, error) {
+	if armored, err := peekArmor(r); err != nil {
+		return nil, err
+	} else if armored {
+		return newSpoolSeekDec(pass, r, opts)
+	}
+
+	c, r, err := seekCodec(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewSeekDec(pass, r, codecDecOptions(opts))
+}
+
+// ReadHeader returns the crypto header of r, as read by the Codec registered for its version
+func ReadHeader(r io.ReadSeeker) (fmt.Stringer, error) {
+	if armored, err := peekArmor(r); err != nil {
+		return nil, err
+	} else if armored {
+		f, err := spoolArmor(r)
+		if err != nil {
+			return nil, err
+		}
+		defer removeSpool(f)
+		r = f
+	}
+
+	c, r, err := seekCodec(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.ReadHeader(r)
+}
+
+// readVer reads the version bytes from r and checks that the version is supported
+func readVer(r io.Reader) (uint16, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, ErrBadVer
 	}
 
 	ver := ldtools.Btou16(b)
-	if !Versions.Sup(ver) {
-		return nil, ErrVerMissing{ver: ver}
+	if ver == parity.Version {
+		return 0, ErrParityInPlace
+	}
+	if string(b) == ArmorBegin[:2] {
+		return 0, ErrArmorInPlace
+	}
+	if ver == volume.Version {
+		return 0, ErrVolumeInPlace
+	}
+	if _, err := Lookup(ver); err != nil {
+		return 0, err
+	}
+
+	return ver, nil
+}
+
+// seekCodec returns the Codec for the version bytes at the start of r, along with
+// the reader to pass it, rewound back to the start. Data with parity is unwrapped first
+func seekCodec(r io.ReadSeeker) (Codec, io.ReadSeeker, error) {
+	if parity.Detect(r) {
+		pr, err := parity.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		r = pr
 	}
 
-	// rewind back to start
 	if _, err := r.Seek(0, io.SeekStart); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// we only have one supported version to return
-	return v1.NewDec(pass, r)
+	ver, err := readVer(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	c, err := Lookup(ver)
+	return c, r, err
 }
 
 // EncryptFile will encrypt fileIn and store the encrypted result at fileOut
 func EncryptFile(pass []byte, cp v1.CostParams, fileIn, fileOut string) error {
-	return v1.EncryptFile(pass, cp, fileIn, fileOut)
+	return EncryptFileOptions(pass, cp, fileIn, fileOut, v2.EncOptions{})
+}
+
+// EncryptFileOptions is EncryptFile with the options of NewEncOptions. Unless opts.SkipMeta
+// is set, the metadata of fileIn is stored along with it as described by v2.EncryptFileOptions.
+// When opts.Split is set, the encrypted file is split into volumes of that size, named
+// fileOut.001, fileOut.002, and so on, as written by a volume.Writer
+func EncryptFileOptions(pass []byte, cp v1.CostParams, fileIn, fileOut string, opts v2.EncOptions) error {
+	plainFile, err := os.Open(fileIn)
+	if err != nil {
+		return err
+	}
+	defer plainFile.Close()
+
+	if opts.Meta == nil && !opts.SkipMeta {
+		if opts.Meta, err = v2.FileMeta(fileIn); err != nil {
+			return err
+		}
+	}
+
+	encF, err := createFile(fileOut, opts)
+	if err != nil {
+		return err
+	}
+	defer encF.Close()
+
+	encW, err := NewEncOptions(pass, cp, encF, opts)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(encW, plainFile); err != nil {
+		encW.Close()
+		return err
+	}
+
+	return encW.Close()
 }
 
-// DecryptFile will decrypt fileIn and store the plaintext result at fileOut
+// DecryptFile will decrypt fileIn and store the plaintext result at fileOut.
+// fileOut is only created once fileIn has been verified as far as NewSeekDec
+// verifies it, and it is removed if any later chunk fails to verify. When fileIn
+// is the first volume of a split file, the rest of the volumes are found and
+// checked by volume.Open, and decrypted as one file. Version 1 files are read only once,
+// into a temp file that is renamed to fileOut once it is verified, by v1.DecryptToFile.
 func DecryptFile(pass []byte, fileIn, fileOut string) error {
-	return v1.DecryptFile(pass, fileIn, fileOut)
+	return DecryptFileOptions(pass, fileIn, fileOut, v2.DecOptions{})
+}
+
+// DecryptFileOptions is DecryptFile with the options of NewDecOptions. The metadata of
+// version 2 files is restored as described by v2.DecryptFileOptions
+func DecryptFileOptions(pass []byte, fileIn, fileOut string, opts v2.DecOptions) error {
+	_, err := DecryptFileMeta(pass, fileIn, fileOut, opts)
+	return err
+}
+
+// DecryptFileMeta is DecryptFileOptions, and also returns the metadata of the original file,
+// such as its name. The metadata is nil for files that don't have any, like version 1 files.
+// As with v2.DecryptFileOptions, fileOut is kept along with a v2.ErrMetaNotRestored if the
+// metadata can't be restored
+func DecryptFileMeta(pass []byte, fileIn, fileOut string, opts v2.DecOptions) (*v2.Metadata, error) {
+	encFile, err := openFile(fileIn)
+	if err != nil {
+		return nil, err
+	}
+	defer encFile.Close()
+
+	if r, ok := v1File(encFile); ok {
+		if len(opts.Trusted) > 0 {
+			return nil, v2.ErrUnsigned
+		}
+		return nil, v1.DecryptToFile(pass, r, fileOut, opts.MaxCost)
+	}
+
+	decR, err := NewSeekDecOptions(pass, encFile, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer decR.Close()
+
+	plainFile, err := os.OpenFile(fileOut, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta *v2.Metadata
+	if md, ok := decR.(v2.MetaDecrypter); ok {
+		meta = md.Meta()
+	}
+
+	_, err = io.Copy(plainFile, decR)
+	if cErr := plainFile.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(fileOut)
+		return nil, err
+	}
+	if meta != nil && !opts.SkipMeta {
+		return meta, meta.Apply(fileOut, !opts.SkipOwner)
+	}
+	return meta, nil
+}
+
+// v1File returns r, unwrapped from any parity and rewound to the start, if it holds a
+// version 1 file. Version 1 files are decrypted to a file in a single pass, with
+// v1.DecryptToFile, rather than reading them once to verify and again to decrypt
+func v1File(r io.ReadSeeker) (io.ReadSeeker, bool) {
+	if armored, err := peekArmor(r); err != nil || armored {
+		return nil, false
+	}
+	c, r, err := seekCodec(r)
+	if err != nil || c.Version() != v1.Version {
+		return nil, false
+	}
+	return r, true
+}
+
+// createFile creates fileOut to write encrypted data to, or a volume.Writer
+// that splits it into volumes when opts.Split is set
+func createFile(fileOut string, opts v2.EncOptions) (io.WriteCloser, error) {
+	if opts.Split > 0 {
+		return volume.NewWriter(fileOut, opts.Split)
+	}
+	return os.OpenFile(fileOut, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+// readSeekCloser is an opened encrypted file
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// openFile opens the encrypted file at path, or the whole set of volumes when
+// path is the first volume of a split file
+func openFile(path string) (readSeekCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !volume.Detect(f) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	f.Close()
+	return volume.Open(path)
 }
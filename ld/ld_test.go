@@ -1,14 +1,28 @@
 package ld_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"github.com/raz-varren/lockdown/ld"
 	"github.com/raz-varren/lockdown/ld/ldtools"
 	"github.com/raz-varren/lockdown/ld/v1"
+	"github.com/raz-varren/lockdown/ld/v2"
+	"github.com/raz-varren/lockdown/ld/volume"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+const (
+	decryptableFilePath = "../testdata/decryptable.file.lkd"
+)
+
 func TestEncDec(t *testing.T) {
 	dir, err := ioutil.TempDir("", "lockdown_ld_tests_")
 	if err != nil {
@@ -33,6 +47,14 @@ func TestEncDec(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	ver, err := ioutil.ReadFile(encFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldtools.Btou16(ver[:2]) != v2.Version {
+		t.Fatalf("expected new files to be version (%d), but got (%d)", v2.Version, ldtools.Btou16(ver[:2]))
+	}
+
 	err = ld.DecryptFile(pass, encFileName, decFileName)
 	if err != nil {
 		t.Fatal(err)
@@ -47,3 +69,943 @@ func TestEncDec(t *testing.T) {
 		t.Fatalf("file hashes don't match: %x != %x", rtf.Sum(), sum)
 	}
 }
+
+func TestDecV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_ld_tests_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pass := []byte("testpassword")
+
+	err = ld.DecryptFile(pass, decryptableFilePath, filepath.Join(dir, "decrypted.file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(decryptableFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dec, err := ld.NewDec(pass, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	if _, err := ioutil.ReadAll(dec); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecV1Trusted(t *testing.T) {
+	sk, err := v2.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sk.Destroy()
+
+	f, err := os.Open(decryptableFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// version 1 files can't be signed
+	_, err = ld.NewDecOptions([]byte("testpassword"), f, v2.DecOptions{Trusted: []v2.VerifyingKey{sk.VerifyingKey()}})
+	if err != v2.ErrUnsigned {
+		t.Fatalf("expected (%v), but got (%v)", v2.ErrUnsigned, err)
+	}
+}
+
+func TestDecBadVer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_ld_tests_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	badVerFile := filepath.Join(dir, "badver.file.lkd")
+	if err := ioutil.WriteFile(badVerFile, ldtools.U16tob(9999), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ld.DecryptFile([]byte("testpassword"), badVerFile, filepath.Join(dir, "badver.file"))
+	if _, ok := err.(ld.ErrVerMissing); !ok {
+		t.Fatalf("expected (ErrVerMissing), but got (%v)", err)
+	}
+}
+
+// hides any Seek method so only Read is available
+type onlyReader struct {
+	r io.Reader
+}
+
+func (or onlyReader) Read(p []byte) (int, error) {
+	return or.r.Read(p)
+}
+
+func TestStreamDec(t *testing.T) {
+	pass := []byte("testpassword")
+	data := make([]byte, 1024*200)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc, err := ld.NewEnc(pass, v1.CostParams{Time: 1, Memory: 1024 * 64, Threads: 2}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := ld.NewStreamDec(pass, onlyReader{r: buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	plain, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, data) {
+		t.Fatal("decrypted data doesn't match original")
+	}
+}
+
+func TestStreamDecV1(t *testing.T) {
+	f, err := os.Open(decryptableFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dec, err := ld.NewStreamDec([]byte("testpassword"), onlyReader{r: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	if _, err := ioutil.ReadAll(dec); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamDecSpoolLimit(t *testing.T) {
+	defer func(limit int64) { ld.SpoolLimit = limit }(ld.SpoolLimit)
+	ld.SpoolLimit = 16
+
+	f, err := os.Open(decryptableFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dec, err := ld.NewStreamDec([]byte("testpassword"), onlyReader{r: f})
+	if err == nil {
+		dec.Close()
+	}
+	if err != ld.ErrSpoolLimit {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrSpoolLimit, err)
+	}
+}
+
+func TestSeekDec(t *testing.T) {
+	pass := []byte("testpassword")
+	data := make([]byte, 1024*200+7)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc, err := ld.NewEnc(pass, v1.CostParams{Time: 1, Memory: 1024 * 64, Threads: 2}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := ld.NewSeekDec(pass, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	testSeekDec(t, dec, data)
+}
+
+func TestSeekDecV1(t *testing.T) {
+	pass := []byte("testpassword")
+	data, err := ioutil.ReadFile(decryptableFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the plaintext comes from the sequential decrypter
+	f, err := os.Open(decryptableFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dec, err := ld.NewSeekDec(pass, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	plain, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// repeat with an in memory copy that hides ReadAt
+	seekOnly := struct{ io.ReadSeeker }{bytes.NewReader(data)}
+	dec2, err := ld.NewSeekDec(pass, seekOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec2.Close()
+
+	testSeekDec(t, dec2, plain)
+}
+
+func testSeekDec(t *testing.T, dec v1.SeekDecrypter, data []byte) {
+	if dec.Size() != int64(len(data)) {
+		t.Fatalf("expected size (%d), but got (%d)", len(data), dec.Size())
+	}
+
+	size := int64(len(data))
+	ranges := [][2]int64{{0, 0}, {0, 1}, {1, 17}, {size / 3, size / 2}, {size - 1, size}, {0, size}}
+	for _, rng := range ranges {
+		p := make([]byte, rng[1]-rng[0])
+		n, err := dec.ReadAt(p, rng[0])
+		if err != nil && !(err == io.EOF && rng[1] == size) {
+			t.Fatalf("ReadAt(%d-%d): %v", rng[0], rng[1], err)
+		}
+		if !bytes.Equal(p[:n], data[rng[0]:rng[1]]) {
+			t.Fatalf("ReadAt(%d-%d): data doesn't match original", rng[0], rng[1])
+		}
+	}
+
+	if _, err := dec.Seek(size/2, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, data[size/2:]) {
+		t.Fatal("data read after Seek doesn't match original")
+	}
+
+	n, err := dec.ReadAt(make([]byte, 1), size)
+	if n != 0 || err != io.EOF {
+		t.Fatalf("expected (0, EOF) reading past the end, but got (%d, %v)", n, err)
+	}
+}
+
+func TestRekeyV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_ld_tests_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v1Data, err := ioutil.ReadFile(decryptableFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1File := filepath.Join(dir, "v1.file.lkd")
+	if err := ioutil.WriteFile(v1File, v1Data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ld.Rekey([]byte("testpassword"), []byte("newpassword"), v1.CostFast, v1.CostParams{}, v1File)
+	if err != ld.ErrRekeyV1 {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrRekeyV1, err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_ld_tests_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pass := []byte("testpassword")
+	cp := v1.CostParams{Time: 1, Memory: 1024 * 128, Threads: 4}
+
+	rtf, err := ldtools.NewRandTmpFile(dir, "test_upgrade_*.file", 1024*128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtf.Close()
+
+	encFileName := rtf.File().Name() + ".lkd"
+	if err := v1.EncryptFile(pass, cp, rtf.File().Name(), encFileName); err != nil {
+		t.Fatal(err)
+	}
+	v1Data, err := ioutil.ReadFile(encFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ld.Upgrade([]byte("wrong password"), encFileName, v2.Version, cp)
+	if err != v1.ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", v1.ErrSigMismatch, err)
+	}
+	if data, _ := ioutil.ReadFile(encFileName); !bytes.Equal(data, v1Data) {
+		t.Fatal("a failed upgrade changed the original file")
+	}
+
+	if err := ld.Upgrade(pass, encFileName, v2.Version, cp); err != nil {
+		t.Fatal(err)
+	}
+	if ver, err := ld.FileVersion(encFileName); err != nil || ver != v2.Version {
+		t.Fatalf("expected version (%d), but got (%d) (%v)", v2.Version, ver, err)
+	}
+
+	decFileName := rtf.File().Name() + ".dec"
+	if err := ld.DecryptFile(pass, encFileName, decFileName); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := ldtools.FileSha256(decFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rtf.Equal(sum) {
+		t.Fatalf("file hashes don't match: %x != %x", rtf.Sum(), sum)
+	}
+
+	// nothing is left behind in the directory
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, but got %d", len(files))
+	}
+
+	if err := ld.Upgrade(pass, encFileName, v2.Version, cp); err != nil {
+		t.Fatalf("expected (nil) upgrading a file that is already up to date, but got (%v)", err)
+	}
+	if err := ld.Upgrade(pass, encFileName, v1.Version, cp); err != ld.ErrDowngrade {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrDowngrade, err)
+	}
+}
+
+// plainCodec is a Codec that stores its data as is, to test the registry
+type plainCodec struct{}
+
+const plainVersion uint16 = 9001
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (plainCodec) Version() uint16 {
+	return plainVersion
+}
+
+func (plainCodec) NewEnc(pass []byte, w io.Writer, opts ld.CodecEncOptions) (io.WriteCloser, error) {
+	if _, err := w.Write(ldtools.U16tob(plainVersion)); err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{w}, nil
+}
+
+func (plainCodec) NewDec(pass []byte, r io.ReadSeeker, opts ld.CodecDecOptions) (io.ReadCloser, error) {
+	if _, err := r.Seek(2, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+func (plainCodec) NewSeekDec(pass []byte, r io.ReadSeeker, opts ld.CodecDecOptions) (ld.SeekDecrypter, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (plainCodec) ReadHeader(r io.Reader) (fmt.Stringer, error) {
+	return nil, errors.New("not implemented")
+}
+
+func isVerMissing(err error) bool {
+	_, ok := err.(ld.ErrVerMissing)
+	return ok
+}
+
+func TestRegister(t *testing.T) {
+	if _, err := ld.Lookup(plainVersion); !isVerMissing(err) {
+		t.Fatalf("expected (ErrVerMissing), but got (%v)", err)
+	}
+
+	if err := ld.Register(plainCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if !ld.Versions.Sup(plainVersion) {
+		t.Fatalf("expected version (%d) to be supported", plainVersion)
+	}
+	if sl := ld.Versions.SupList(); sl != "1, 2, 9001" {
+		t.Fatalf("expected (1, 2, 9001), but got (%s)", sl)
+	}
+	err := ld.ErrVerMissing{}
+	if !strings.Contains(err.Error(), "(1, 2, 9001)") {
+		t.Fatalf("expected the registered versions in (%v)", err)
+	}
+
+	c, lErr := ld.Lookup(plainVersion)
+	if lErr != nil {
+		t.Fatal(lErr)
+	}
+	data := make([]byte, 1024)
+	rand.Read(data)
+
+	buf := bytes.NewBuffer(nil)
+	enc, lErr := c.NewEnc(nil, buf, ld.CodecEncOptions{})
+	if lErr != nil {
+		t.Fatal(lErr)
+	}
+	enc.Write(data)
+	enc.Close()
+	encData := buf.Bytes()
+
+	dec, lErr := ld.NewDec(nil, bytes.NewReader(encData))
+	if lErr != nil {
+		t.Fatal(lErr)
+	}
+	got, _ := ioutil.ReadAll(dec)
+	dec.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatal("decrypted data doesn't match")
+	}
+
+	// plainCodec isn't a StreamCodec, so it is spooled
+	dec, lErr = ld.NewStreamDec(nil, onlyReader{bytes.NewReader(encData)})
+	if lErr != nil {
+		t.Fatal(lErr)
+	}
+	got, _ = ioutil.ReadAll(dec)
+	dec.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatal("streamed data doesn't match")
+	}
+
+	// the first Codec registered for a version is kept
+	if err, ok := ld.Register(plainCodec{}).(ld.ErrVerRegistered); !ok {
+		t.Fatalf("expected (ErrVerRegistered), but got (%v)", err)
+	}
+}
+
+func TestParity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_ld_tests_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pass := []byte("testpassword")
+	cp := v1.CostParams{Time: 1, Memory: 1024 * 128, Threads: 4}
+
+	rtf, err := ldtools.NewRandTmpFile(dir, "test_parity_*.file", 1024*256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtf.Close()
+
+	encFileName := rtf.File().Name() + ".lkd"
+	if err := ld.EncryptFileOptions(pass, cp, rtf.File().Name(), encFileName, v2.EncOptions{Parity: 10}); err != nil {
+		t.Fatal(err)
+	}
+	encData, err := ioutil.ReadFile(encFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a bit near the start, where the version bytes and header are,
+	// and one in the middle of the file
+	damaged := append([]byte{}, encData...)
+	damaged[0] ^= 1
+	damaged[len(damaged)/2] ^= 1
+	if err := ioutil.WriteFile(encFileName, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := ld.NewDec(pass, bytes.NewReader(damaged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := ldtools.ReaderSha256(dec)
+	dec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rtf.Equal(sum) {
+		t.Fatalf("file hashes don't match: %x != %x", rtf.Sum(), sum)
+	}
+
+	n, err := ld.Repair(encFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 2 {
+		t.Fatalf("expected at least (2) repairs, but got (%d)", n)
+	}
+	if data, _ := ioutil.ReadFile(encFileName); !bytes.Equal(data, encData) {
+		t.Fatal("the repaired file doesn't match the original")
+	}
+	if n, err := ld.Repair(encFileName); n != 0 || err != nil {
+		t.Fatalf("expected (0) repairs of an undamaged file, but got (%d) (%v)", n, err)
+	}
+
+	err = ld.Rekey(pass, []byte("newpassword"), cp, v1.CostParams{}, encFileName)
+	if err != ld.ErrParityInPlace {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrParityInPlace, err)
+	}
+
+	dec, err = ld.NewStreamDec(pass, onlyReader{bytes.NewReader(encData)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err = ldtools.ReaderSha256(dec)
+	dec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rtf.Equal(sum) {
+		t.Fatalf("streamed file hashes don't match: %x != %x", rtf.Sum(), sum)
+	}
+}
+
+func TestArmor(t *testing.T) {
+	data := make([]byte, 1000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	aw, err := ld.NewArmorWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	armored := buf.String()
+
+	// armor that was indented and rewrapped when it was pasted still decodes
+	lines := strings.Split(armored, "\n")
+	pasted := []string{"see below", lines[0], lines[1][:30], lines[1][30:] + lines[2][:5]}
+	pasted = append(pasted, lines[2][5:])
+	pasted = append(pasted, lines[3:]...)
+
+	ar, err := ld.NewArmorReader(strings.NewReader("  " + strings.Join(pasted, "\n  ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the decoded data doesn't match the original")
+	}
+
+	// change one character of the base64 to another valid one
+	line := []byte(lines[3])
+	if line[10] == 'A' {
+		line[10] = 'B'
+	} else {
+		line[10] = 'A'
+	}
+	lines[3] = string(line)
+	ar, err = ld.NewArmorReader(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(ar); err != ld.ErrArmorChecksum {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrArmorChecksum, err)
+	}
+
+	ar, err = ld.NewArmorReader(strings.NewReader(armored[:len(armored)/2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(ar); err != ld.ErrBadArmor {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrBadArmor, err)
+	}
+
+	if _, err := ld.NewArmorReader(bytes.NewReader(data)); err != ld.ErrNoArmor {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrNoArmor, err)
+	}
+
+	// base64 pasted as a single line, far longer than a bufio.Scanner token
+	data = make([]byte, 1024*128)
+	rand.Read(data)
+	buf.Reset()
+	aw, err = ld.NewArmorWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.Write(data)
+	aw.Close()
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	n := len(lines)
+	oneLine := strings.Join([]string{lines[0], strings.Join(lines[1:n-2], ""), lines[n-2], lines[n-1]}, "\n")
+	ar, err = ld.NewArmorReader(strings.NewReader(oneLine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the decoded data doesn't match the original")
+	}
+}
+
+func TestArmorFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_ld_tests_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pass := []byte("testpassword")
+	cp := v1.CostParams{Time: 1, Memory: 1024 * 64, Threads: 2}
+
+	rtf, err := ldtools.NewRandTmpFile(dir, "test_armor_*.file", 1024*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtf.Close()
+
+	for _, opts := range []v2.EncOptions{{Armor: true}, {Armor: true, Parity: 10}} {
+		encFileName := fmt.Sprintf("%s.%d.lkd.asc", rtf.File().Name(), opts.Parity)
+		if err := ld.EncryptFileOptions(pass, cp, rtf.File().Name(), encFileName, opts); err != nil {
+			t.Fatal(err)
+		}
+		encData, err := ioutil.ReadFile(encFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(encData, []byte(ld.ArmorBegin+"\n")) {
+			t.Fatalf("expected the file to start with (%s)", ld.ArmorBegin)
+		}
+
+		decFileName := encFileName + ".dec"
+		meta, err := ld.DecryptFileMeta(pass, encFileName, decFileName, v2.DecOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta == nil || meta.Name != filepath.Base(rtf.File().Name()) {
+			t.Fatalf("expected the metadata of (%s), but got (%v)", rtf.File().Name(), meta)
+		}
+		sum, err := ldtools.FileSha256(decFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rtf.Equal(sum) {
+			t.Fatalf("file hashes don't match: %x != %x", rtf.Sum(), sum)
+		}
+
+		dec, err := ld.NewStreamDec(pass, onlyReader{bytes.NewReader(encData)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, err = ldtools.ReaderSha256(dec)
+		dec.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rtf.Equal(sum) {
+			t.Fatalf("streamed file hashes don't match: %x != %x", rtf.Sum(), sum)
+		}
+
+		if _, err := ld.ReadHeader(bytes.NewReader(encData)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ld.Rekey(pass, []byte("newpassword"), cp, v1.CostParams{}, encFileName); err != ld.ErrArmorInPlace {
+			t.Fatalf("expected (%v), but got (%v)", ld.ErrArmorInPlace, err)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_ld_tests_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pass := []byte("testpassword")
+	cp := v1.CostParams{Time: 1, Memory: 1024 * 64, Threads: 2}
+
+	tree := filepath.Join(dir, "tree")
+	files := map[string][]byte{
+		"tree/a.txt":         []byte("hello"),
+		"tree/sub/b.file":    make([]byte, 1024*100),
+		"tree/sub/deep/c.sh": []byte("#!/bin/sh\n"),
+	}
+	rand.Read(files["tree/sub/b.file"])
+	for name, data := range files {
+		fp := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fp, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chmod(filepath.Join(tree, "sub/deep/c.sh"), 0750)
+	if err := os.Mkdir(filepath.Join(tree, "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink(filepath.Join(tree, "a.txt"), filepath.Join(tree, "link"))
+
+	// the archive is written inside the tree, and must not archive itself
+	archive := filepath.Join(tree, "tree.lkd")
+	if err := ld.EncryptArchive(pass, cp, archive, []string{tree}, v2.EncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ld.ListArchive(pass, archive, v2.DecOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	expected := "tree tree/a.txt tree/empty tree/sub tree/sub/b.file tree/sub/deep tree/sub/deep/c.sh"
+	if strings.Join(names, " ") != expected {
+		t.Fatalf("expected (%s), but got (%s)", expected, strings.Join(names, " "))
+	}
+
+	dest := filepath.Join(dir, "out")
+	extracted, err := ld.ExtractArchive(pass, archive, dest, v2.DecOptions{SkipOwner: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extracted) != len(entries) {
+		t.Fatalf("expected (%d) extracted entries, but got (%d)", len(entries), len(extracted))
+	}
+	for name, data := range files {
+		fp := filepath.Join(dest, filepath.FromSlash(name))
+		got, err := ioutil.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("the extracted file (%s) doesn't match the original", name)
+		}
+	}
+	if stat, err := os.Stat(filepath.Join(dest, "tree/sub/deep/c.sh")); err != nil || stat.Mode().Perm() != 0750 {
+		t.Fatalf("expected the mode (%v) to be restored, but got (%v) (%v)", os.FileMode(0750), stat, err)
+	}
+	if stat, err := os.Stat(filepath.Join(dest, "tree/empty")); err != nil || !stat.IsDir() {
+		t.Fatalf("expected the empty directory to be extracted, but got (%v)", err)
+	}
+
+	if _, err := ld.ExtractArchive(pass, archive, dest, v2.DecOptions{}); err != ld.ErrArchiveExists {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrArchiveExists, err)
+	}
+
+	// a tampered archive leaves nothing behind
+	encData, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encData[len(encData)-10] ^= 1
+	if err := ioutil.WriteFile(archive, encData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tampered := filepath.Join(dir, "tampered")
+	if _, err := ld.ExtractArchive(pass, archive, tampered, v2.DecOptions{}); err != v1.ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", v1.ErrSigMismatch, err)
+	}
+	if left, _ := ioutil.ReadDir(tampered); len(left) != 0 {
+		t.Fatalf("expected nothing to be extracted, but got (%d) entries", len(left))
+	}
+
+	if err := ld.EncryptArchive(pass, cp, filepath.Join(dir, "dup.lkd"), []string{tree, filepath.Join(dir, "out/tree")}, v2.EncOptions{}); err != ld.ErrArchiveNames {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrArchiveNames, err)
+	}
+}
+
+func TestReadArchivePath(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "tree/../../evil", Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ld.ReadArchive(buf, func(e ld.ArchiveEntry, r io.Reader) error {
+		return nil
+	})
+	if _, ok := err.(ld.ErrArchivePath); !ok {
+		t.Fatalf("expected (%v), but got (%v)", ld.ErrArchivePath{Name: "tree/../../evil"}, err)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_ld_tests_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pass := []byte("testpassword")
+	cp := v1.CostParams{Time: 1, Memory: 1024 * 64, Threads: 2}
+
+	rtf, err := ldtools.NewRandTmpFile(dir, "test_split_*.file", 1024*100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtf.Close()
+
+	for _, opts := range []v2.EncOptions{{Split: 1024 * 16}, {Split: 1024 * 16, Parity: 10, Armor: true}} {
+		encFileName := fmt.Sprintf("%s.%d.lkd", rtf.File().Name(), opts.Parity)
+		if err := ld.EncryptFileOptions(pass, cp, rtf.File().Name(), encFileName, opts); err != nil {
+			t.Fatal(err)
+		}
+		first := volume.Name(encFileName, 0)
+
+		decFileName := encFileName + ".dec"
+		if err := ld.DecryptFile(pass, first, decFileName); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := ldtools.FileSha256(decFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rtf.Equal(sum) {
+			t.Fatalf("file hashes don't match: %x != %x", rtf.Sum(), sum)
+		}
+
+		if err := ld.Rekey(pass, []byte("newpassword"), cp, v1.CostParams{}, first); err != ld.ErrVolumeInPlace {
+			t.Fatalf("expected (%v), but got (%v)", ld.ErrVolumeInPlace, err)
+		}
+
+		os.Remove(volume.Name(encFileName, 2))
+		err = ld.DecryptFile(pass, first, encFileName+".missing")
+		if err != (volume.ErrMissing{Name: volume.Name(encFileName, 2)}) {
+			t.Fatalf("expected (%v), but got (%v)", volume.ErrMissing{Name: volume.Name(encFileName, 2)}, err)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	pass := []byte("testpassword")
+	cp := v1.CostParams{Time: 1, Memory: 1024 * 128, Threads: 4}
+
+	for _, size := range []int{0, 1, 1024 * 100} {
+		secret := make([]byte, size)
+		rand.Read(secret)
+
+		sealed, err := ld.Seal(pass, cp, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ver := ldtools.Btou16(sealed[:2]); ver != ld.LatestVersion {
+			t.Fatalf("expected version (%d), but got (%d)", ld.LatestVersion, ver)
+		}
+
+		opened, err := ld.Open(pass, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened.Bytes(), secret) {
+			t.Fatal("opened data does not match sealed data")
+		}
+		opened.Destroy()
+	}
+
+	sealed, err := ld.SealOptions(pass, cp, []byte("api token"), v2.EncOptions{Armor: true, Compression: v2.CompressGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(sealed), ld.ArmorBegin) {
+		t.Fatal("expected armored data")
+	}
+	opened, err := ld.Open(pass, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened.Bytes()) != "api token" {
+		t.Fatal("opened data does not match sealed data")
+	}
+	opened.Destroy()
+
+	sealed, err = ld.Seal(pass, cp, []byte("api token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ld.Open([]byte("wrong password"), sealed); err != v2.ErrWrongPassword {
+		t.Fatalf("expected (%v), but got (%v)", v2.ErrWrongPassword, err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := ld.Open(pass, sealed); err != v2.ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", v2.ErrSigMismatch, err)
+	}
+
+	// a tampered chunk in the middle of compressed data is found before anything is returned
+	secret := make([]byte, 4096)
+	rand.Read(secret)
+	sealed, err = ld.SealOptions(pass, cp, secret, v2.EncOptions{
+		Compression: v2.CompressGzip,
+		ChunkSize:   64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)-(64+v2.LenTag)*3] ^= 1
+	if opened, err := ld.Open(pass, sealed); err != v2.ErrSigMismatch {
+		if opened != nil {
+			opened.Destroy()
+		}
+		t.Fatalf("expected (%v), but got (%v)", v2.ErrSigMismatch, err)
+	}
+
+	// version 1 data opens as well
+	v1Data, err := ioutil.ReadFile(decryptableFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err = ld.Open(pass, v1Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened.Destroy()
+
+	if _, err := ld.Seal(nil, cp, []byte("api token")); err != v2.ErrBadPass {
+		t.Fatalf("expected (%v), but got (%v)", v2.ErrBadPass, err)
+	}
+}
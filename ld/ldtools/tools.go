@@ -51,6 +51,18 @@ func Btou32(b []byte) uint32 {
 	return binary.BigEndian.Uint32(b)
 }
 
+// converts a uint64 number to a byte slice
+func U64tob(i uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return b
+}
+
+// converts a byte slice to a uint64 number
+func Btou64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
 type VersionMap struct {
 	mu  *sync.RWMutex
 	m   map[uint16]bool
@@ -59,27 +71,34 @@ type VersionMap struct {
 }
 
 func NewVersionMap(vers ...uint16) *VersionMap {
-	m := make(map[uint16]bool)
-	vl := []int{}
-	vls := []string{}
-	for _, v := range vers {
-		m[v] = true
-		vl = append(vl, int(v))
+	vMap := &VersionMap{
+		mu: &sync.RWMutex{},
+		m:  make(map[uint16]bool),
 	}
-	sort.Ints(vl)
+	vMap.Add(vers...)
 
-	for _, v := range vl {
-		vls = append(vls, strconv.Itoa(v))
-	}
+	return vMap
+}
 
-	vMap := &VersionMap{
-		mu:  &sync.RWMutex{},
-		m:   m,
-		vl:  vl,
-		vls: strings.Join(vls, ", "),
+// Add marks the provided versions as supported
+func (vm *VersionMap) Add(vers ...uint16) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	for _, v := range vers {
+		if vm.m[v] {
+			continue
+		}
+		vm.m[v] = true
+		vm.vl = append(vm.vl, int(v))
 	}
+	sort.Ints(vm.vl)
 
-	return vMap
+	vls := []string{}
+	for _, v := range vm.vl {
+		vls = append(vls, strconv.Itoa(v))
+	}
+	vm.vls = strings.Join(vls, ", ")
 }
 
 // Sup returns true if the provided version is supported
@@ -104,6 +123,35 @@ func GetSlices(r io.Reader, slices ...[]byte) error {
 	return nil
 }
 
+// NewReaderAt returns rs as an io.ReaderAt. If rs doesn't implement io.ReaderAt
+// itself, each ReadAt seeks rs and reads from it while holding a lock, so rs
+// should not be read from elsewhere once it has been wrapped.
+func NewReaderAt(rs io.ReadSeeker) io.ReaderAt {
+	if ra, ok := rs.(io.ReaderAt); ok {
+		return ra
+	}
+	return &seekReaderAt{mu: &sync.Mutex{}, rs: rs}
+}
+
+type seekReaderAt struct {
+	mu *sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (sra *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	sra.mu.Lock()
+	defer sra.mu.Unlock()
+
+	if _, err := sra.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(sra.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
 func NewRandMemFile(size int64) (io.ReadWriteSeeker, error) {
 	fb := filebuffer.New(nil)
 	_, err := io.CopyN(fb, rand.Reader, size)
@@ -0,0 +1,134 @@
+package parity
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+// withParity returns data with percent of parity added
+func withParity(t *testing.T, data []byte, percent int) []byte {
+	buf := bytes.NewBuffer(nil)
+	pw, err := NewWriter(buf, percent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readAll(t *testing.T, pd []byte) ([]byte, int, error) {
+	pr, err := NewReader(bytes.NewReader(pd))
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := ioutil.ReadAll(pr)
+	return data, pr.Repaired(), err
+}
+
+// shardOffset is the offset of shard i of stripe s in data written with the default layout
+func shardOffset(l layout, s, i int) int {
+	return lenHeader + s*int(l.stripeLen()) + i*(l.shardSize+lenCRC)
+}
+
+func TestParity(t *testing.T) {
+	l := layout{dataShards: defDataShards, parityShards: shardsFor(10, defDataShards), shardSize: defShardSize}
+	sizes := []int{0, 1, defShardSize, int(l.stripeData()), int(l.stripeData())*3 + 7}
+
+	for _, size := range sizes {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		pd := withParity(t, data, 10)
+		got, repaired, err := readAll(t, pd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) || repaired != 0 {
+			t.Fatalf("expected (%d) undamaged bytes, but got (%d) bytes with (%d) repairs", size, len(got), repaired)
+		}
+	}
+
+	data := make([]byte, int(l.stripeData())*3+7)
+	rand.Read(data)
+	pd := withParity(t, data, 10)
+
+	// flip a bit in as many shards of each stripe as the parity can repair, along
+	// with the version bytes and a trailer
+	damaged := append([]byte{}, pd...)
+	for s := 0; s < 4; s++ {
+		for i := 0; i < l.parityShards; i++ {
+			damaged[shardOffset(l, s, i*3)+5] ^= 1
+		}
+	}
+	damaged[0] ^= 0xff
+	damaged[len(damaged)-1] ^= 1
+
+	if !Detect(bytes.NewReader(damaged)) {
+		t.Fatal("expected the damaged data to be detected by its trailers")
+	}
+	got, repaired, err := readAll(t, damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the repaired data doesn't match")
+	}
+	if expected := 4*l.parityShards + 2; repaired != expected {
+		t.Fatalf("expected (%d) repairs, but got (%d)", expected, repaired)
+	}
+
+	fixed := bytes.NewBuffer(nil)
+	n, err := Repair(bytes.NewReader(damaged), fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != repaired || !bytes.Equal(fixed.Bytes(), pd) {
+		t.Fatalf("expected Repair to rebuild the original (%d) bytes, but got (%d) bytes with (%d) repairs", len(pd), fixed.Len(), n)
+	}
+
+	// one more damaged shard in a stripe is too many
+	damaged[shardOffset(l, 1, 1)] ^= 1
+	if _, _, err := readAll(t, damaged); err != ErrTooDamaged {
+		t.Fatalf("expected (%v), but got (%v)", ErrTooDamaged, err)
+	}
+
+	if _, _, err := readAll(t, pd[:len(pd)-lenTrailers-1]); err != ErrBadParity {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadParity, err)
+	}
+	truncated := append(append([]byte{}, pd[:lenHeader+10]...), pd[len(pd)-lenTrailers:]...)
+	if _, _, err := readAll(t, truncated); err != ErrTruncated {
+		t.Fatalf("expected (%v), but got (%v)", ErrTruncated, err)
+	}
+
+	// a trailer whose data length overflows the offsets is rejected rather than wrapped
+	huge := append(l.header(), bytes.Repeat(l.trailer(math.MaxUint64), trailerCopies)...)
+	if _, _, err := readAll(t, huge); err != ErrBadParity {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadParity, err)
+	}
+
+	pr, err := NewReader(bytes.NewReader(pd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Seek(0, 3); err != ErrBadWhence {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadWhence, err)
+	}
+
+	if Detect(bytes.NewReader(data)) {
+		t.Fatal("expected data without parity not to be detected")
+	}
+
+	for _, percent := range []int{0, 101} {
+		if _, err := NewWriter(ioutil.Discard, percent); err != ErrBadPercent {
+			t.Fatalf("expected (%v), but got (%v)", ErrBadPercent, err)
+		}
+	}
+}
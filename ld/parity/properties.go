@@ -0,0 +1,175 @@
+package parity
+
+import (
+	"errors"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"hash/crc32"
+	"math"
+)
+
+// Below is a representation of the finished data that will be written to the io.Writer passed into NewWriter:
+// Data:
+//     Header|Stripe0|Stripe1|...|StripeN|Trailer|Trailer|Trailer
+// Bytes:
+//     12|stripe size|stripe size|...|stripe size|20|20|20
+//
+// Header:
+//     Version|DataShards|ParityShards|ShardSize|CRC
+//     2|1|1|4|4
+//
+// Trailer, written three times:
+//     Version|DataShards|ParityShards|ShardSize|DataLen|CRC
+//     2|1|1|4|8|4
+//
+// Each stripe holds DataShards shards of the wrapped data followed by ParityShards
+// Reed-Solomon parity shards, the last stripe being padded with zeros:
+//     Shard|CRC
+//     ShardSize|4
+//
+// The parity is computed over the data as it was written, which is normally an encrypted
+// file, so nothing about the plaintext is revealed and the wrapped data still authenticates
+// itself once it is recovered. The CRC of each shard covers its stripe index, its index in
+// the stripe, and its data, so a damaged or misplaced shard is known to be missing, and any
+// ParityShards missing shards of a stripe can be rebuilt. The CRCs of the header and trailer
+// cover the fields before them. Any one intact trailer is enough to read the data, so even
+// the version bytes at the start of the file can be recovered.
+
+const (
+	// Version starts data with parity, in place of the version bytes of the data it wraps
+	Version uint16 = 0xfec1
+
+	//default layout, every parity shard adds 5% to the size of the data
+	defDataShards = 20
+	defShardSize  = 1024 * 4
+
+	//maximum percentage of parity accepted by NewWriter
+	maxPercent = 100
+
+	//header data length
+	lenVer          = 2
+	lenDataShards   = 1
+	lenParityShards = 1
+	lenShardSize    = 4
+	lenDataLen      = 8
+	lenCRC          = crc32.Size
+
+	//combined lengths
+	lenLayout   = lenVer + lenDataShards + lenParityShards + lenShardSize
+	lenHeader   = lenLayout + lenCRC
+	lenTrailer  = lenLayout + lenDataLen + lenCRC
+	lenTrailers = lenTrailer * trailerCopies
+
+	trailerCopies = 3
+)
+
+var (
+	ErrBadPercent = errors.New("parity must be between 1% and 100%")
+	ErrBadParity  = errors.New("the data doesn't have a valid parity header or trailer")
+	ErrTruncated  = errors.New("the data with parity has been truncated or extended and can't be repaired")
+	ErrTooDamaged = errors.New("the data has more damaged shards than its parity can repair")
+)
+
+// layout is how data with parity is split into shards and stripes
+type layout struct {
+	dataShards   int
+	parityShards int
+	shardSize    int
+}
+
+// shardsFor returns the number of parity shards that adds at least percent
+// of parity to dataShards shards
+func shardsFor(percent, dataShards int) int {
+	return (percent*dataShards + 99) / 100
+}
+
+// stripeData is the amount of wrapped data held by each stripe
+func (l layout) stripeData() int64 {
+	return int64(l.dataShards * l.shardSize)
+}
+
+// stripeLen is the length of a stripe once its shards and CRCs are written
+func (l layout) stripeLen() int64 {
+	return int64((l.dataShards + l.parityShards) * (l.shardSize + lenCRC))
+}
+
+// stripes is the number of stripes needed to hold dataLen bytes
+func (l layout) stripes(dataLen uint64) int64 {
+	sd := uint64(l.stripeData())
+	return int64((dataLen + sd - 1) / sd)
+}
+
+// fits returns true if the data with parity of dataLen bytes is small enough
+// for its offsets to fit in an int64
+func (l layout) fits(dataLen uint64) bool {
+	maxStripes := uint64(math.MaxInt64-lenHeader-lenTrailers) / uint64(l.stripeLen())
+	return dataLen <= maxStripes*uint64(l.stripeData())
+}
+
+func (l layout) valid() bool {
+	return l.dataShards > 0 && l.parityShards > 0 &&
+		l.dataShards+l.parityShards <= 256 &&
+		l.shardSize > 0 && l.shardSize <= 1024*1024
+}
+
+func (l layout) marshal() []byte {
+	b := make([]byte, 0, lenLayout)
+	b = append(b, ldtools.U16tob(Version)...)
+	b = append(b, ldtools.U8tob(uint8(l.dataShards))...)
+	b = append(b, ldtools.U8tob(uint8(l.parityShards))...)
+	b = append(b, ldtools.U32tob(uint32(l.shardSize))...)
+	return b
+}
+
+// unmarshalLayout parses the layout at the start of b, which must be long enough to hold it
+func unmarshalLayout(b []byte) (layout, bool) {
+	l := layout{
+		dataShards:   int(ldtools.Btou8(b[2:3])),
+		parityShards: int(ldtools.Btou8(b[3:4])),
+		shardSize:    int(ldtools.Btou32(b[4:8])),
+	}
+	return l, ldtools.Btou16(b[:2]) == Version && l.valid()
+}
+
+func (l layout) header() []byte {
+	return withCRC(l.marshal())
+}
+
+func (l layout) trailer(dataLen uint64) []byte {
+	return withCRC(append(l.marshal(), ldtools.U64tob(dataLen)...))
+}
+
+// parseHeader returns the layout of a header
+func parseHeader(b []byte) (layout, bool) {
+	if !checkCRC(b) {
+		return layout{}, false
+	}
+	return unmarshalLayout(b)
+}
+
+// parseTrailer returns the layout and data length of a trailer
+func parseTrailer(b []byte) (layout, uint64, bool) {
+	if !checkCRC(b) {
+		return layout{}, 0, false
+	}
+	l, ok := unmarshalLayout(b)
+	dataLen := ldtools.Btou64(b[lenLayout : lenLayout+lenDataLen])
+	return l, dataLen, ok && l.fits(dataLen)
+}
+
+func withCRC(b []byte) []byte {
+	return append(b, ldtools.U32tob(crc32.ChecksumIEEE(b))...)
+}
+
+func checkCRC(b []byte) bool {
+	n := len(b) - lenCRC
+	return crc32.ChecksumIEEE(b[:n]) == ldtools.Btou32(b[n:])
+}
+
+// shardCRC is the CRC of shard i of stripe s
+func shardCRC(s int64, i int, shard []byte) []byte {
+	h := crc32.NewIEEE()
+	h.Write(ldtools.U64tob(uint64(s)))
+	h.Write(ldtools.U8tob(uint8(i)))
+	h.Write(shard)
+	return h.Sum(nil)
+}
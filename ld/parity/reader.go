@@ -0,0 +1,257 @@
+package parity
+
+import (
+	"bytes"
+	"errors"
+	"github.com/klauspost/reedsolomon"
+	"io"
+)
+
+var (
+	ErrNegativeOffset = errors.New("negative offset")
+	ErrBadWhence      = errors.New("invalid whence")
+)
+
+// Reader reads back the data written by a Writer, rebuilding any damaged shards
+// from the parity as each stripe is read. It is not safe for concurrent use.
+type Reader struct {
+	r        io.ReadSeeker
+	l        layout
+	enc      reedsolomon.Encoder
+	dataLen  int64
+	off      int64
+	stripe   int64
+	buf      []byte
+	checked  map[int64]bool
+	repaired int
+}
+
+// Detect returns true if r starts with, or ends with, the layout of data with parity.
+// It checks the trailers as well, so that data whose header is damaged is still found.
+func Detect(r io.ReadSeeker) bool {
+	hb := make([]byte, lenHeader)
+	if _, err := r.Seek(0, io.SeekStart); err == nil {
+		if _, err := io.ReadFull(r, hb); err == nil {
+			if _, ok := parseHeader(hb); ok {
+				return true
+			}
+		}
+	}
+
+	_, _, err := readTrailers(r)
+	return err == nil
+}
+
+// readTrailers returns the layout and data length of the first intact trailer of r
+func readTrailers(r io.ReadSeeker) (layout, uint64, error) {
+	if _, err := r.Seek(-lenTrailers, io.SeekEnd); err != nil {
+		return layout{}, 0, ErrBadParity
+	}
+
+	tb := make([]byte, lenTrailers)
+	if _, err := io.ReadFull(r, tb); err != nil {
+		return layout{}, 0, ErrBadParity
+	}
+
+	for i := 0; i < trailerCopies; i++ {
+		if l, dataLen, ok := parseTrailer(tb[i*lenTrailer : (i+1)*lenTrailer]); ok {
+			return l, dataLen, nil
+		}
+	}
+	return layout{}, 0, ErrBadParity
+}
+
+// NewReader returns a Reader for the data with parity in r. Damaged headers and
+// trailers are counted by Repaired along with the damaged shards.
+// ErrTruncated is returned if the length of r doesn't match its layout.
+func NewReader(r io.ReadSeeker) (*Reader, error) {
+	l, dataLen, err := readTrailers(r)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size != lenHeader+l.stripes(dataLen)*l.stripeLen()+lenTrailers {
+		return nil, ErrTruncated
+	}
+
+	enc, err := reedsolomon.New(l.dataShards, l.parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &Reader{
+		r:       r,
+		l:       l,
+		enc:     enc,
+		dataLen: int64(dataLen),
+		stripe:  -1,
+		checked: make(map[int64]bool),
+	}
+
+	// any damaged header or trailer is rewritten by Repair
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, lenHeader)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(b, l.header()) {
+		pr.repaired++
+	}
+
+	if _, err := r.Seek(-lenTrailers, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	b = make([]byte, lenTrailers)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	trailer := l.trailer(dataLen)
+	for i := 0; i < trailerCopies; i++ {
+		if !bytes.Equal(b[i*lenTrailer:(i+1)*lenTrailer], trailer) {
+			pr.repaired++
+		}
+	}
+
+	return pr, nil
+}
+
+// Size returns the length of the data without its parity
+func (pr *Reader) Size() int64 {
+	return pr.dataLen
+}
+
+// Repaired returns the number of damaged shards, headers, and trailers found so far
+func (pr *Reader) Repaired() int {
+	return pr.repaired
+}
+
+func (pr *Reader) Read(p []byte) (int, error) {
+	n, err := pr.ReadAt(p, pr.off)
+	pr.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (pr *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pr.off
+	case io.SeekEnd:
+		offset += pr.dataLen
+	default:
+		return 0, ErrBadWhence
+	}
+	if offset < 0 {
+		return 0, ErrNegativeOffset
+	}
+	pr.off = offset
+	return offset, nil
+}
+
+func (pr *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+
+	n := 0
+	for n < len(p) {
+		if off >= pr.dataLen {
+			return n, io.EOF
+		}
+
+		s := off / pr.l.stripeData()
+		if err := pr.load(s); err != nil {
+			return n, err
+		}
+
+		start := off - s*pr.l.stripeData()
+		end := int64(len(pr.buf))
+		if rest := pr.dataLen - s*pr.l.stripeData(); rest < end {
+			end = rest
+		}
+		c := copy(p[n:], pr.buf[start:end])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// load reads stripe s into buf, rebuilding any of its damaged shards
+func (pr *Reader) load(s int64) error {
+	if pr.stripe == s {
+		return nil
+	}
+	pr.stripe = -1
+
+	if _, err := pr.r.Seek(lenHeader+s*pr.l.stripeLen(), io.SeekStart); err != nil {
+		return err
+	}
+	raw := make([]byte, pr.l.stripeLen())
+	if _, err := io.ReadFull(pr.r, raw); err != nil {
+		return err
+	}
+
+	shards := make([][]byte, pr.l.dataShards+pr.l.parityShards)
+	damaged := 0
+	for i := range shards {
+		pos := i * (pr.l.shardSize + lenCRC)
+		shard := raw[pos : pos+pr.l.shardSize]
+		crc := raw[pos+pr.l.shardSize : pos+pr.l.shardSize+lenCRC]
+		if !bytes.Equal(crc, shardCRC(s, i, shard)) {
+			damaged++
+			continue
+		}
+		shards[i] = shard
+	}
+
+	if damaged > pr.l.parityShards {
+		return ErrTooDamaged
+	}
+	if damaged > 0 {
+		if err := pr.enc.ReconstructData(shards); err != nil {
+			return ErrTooDamaged
+		}
+	}
+
+	// a stripe read more than once is only counted once
+	if !pr.checked[s] {
+		pr.checked[s] = true
+		pr.repaired += damaged
+	}
+
+	pr.buf = pr.buf[:0]
+	for _, shard := range shards[:pr.l.dataShards] {
+		pr.buf = append(pr.buf, shard...)
+	}
+	pr.stripe = s
+	return nil
+}
+
+// Repair copies the data with parity in r to w, rebuilding every damaged shard,
+// header, and trailer with the same layout, and returns the number it rebuilt.
+// w is closed if it is an io.Closer
+func Repair(r io.ReadSeeker, w io.Writer) (int, error) {
+	pr, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	pw, err := newWriter(w, pr.l)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := io.Copy(pw, pr); err != nil {
+		return pr.Repaired(), err
+	}
+	return pr.Repaired(), pw.Close()
+}
@@ -0,0 +1,145 @@
+package parity
+
+import (
+	"errors"
+	"github.com/klauspost/reedsolomon"
+	"io"
+)
+
+var (
+	ErrClosed = errors.New("the parity writer is already closed")
+)
+
+// Writer adds Reed-Solomon parity to the data written to it
+type Writer struct {
+	w       io.Writer
+	l       layout
+	enc     reedsolomon.Encoder
+	buf     []byte
+	n       int
+	stripe  int64
+	dataLen uint64
+	closed  bool
+	err     error
+}
+
+// NewWriter returns a Writer that writes the data written to it to w with
+// percent of parity added, rounded up to the next 5%. Up to that percent of
+// each stripe of the written data can then be damaged and still be recovered
+// by NewReader.
+//
+// Close must be called on the returned Writer when finished writing to write
+// the last stripe. Close also closes w, if w is an io.Closer, so a Writer can be
+// passed to the encrypters in place of the file they write to.
+func NewWriter(w io.Writer, percent int) (*Writer, error) {
+	if percent < 1 || percent > maxPercent {
+		return nil, ErrBadPercent
+	}
+	return newWriter(w, layout{
+		dataShards:   defDataShards,
+		parityShards: shardsFor(percent, defDataShards),
+		shardSize:    defShardSize,
+	})
+}
+
+func newWriter(w io.Writer, l layout) (*Writer, error) {
+	enc, err := reedsolomon.New(l.dataShards, l.parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(l.header()); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:   w,
+		l:   l,
+		enc: enc,
+		buf: make([]byte, l.stripeData()),
+	}, nil
+}
+
+func (pw *Writer) Write(p []byte) (int, error) {
+	if pw.closed {
+		return 0, ErrClosed
+	}
+	if pw.err != nil {
+		return 0, pw.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(pw.buf[pw.n:], p)
+		pw.n += n
+		written += n
+		p = p[n:]
+
+		if pw.n == len(pw.buf) {
+			if pw.err = pw.writeStripe(); pw.err != nil {
+				return written, pw.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writeStripe computes the parity of the buffered data and writes out the stripe
+func (pw *Writer) writeStripe() error {
+	for i := pw.n; i < len(pw.buf); i++ {
+		pw.buf[i] = 0
+	}
+
+	shards := make([][]byte, pw.l.dataShards+pw.l.parityShards)
+	for i := range shards {
+		if i < pw.l.dataShards {
+			shards[i] = pw.buf[i*pw.l.shardSize : (i+1)*pw.l.shardSize]
+			continue
+		}
+		shards[i] = make([]byte, pw.l.shardSize)
+	}
+	if err := pw.enc.Encode(shards); err != nil {
+		return err
+	}
+
+	for i, shard := range shards {
+		if _, err := pw.w.Write(shard); err != nil {
+			return err
+		}
+		if _, err := pw.w.Write(shardCRC(pw.stripe, i, shard)); err != nil {
+			return err
+		}
+	}
+
+	pw.dataLen += uint64(pw.n)
+	pw.stripe++
+	pw.n = 0
+	return nil
+}
+
+// Close writes the last stripe and the trailers, then closes the underlying
+// writer if it is an io.Closer
+func (pw *Writer) Close() error {
+	if pw.closed {
+		return ErrClosed
+	}
+	pw.closed = true
+
+	err := pw.err
+	if err == nil && pw.n > 0 {
+		err = pw.writeStripe()
+	}
+	if err == nil {
+		trailer := pw.l.trailer(pw.dataLen)
+		for i := 0; i < trailerCopies && err == nil; i++ {
+			_, err = pw.w.Write(trailer)
+		}
+	}
+
+	if c, ok := pw.w.(io.Closer); ok {
+		if cErr := c.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,34 @@
+package ld
+
+import (
+	"errors"
+	"github.com/raz-varren/lockdown/ld/v1"
+)
+
+var (
+	ErrRekeyV1 = errors.New("version 1 files derive their key straight from the password and can't be rekeyed, upgrade the file to the latest version first")
+)
+
+// Rekey changes the password of the encrypted file at path from oldPass to newPass,
+// deriving the new key with newCost. Only the key-wrapping part of the header and the
+// header MAC are rewritten, so the file is never decrypted to disk. The old key is only
+// derived if it costs no more than limit, the same as opts.MaxCost of NewDecOptions.
+// See v2.Rekey for how the header is replaced. Files whose Codec isn't a RekeyCodec,
+// like version 1 files, return ErrRekeyV1.
+func Rekey(oldPass, newPass []byte, newCost, limit v1.CostParams, path string) error {
+	ver, err := FileVersion(path)
+	if err != nil {
+		return err
+	}
+
+	c, err := Lookup(ver)
+	if err != nil {
+		return err
+	}
+
+	rc, ok := c.(RekeyCodec)
+	if !ok {
+		return ErrRekeyV1
+	}
+	return rc.Rekey(oldPass, newPass, path, CodecEncOptions{Cost: newCost}, CodecDecOptions{MaxCost: limit})
+}
@@ -0,0 +1,68 @@
+package ld
+
+import (
+	"errors"
+	"github.com/raz-varren/lockdown/ld/parity"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrParityInPlace = errors.New("files with parity can't be rekeyed or upgraded in place, decrypt them and encrypt them again")
+)
+
+// Repair rebuilds the damaged parts of the file with parity at path, and returns how many
+// shards, headers, and trailers were damaged. No password is needed, since the parity is
+// computed over the encrypted data. An undamaged file is left alone. Otherwise the repaired
+// file is written to a temp file in the same directory, which is renamed over the original,
+// keeping the original's mode and modification time.
+//
+// Files without parity return parity.ErrBadParity, and files with more damage than their
+// parity can repair return parity.ErrTooDamaged, in which case the original is left in place.
+func Repair(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".lockdown_repair_*")
+	if err != nil {
+		return 0, err
+	}
+	tmpName := tmp.Name()
+
+	// parity.Repair closes its writer, but tmp still has to be synced
+	n, err := parity.Repair(f, struct{ io.Writer }{tmp})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil && n == 0 {
+		os.Remove(tmpName)
+		return 0, nil
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, stat.Mode())
+	}
+	if err == nil {
+		err = os.Chtimes(tmpName, stat.ModTime(), stat.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return 0, err
+	}
+	return n, nil
+}
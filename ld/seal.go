@@ -0,0 +1,95 @@
+package ld
+
+import (
+	"bytes"
+	"errors"
+	"github.com/awnumar/memguard"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"github.com/raz-varren/lockdown/ld/v2"
+	"io"
+)
+
+var (
+	ErrOpenSize = errors.New("the decrypted data doesn't match its size")
+)
+
+// Seal encrypts plaintext with pass, deriving the key with cp, and returns the encrypted
+// data, exactly as NewEnc would write it. It is meant for small secrets, like API tokens
+// and config values, that are easier to handle as a whole than as a stream. The encrypter
+// is closed before Seal returns, so the final chunk is never left off.
+func Seal(pass []byte, cp v1.CostParams, plaintext []byte) ([]byte, error) {
+	return SealOptions(pass, cp, plaintext, v2.EncOptions{})
+}
+
+// SealOptions is Seal with the options of NewEncOptions
+func SealOptions(pass []byte, cp v1.CostParams, plaintext []byte, opts v2.EncOptions) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	encW, err := NewEncOptions(pass, cp, buf, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := encW.Write(plaintext); err != nil {
+		encW.Close()
+		return nil, err
+	}
+	if err := encW.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Open decrypts ciphertext, as returned by Seal or written by NewEnc, with pass. The whole
+// of the plaintext is authenticated before it is returned, in a LockedBuffer so that it
+// isn't left on the heap. The returned LockedBuffer must be destroyed once it is no
+// longer needed.
+func Open(pass, ciphertext []byte) (*memguard.LockedBuffer, error) {
+	return OpenOptions(pass, ciphertext, v2.DecOptions{})
+}
+
+// OpenOptions is Open with the options of NewDecOptions
+func OpenOptions(pass, ciphertext []byte, opts v2.DecOptions) (*memguard.LockedBuffer, error) {
+	decR, err := NewSeekDecOptions(pass, bytes.NewReader(ciphertext), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer decR.Close()
+
+	size, err := checkSize(decR)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := memguard.NewBuffer(int(size))
+	if _, err := io.ReadFull(decR, plaintext.Bytes()); err != nil {
+		plaintext.Destroy()
+		return nil, err
+	}
+
+	// the plaintext has to end right where its size says it does
+	extra := make([]byte, 1)
+	n, err := decR.Read(extra)
+	extra[0] = 0
+	if n > 0 || err != io.EOF {
+		plaintext.Destroy()
+		if err == nil || err == io.EOF {
+			err = ErrOpenSize
+		}
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// checkSize returns the size of the plaintext of sd, or the error that kept it from being
+// found, as described by v2.SizeDecrypter
+func checkSize(sd SeekDecrypter) (int64, error) {
+	if sc, ok := sd.(v2.SizeDecrypter); ok {
+		return sc.CheckSize()
+	}
+	if size := sd.Size(); size >= 0 {
+		return size, nil
+	}
+	return 0, ErrOpenSize
+}
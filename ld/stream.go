@@ -0,0 +1,195 @@
+package ld
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"github.com/raz-varren/lockdown/ld/parity"
+	"github.com/raz-varren/lockdown/ld/v2"
+	"github.com/raz-varren/lockdown/ld/volume"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	// SpoolLimit is the largest version 1 file, in bytes, that NewStreamDec will
+	// spool to a temp file while it is verified. It also limits decoded armored data
+	// that is spooled so it can be seeked
+	SpoolLimit int64 = 1024 * 1024 * 1024 * 4
+
+	// SpoolDir is the directory version 1 files and armored data are spooled to.
+	// When empty the default temp directory is used
+	SpoolDir = ""
+
+	ErrSpoolLimit = errors.New("the encrypted data is larger than the spool limit")
+)
+
+// NewStreamDec is NewDec for readers that can't seek, such as pipes, sockets, and stdin.
+//
+// Version 2 data is decrypted as it streams in, and each chunk is authenticated before any
+// of its plaintext is returned, so Read may return ErrSigMismatch. Version 1 data can only
+// be verified once all of it has been read, so it is first spooled to a temp file in SpoolDir,
+// up to SpoolLimit bytes, and no plaintext is returned until the signature matches. The
+// spooled data is still encrypted. Data of any other Codec that isn't a StreamCodec is
+// spooled the same way, as is data with parity. Armored data is decoded by NewArmorReader
+// as it streams in, and the data inside it is then handled the same way.
+//
+// The returned io.ReadCloser, must be closed once it is no longer needed,
+// in order to clear the derived key from protected memory and remove any spooled data.
+func NewStreamDec(pass []byte, r io.Reader) (io.ReadCloser, error) {
+	return NewStreamDecOptions(pass, r, v2.DecOptions{})
+}
+
+// NewStreamDecOptions is NewStreamDec with the options of NewDecOptions
+func NewStreamDecOptions(pass []byte, r io.Reader, opts v2.DecOptions) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, armorPeek)
+	if peek, _ := br.Peek(armorPeek); isArmored(peek) {
+		ar, err := NewArmorReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return NewStreamDecOptions(pass, ar, opts)
+	}
+	r = br
+
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, ErrBadVer
+	}
+
+	// put the version bytes back in front of the rest of the stream
+	r = io.MultiReader(bytes.NewReader(b), r)
+
+	// parity can only be checked once all of the data has been read
+	ver := ldtools.Btou16(b)
+	if ver == parity.Version {
+		return newSpoolDec(pass, r, opts)
+	}
+
+	if ver == volume.Version {
+		return nil, ErrVolumeInPlace
+	}
+
+	c, err := Lookup(ver)
+	if err != nil {
+		return nil, err
+	}
+	if sc, ok := c.(StreamCodec); ok {
+		return sc.NewStreamDec(pass, r, codecDecOptions(opts))
+	}
+	return newSpoolDec(pass, r, opts)
+}
+
+func newSpoolDec(pass []byte, r io.Reader, opts v2.DecOptions) (io.ReadCloser, error) {
+	f, err := spool(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sd := &spoolDec{f: f}
+	sd.dec, err = NewDecOptions(pass, f, opts)
+	if err != nil {
+		sd.Close()
+		return nil, err
+	}
+
+	return sd, nil
+}
+
+// spoolDec decrypts data that was spooled to a temp file and removes
+// the temp file when closed
+type spoolDec struct {
+	f   *os.File
+	dec io.ReadCloser
+}
+
+func (sd *spoolDec) Read(p []byte) (int, error) {
+	return sd.dec.Read(p)
+}
+
+func (sd *spoolDec) Close() error {
+	if sd.dec != nil {
+		sd.dec.Close()
+	}
+	return removeSpool(sd.f)
+}
+
+// newSpoolSeekDec decodes the armored data in r to a temp file, and returns a
+// SeekDecrypter for it that removes the temp file when closed
+func newSpoolSeekDec(pass []byte, r io.Reader, opts v2.DecOptions) (SeekDecrypter, error) {
+	f, err := spoolArmor(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := NewSeekDecOptions(pass, f, opts)
+	if err != nil {
+		removeSpool(f)
+		return nil, err
+	}
+
+	return &spoolSeekDec{SeekDecrypter: dec, f: f}, nil
+}
+
+// spoolSeekDec is spoolDec for a SeekDecrypter
+type spoolSeekDec struct {
+	SeekDecrypter
+	f *os.File
+}
+
+// Meta returns the metadata of the spooled file, if its decrypter has any
+func (sd *spoolSeekDec) Meta() *v2.Metadata {
+	if md, ok := sd.SeekDecrypter.(v2.MetaDecrypter); ok {
+		return md.Meta()
+	}
+	return nil
+}
+
+// CheckSize returns the size of the spooled file as described by v2.SizeDecrypter
+func (sd *spoolSeekDec) CheckSize() (int64, error) {
+	if sc, ok := sd.SeekDecrypter.(v2.SizeDecrypter); ok {
+		return sc.CheckSize()
+	}
+	return sd.Size(), nil
+}
+
+func (sd *spoolSeekDec) Close() error {
+	sd.SeekDecrypter.Close()
+	return removeSpool(sd.f)
+}
+
+// spool copies r to a temp file in SpoolDir, up to SpoolLimit bytes
+func spool(r io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile(SpoolDir, "lockdown_spool_*.lkd")
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r, SpoolLimit+1))
+	if err == nil && n > SpoolLimit {
+		err = ErrSpoolLimit
+	}
+	if err != nil {
+		removeSpool(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+// spoolArmor decodes the armored data in r to a temp file in SpoolDir
+func spoolArmor(r io.Reader) (*os.File, error) {
+	ar, err := NewArmorReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return spool(ar)
+}
+
+// removeSpool closes and removes a temp file made by spool
+func removeSpool(f *os.File) error {
+	err := f.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,149 @@
+package ld
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"github.com/raz-varren/lockdown/ld/v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrDowngrade       = errors.New("files can't be converted to an older version")
+	ErrUpgradeMismatch = errors.New("the upgraded file doesn't decrypt to the same data as the original, the original was left in place")
+)
+
+// Upgrade re-encrypts the file at path as targetVersion, deriving the new key from pass with cost.
+// Files that are already targetVersion are left alone. See UpgradeOptions for how the file is replaced.
+func Upgrade(pass []byte, path string, targetVersion uint16, cost v1.CostParams) error {
+	return UpgradeOptions(pass, path, targetVersion, cost, v2.EncOptions{}, v2.DecOptions{})
+}
+
+// UpgradeOptions is Upgrade, decrypting the file with decOpts and encrypting it again
+// with encOpts, using the Codec registered for targetVersion.
+//
+// The plaintext is streamed straight from the old file into a new encrypted temp file in the
+// same directory, so it is never written to disk. The temp file is then decrypted with pass and
+// decOpts, and only if it matches the original plaintext is it renamed over the original, keeping
+// the original's mode and modification time. pass and decOpts must be able to decrypt the result.
+func UpgradeOptions(pass []byte, path string, targetVersion uint16, cost v1.CostParams, encOpts v2.EncOptions, decOpts v2.DecOptions) error {
+	c, err := Lookup(targetVersion)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ver, err := readVer(f)
+	if err != nil {
+		return err
+	}
+	switch {
+	case ver == targetVersion:
+		return nil
+	case ver > targetVersion:
+		return ErrDowngrade
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	dec, err := NewDecOptions(pass, f, decOpts)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".lockdown_upgrade_*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	sum, err := writeUpgrade(pass, tmp, dec, c, cost, encOpts)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = verifyUpgrade(pass, tmpName, decOpts, sum)
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, stat.Mode())
+	}
+	if err == nil {
+		err = os.Chtimes(tmpName, stat.ModTime(), stat.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+// writeUpgrade encrypts everything read from dec into f with c, and
+// returns the sha256 of the plaintext
+func writeUpgrade(pass []byte, f *os.File, dec io.Reader, c Codec, cost v1.CostParams, opts v2.EncOptions) ([]byte, error) {
+	// the encrypters close their writer, but f still has to be synced
+	enc, err := c.NewEnc(pass, struct{ io.Writer }{f}, codecEncOptions(cost, opts))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(enc, io.TeeReader(dec, sum)); err != nil {
+		enc.Close()
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return sum.Sum(nil), f.Sync()
+}
+
+// verifyUpgrade decrypts the file at path and checks that its plaintext hashes to sum
+func verifyUpgrade(pass []byte, path string, opts v2.DecOptions, sum []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec, err := NewDecOptions(pass, f, opts)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, dec); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return ErrUpgradeMismatch
+	}
+	return nil
+}
+
+// FileVersion returns the version of the encrypted file at path
+func FileVersion(path string) (uint16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return readVer(f)
+}
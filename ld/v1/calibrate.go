@@ -0,0 +1,60 @@
+package v1
+
+import (
+	"golang.org/x/crypto/argon2"
+	"runtime"
+	"time"
+)
+
+const (
+	// minCalibrateMem is the least memory, in KB, Calibrate will lower the memory cost to
+	minCalibrateMem = 1024 * 16
+)
+
+// Calibrate benchmarks argon2 on this machine and returns the cost parameters that take
+// about target to derive a key, using at most maxMem KB of memory, or the memory of
+// CostNormal when maxMem is 0. Memory is what makes argon2 expensive to attack with
+// dedicated hardware, so it is kept at maxMem unless a single pass over it takes longer
+// than target, and the rest of target is spent on more passes. Threads is set to the
+// number of CPUs.
+//
+// Each of the returned parameters is capped at DefCostLimit, so files written with them can
+// always be decrypted without raising the limit. On fast machines, or with a long target, a
+// key may take less than target to derive.
+func Calibrate(target time.Duration, maxMem uint32) CostParams {
+	threads := runtime.NumCPU()
+	if threads > int(DefCostLimit.Threads) {
+		threads = int(DefCostLimit.Threads)
+	}
+
+	cp := CostParams{Time: 1, Memory: maxMem, Threads: uint8(threads)}
+	if cp.Memory == 0 {
+		cp.Memory = defCostMem
+	}
+	if cp.Memory > DefCostLimit.Memory {
+		cp.Memory = DefCostLimit.Memory
+	}
+
+	pass := Benchmark(cp)
+	for pass > target && cp.Memory/2 >= minCalibrateMem {
+		cp.Memory /= 2
+		pass = Benchmark(cp)
+	}
+
+	if pass > 0 && target > pass {
+		cp.Time = DefCostLimit.Time
+		if passes := target / pass; passes < time.Duration(DefCostLimit.Time) {
+			cp.Time = uint32(passes)
+		}
+	}
+	return cp
+}
+
+// Benchmark returns how long it takes this machine to derive a key with cp, which is
+// also how long each password guess takes an attacker with the same hardware
+func Benchmark(cp CostParams) time.Duration {
+	salt := make([]byte, lenSalt)
+	start := time.Now()
+	argon2.IDKey([]byte("lockdown calibration"), salt, cp.Time, cp.Memory, cp.Threads, 32)
+	return time.Since(start)
+}
@@ -2,7 +2,9 @@ package v1
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/raz-varren/lockdown/ld/ldtools"
+	"math"
 )
 
 var (
@@ -24,6 +26,24 @@ var (
 		Memory:  defCostMem,
 		Threads: defCostThread,
 	}
+
+	// DefCostLimit is the highest cost an encrypted file can ask for before decrypting it
+	// is refused, unless the caller gives a higher limit. It leaves plenty of room above
+	// CostSlow, but stops a crafted file from exhausting the memory or time of whoever
+	// tries to decrypt it
+	DefCostLimit = CostParams{
+		Time:    defCostTime * 8,
+		Memory:  defCostMem * 4,
+		Threads: defCostThread * 8,
+	}
+
+	// NoCostLimit is a limit that every file is under, for files that are trusted not
+	// to be crafted, such as those written by NewEnc on a faster machine
+	NoCostLimit = CostParams{
+		Time:    math.MaxUint32,
+		Memory:  math.MaxUint32,
+		Threads: math.MaxUint8,
+	}
 )
 
 type CostParams struct {
@@ -32,6 +52,38 @@ type CostParams struct {
 	Threads uint8
 }
 
+// ErrCostLimit is returned, before any key derivation runs, when the cost parameters
+// of an encrypted file are over the limit allowed for decrypting it
+type ErrCostLimit struct {
+	Cost  CostParams
+	Limit CostParams
+}
+
+func (e ErrCostLimit) Error() string {
+	return fmt.Sprintf("the key derivation cost of the file (time: %d, memory: %dMB, threads: %d) is over the limit (time: %d, memory: %dMB, threads: %d)",
+		e.Cost.Time, e.Cost.Memory/1024, e.Cost.Threads,
+		e.Limit.Time, e.Limit.Memory/1024, e.Limit.Threads)
+}
+
+// Check returns an ErrCostLimit if any of cp is over limit. Any zero fields
+// of limit are taken from DefCostLimit
+func (cp CostParams) Check(limit CostParams) error {
+	if limit.Time == 0 {
+		limit.Time = DefCostLimit.Time
+	}
+	if limit.Memory == 0 {
+		limit.Memory = DefCostLimit.Memory
+	}
+	if limit.Threads == 0 {
+		limit.Threads = DefCostLimit.Threads
+	}
+
+	if cp.Time > limit.Time || cp.Memory > limit.Memory || cp.Threads > limit.Threads {
+		return ErrCostLimit{Cost: cp, Limit: limit}
+	}
+	return nil
+}
+
 type costParams struct {
 	time    uint32
 	memory  uint32
@@ -18,6 +18,7 @@ type cryptoRing struct {
 	hashKey, cipherKey *memguard.LockedBuffer
 	ch                 *cryptoHeader
 	mac                hash.Hash
+	block              cipher.Block
 	stream             cipher.Stream
 }
 
@@ -52,6 +53,7 @@ func (cr *cryptoRing) genCrypto(pass []byte) {
 		panic(err)
 	}
 
+	cr.block = block
 	cr.stream = cipher.NewCTR(block, cr.ch.IV())
 }
 
@@ -69,6 +71,33 @@ func (cr *cryptoRing) Stream() cipher.Stream {
 	return cr.stream
 }
 
+// StreamAt returns a new CTR stream positioned at byte off of the encrypted data
+func (cr *cryptoRing) StreamAt(off int64) cipher.Stream {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	// the CTR counter is the whole IV as a big endian number,
+	// so add the block index to it
+	iv := make([]byte, len(cr.ch.IV()))
+	copy(iv, cr.ch.IV())
+	carry := uint64(off / aes.BlockSize)
+	for i := len(iv) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(iv[i]) + carry&0xff
+		iv[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream := cipher.NewCTR(cr.block, iv)
+
+	// discard the keystream before off within its block
+	if rem := off % aes.BlockSize; rem > 0 {
+		skip := make([]byte, rem)
+		stream.XORKeyStream(skip, skip)
+	}
+
+	return stream
+}
+
 func (cr *cryptoRing) HeaderLen() int {
 	return cr.ch.Len()
 }
@@ -6,7 +6,10 @@ import (
 	"errors"
 	"github.com/raz-varren/lockdown/ld/ldtools"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
 var (
@@ -14,8 +17,20 @@ var (
 	ErrSigMismatch = errors.New("the signature did not match the encypted data")
 	//ErrBadSalt     = errors.New("could not read salts from file")
 	ErrVerMismatch = errors.New("invalid file version, version must be 1")
+	ErrBadWhence   = errors.New("invalid whence")
+	ErrNegOffset   = errors.New("negative offset")
 )
 
+// SeekDecrypter is decrypted data that can be read from any offset
+type SeekDecrypter interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+
+	// Size returns the size of the plaintext in bytes
+	Size() int64
+}
+
 // NewDec returns an io.ReadCloser that will decrypt r. If the provided password is incorrect,
 // an ErrSigMismatch will be returned. ErrSigMismatch may also indicate the encrypted file was
 // tampered with, as there is no way to know if the key was wrong or the file is compromised.
@@ -23,6 +38,21 @@ var (
 // The returned io.ReadCloser, must be closed once it is no longer needed,
 // in order to clear the derived key from protected memory.
 func NewDec(pass []byte, r io.ReadSeeker) (io.ReadCloser, error) {
+	return NewSeekDec(pass, r)
+}
+
+// NewSeekDec is NewDec, except the returned SeekDecrypter can also Seek and ReadAt
+// any offset of the plaintext, once the signature of the whole file has been verified.
+// If r doesn't implement io.ReaderAt, it must not be used elsewhere until the
+// SeekDecrypter is closed. The cost parameters of the file aren't limited, so files that
+// may have been crafted should be decrypted with NewSeekDecLimit instead.
+func NewSeekDec(pass []byte, r io.ReadSeeker) (SeekDecrypter, error) {
+	return NewSeekDecLimit(pass, r, NoCostLimit)
+}
+
+// NewSeekDecLimit is NewSeekDec, except the cost parameters of the file are checked against
+// limit, as described by CostParams.Check, before the key is derived
+func NewSeekDecLimit(pass []byte, r io.ReadSeeker, limit CostParams) (SeekDecrypter, error) {
 	end, err := r.Seek(0, io.SeekEnd)
 	if err != nil {
 		return nil, err
@@ -45,12 +75,19 @@ func NewDec(pass []byte, r io.ReadSeeker) (io.ReadCloser, error) {
 	}
 
 	ch := emptyCryptoHeader()
-	ch.UnmarshalBinary(headerBytes)
+	if err := ch.UnmarshalBinary(headerBytes); err != nil {
+		return nil, err
+	}
 
 	if ch.Ver() != Version {
 		return nil, ErrVerMismatch
 	}
 
+	cp := CostParams{Time: ch.cp.Time(), Memory: ch.cp.Memory(), Threads: ch.cp.Threads()}
+	if err := cp.Check(limit); err != nil {
+		return nil, err
+	}
+
 	cr := newCryptoRing(pass, ch)
 
 	// reset to start
@@ -79,23 +116,98 @@ func NewDec(pass []byte, r io.ReadSeeker) (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	sr := &cipher.StreamReader{
-		S: cr.Stream(),
-		R: io.LimitReader(r, fileSize-int64(ch.Len())-lenSig),
+	cw := &closeWrapper{
+		mu:    &sync.Mutex{},
+		ra:    ldtools.NewReaderAt(r),
+		cr:    cr,
+		start: int64(ch.Len()),
+		size:  fileSize - int64(ch.Len()) - lenSig,
 	}
 
-	cw := &closeWrapper{sr: sr, cr: cr}
-
 	return cw, nil
 }
 
 type closeWrapper struct {
-	sr *cipher.StreamReader
-	cr *cryptoRing
+	mu          *sync.Mutex
+	ra          io.ReaderAt
+	cr          *cryptoRing
+	stream      cipher.Stream
+	streamOff   int64
+	start, size int64
+	off         int64
 }
 
 func (cw *closeWrapper) Read(p []byte) (n int, err error) {
-	return cw.sr.Read(p)
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	n, err = cw.readAt(p, cw.off)
+	cw.off += int64(n)
+	return n, err
+}
+
+func (cw *closeWrapper) ReadAt(p []byte, off int64) (n int, err error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	return cw.readAt(p, off)
+}
+
+func (cw *closeWrapper) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegOffset
+	}
+	if off >= cw.size {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if rem := cw.size - off; int64(n) > rem {
+		n = int(rem)
+	}
+
+	m, err := cw.ra.ReadAt(p[:n], cw.start+off)
+	if err != nil && !(err == io.EOF && m == n) {
+		return m, err
+	}
+
+	// sequential reads keep using the same stream
+	if cw.stream == nil || cw.streamOff != off {
+		cw.stream = cw.cr.StreamAt(off)
+	}
+	cw.stream.XORKeyStream(p[:m], p[:m])
+	cw.streamOff = off + int64(m)
+
+	if m < len(p) {
+		return m, io.EOF
+	}
+	return m, nil
+}
+
+func (cw *closeWrapper) Seek(offset int64, whence int) (int64, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cw.off
+	case io.SeekEnd:
+		offset += cw.size
+	default:
+		return 0, ErrBadWhence
+	}
+
+	if offset < 0 {
+		return 0, ErrNegOffset
+	}
+
+	cw.off = offset
+	return offset, nil
+}
+
+func (cw *closeWrapper) Size() int64 {
+	return cw.size
 }
 
 func (cw *closeWrapper) Close() error {
@@ -126,3 +238,118 @@ func DecryptFile(pass []byte, fileIn, fileOut string) error {
 	_, err = io.Copy(plainFile, decR)
 	return err
 }
+
+// DecryptFileOnce is DecryptFile, except fileIn is only read once, rather than once to
+// verify the signature and again to decrypt it, as described by DecryptToFile. Like
+// DecryptFile, the cost parameters of the file aren't limited
+func DecryptFileOnce(pass []byte, fileIn, fileOut string) error {
+	encFile, err := os.Open(fileIn)
+	if err != nil {
+		return err
+	}
+	defer encFile.Close()
+
+	return DecryptToFile(pass, encFile, fileOut, NoCostLimit)
+}
+
+// DecryptToFile decrypts the encrypted data read from r and stores the plaintext at fileOut,
+// reading r only once. The plaintext is written to a temp file in the same directory as
+// fileOut while the signature is computed, and the temp file is only renamed to fileOut once
+// the signature matches. Otherwise it is removed and ErrSigMismatch is returned, so the
+// plaintext never shows up at fileOut unless it was authenticated. fileOut must not exist,
+// and is never replaced if it is created while r is decrypted.
+// The cost parameters of the file are checked against limit, as described by CostParams.Check.
+func DecryptToFile(pass []byte, r io.Reader, fileOut string, limit CostParams) error {
+	if _, err := os.Lstat(fileOut); err == nil {
+		return &os.PathError{Op: "open", Path: fileOut, Err: os.ErrExist}
+	}
+
+	headerBytes := make([]byte, lenHeader)
+	if _, err := io.ReadFull(r, headerBytes); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTooSmall
+	} else if err != nil {
+		return err
+	}
+
+	ch := emptyCryptoHeader()
+	if err := ch.UnmarshalBinary(headerBytes); err != nil {
+		return err
+	}
+
+	if ch.Ver() != Version {
+		return ErrVerMismatch
+	}
+
+	cp := CostParams{Time: ch.cp.Time(), Memory: ch.cp.Memory(), Threads: ch.cp.Threads()}
+	if err := cp.Check(limit); err != nil {
+		return err
+	}
+
+	cr := newCryptoRing(pass, ch)
+	defer cr.Destroy()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fileOut), "."+filepath.Base(fileOut)+".decrypt*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	mac := cr.Mac()
+	mac.Write(headerBytes)
+	stream := cr.StreamAt(0)
+
+	// the signature at the end is held back from the encrypted data
+	buf := make([]byte, 1024*32+lenSig)
+	held := 0
+	for {
+		n, rErr := r.Read(buf[held:])
+		held += n
+		if held > lenSig {
+			data := buf[:held-lenSig]
+			mac.Write(data)
+			stream.XORKeyStream(data, data)
+			if _, err := tmp.Write(data); err != nil {
+				return err
+			}
+			held = copy(buf, buf[held-lenSig:held])
+		}
+		if rErr == io.EOF {
+			break
+		}
+		if rErr != nil {
+			return rErr
+		}
+	}
+	if held < lenSig {
+		return ErrTooSmall
+	}
+
+	//if this fails then either the password was wrong
+	//or the data was tampered with
+	if !hmac.Equal(buf[:lenSig], mac.Sum(nil)) {
+		return ErrSigMismatch
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return linkNew(tmp.Name(), fileOut)
+}
+
+// linkNew gives the file at tmp the name fileOut, failing if fileOut exists, rather than
+// replacing it like os.Rename would. On filesystems without hard links, fileOut is
+// created with O_EXCL to claim the name before tmp is renamed over it
+func linkNew(tmp, fileOut string) error {
+	err := os.Link(tmp, fileOut)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(fileOut, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, fileOut)
+}
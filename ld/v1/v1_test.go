@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
 type fileT struct {
@@ -206,6 +207,61 @@ func TestNewDecBadVer(t *testing.T) {
 	}
 }
 
+func TestNewDecCostLimit(t *testing.T) {
+	// a crafted header that would need 4TB of memory to derive the key
+	ch := cpCryptoHeader(CostParams{Time: 1, Memory: 1<<32 - 1, Threads: 4})
+	chData, _ := ch.MarshalBinary()
+	data := append(chData, make([]byte, lenSig)...)
+
+	dec, err := NewSeekDecLimit(testPass, bytes.NewReader(data), CostParams{})
+	if err == nil {
+		dec.Close()
+	}
+	if _, ok := err.(ErrCostLimit); !ok {
+		t.Fatalf("expected (ErrCostLimit), but got (%v)", err)
+	}
+
+	// NewDec is left unlimited, so files written with a higher cost still open
+	highCP := CostParams{Time: DefCostLimit.Time + 1, Memory: 1024 * 8, Threads: 1}
+	buf := bytes.NewBuffer(nil)
+	enc, err := NewEnc(testPass, highCP, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write([]byte("high cost"))
+	enc.Close()
+	if _, err := NewSeekDecLimit(testPass, bytes.NewReader(buf.Bytes()), CostParams{}); err == nil {
+		t.Fatal("expected (ErrCostLimit), but got (nil)")
+	}
+	highDec, err := NewDec(testPass, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	highDec.Close()
+
+	// so is DecryptFileOnce, the same as DecryptFile
+	tmpDir, err := ioutil.TempDir("", tmpDirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	highFile := filepath.Join(tmpDir, "high.lkd")
+	if err := ioutil.WriteFile(highFile, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptFileOnce(testPass, highFile, highFile+".dec"); err != nil {
+		t.Fatal(err)
+	}
+
+	limit := CostParams{Time: 1, Memory: 1024, Threads: 1}
+	if err := fastCP.Check(limit); err != (ErrCostLimit{Cost: fastCP, Limit: limit}) {
+		t.Fatalf("expected (ErrCostLimit), but got (%v)", err)
+	}
+	if err := fastCP.Check(CostParams{}); err != nil {
+		t.Fatalf("expected (nil), but got (%v)", err)
+	}
+}
+
 func TestDecryptFileNotExists(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", tmpDirPrefix)
 	if err != nil {
@@ -372,3 +428,160 @@ func (tio *TaintedIO) Close() error {
 	}
 	return nil
 }
+
+func TestSeekDec(t *testing.T) {
+	data := make([]byte, 1024*64+5)
+	fillRand(data)
+
+	buf := bytes.NewBuffer(nil)
+	enc, err := NewEnc(testPass, fastCP, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(data)
+	enc.Close()
+
+	dec, err := NewSeekDec(testPass, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	if dec.Size() != int64(len(data)) {
+		t.Fatalf("expected size (%d), but got (%d)", len(data), dec.Size())
+	}
+
+	for _, off := range []int64{0, 1, 15, 16, 17, 4095, 4096 * 3, int64(len(data)) - 3} {
+		p := make([]byte, 100)
+		n, err := dec.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+			t.Fatalf("ReadAt(%d): data doesn't match original", off)
+		}
+	}
+
+	if _, err := dec.Seek(-20, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, data[len(data)-20:]) {
+		t.Fatal("data read after Seek doesn't match original")
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	maxMem := uint32(1024 * 32)
+	cp := Calibrate(50*time.Millisecond, maxMem)
+	if cp.Memory > maxMem || cp.Memory < minCalibrateMem {
+		t.Fatalf("expected memory between (%d) and (%d), but got (%d)", minCalibrateMem, maxMem, cp.Memory)
+	}
+	if cp.Time < 1 || cp.Threads < 1 {
+		t.Fatalf("expected a time and threads cost of at least 1, but got (%d) and (%d)", cp.Time, cp.Threads)
+	}
+	if err := cp.Check(DefCostLimit); err != nil {
+		t.Fatalf("expected (nil), but got (%v)", err)
+	}
+
+	// a target far longer than a pass over the least memory is capped at DefCostLimit
+	cp = Calibrate(time.Hour, minCalibrateMem)
+	if err := cp.Check(DefCostLimit); err != nil {
+		t.Fatalf("expected (nil), but got (%v)", err)
+	}
+	if cp.Time != DefCostLimit.Time {
+		t.Fatalf("expected time (%d), but got (%d)", DefCostLimit.Time, cp.Time)
+	}
+}
+
+func TestDecryptFileOnce(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", tmpDirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, size := range []int64{0, 1, lenSig, 1024*32 + 7, 1024 * 1024} {
+		rtf, err := ldtools.NewRandTmpFile(tmpDir, "once_*.file", size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fileName := rtf.File().Name()
+		encFileName := fileName + ".lkd"
+		decFileName := fileName + ".dec"
+
+		if err := EncryptFile(testPass, fastCP, fileName, encFileName); err != nil {
+			t.Fatal(err)
+		}
+		if err := DecryptFileOnce(testPass, encFileName, decFileName); err != nil {
+			t.Fatal(err)
+		}
+
+		sum, err := ldtools.FileSha256(decFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rtf.Equal(sum) {
+			t.Fatal("decrypted file doesn't match original")
+		}
+
+		rtf.Close()
+		os.Remove(fileName)
+		os.Remove(encFileName)
+		os.Remove(decFileName)
+	}
+
+	decFileName := filepath.Join(tmpDir, "decrypted.file")
+	for _, fp := range []string{decryptableFilePath, tamperedFilePath} {
+		pass := testPass
+		if fp == decryptableFilePath {
+			pass = []byte("bad pass")
+		}
+		err = DecryptFileOnce(pass, fp, decFileName)
+		if err != ErrSigMismatch {
+			t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+		}
+	}
+
+	// nothing is left behind when the signature doesn't match
+	left, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("expected an empty directory, but found (%s)", left[0].Name())
+	}
+
+	err = DecryptFileOnce(testPass, decryptableFilePath, encryptedFilePath)
+	if err == nil || !os.IsExist(err) {
+		t.Fatalf("expected (file exists error), but got (%v)", err)
+	}
+
+	// a file that shows up at fileOut while decrypting is never replaced
+	tmpName, existing := filepath.Join(tmpDir, "tmp.file"), filepath.Join(tmpDir, "existing.file")
+	if err := ioutil.WriteFile(tmpName, []byte("plaintext"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(existing, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := linkNew(tmpName, existing); err == nil || !os.IsExist(err) {
+		t.Fatalf("expected (file exists error), but got (%v)", err)
+	}
+	if data, _ := ioutil.ReadFile(existing); string(data) != "existing" {
+		t.Fatal("an existing file was replaced")
+	}
+
+	enc, err := ioutil.ReadFile(decryptableFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DecryptToFile(testPass, bytes.NewReader(enc[:lenHeader+lenSig-1]), decFileName, CostParams{})
+	if err != ErrTooSmall {
+		t.Fatalf("expected (%v), but got (%v)", ErrTooSmall, err)
+	}
+}
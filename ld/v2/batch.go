@@ -0,0 +1,116 @@
+package v2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// BatchKey is the master key of a batch of files. Its password is run through the KDF
+// once, with the batch's salt, and each file encrypted with it gets its own key encryption
+// key, derived from the master key and a salt of the file's own with hkdf-sha256. That
+// way a batch of files costs one key derivation to encrypt, rather than one per file.
+type BatchKey struct {
+	factors Factors
+	kdf     KDFParams
+	salt    []byte
+	master  *memguard.LockedBuffer
+}
+
+// BatchCache keeps the master keys of the batches that have already been unlocked, so that
+// DecOptions.Batches can unlock the rest of the files of a batch without deriving its key again
+type BatchCache interface {
+	// BatchKey returns the master key of the batch with salt, or nil if it isn't known
+	BatchKey(salt []byte) *BatchKey
+
+	// AddBatchKey adds the master key of a batch once it has unlocked a file
+	AddBatchKey(bk *BatchKey)
+}
+
+// NewBatchKey derives the master key of a new batch from pass and keyfile, either of which
+// may be empty, but not both, with kdf. The returned BatchKey must be destroyed once the
+// batch is encrypted.
+func NewBatchKey(pass []byte, keyfile *memguard.LockedBuffer, kdf KDFParams) (*BatchKey, error) {
+	if len(pass) == 0 && keyfile == nil {
+		return nil, ErrBadPass
+	}
+	if kdf == nil || !kdf.valid() {
+		return nil, ErrBadKDF
+	}
+
+	ps := &passStanza{
+		kdf:  kdf,
+		salt: make([]byte, lenSalt),
+	}
+	if len(pass) > 0 {
+		ps.factors |= FactorPassword
+	}
+	if keyfile != nil {
+		ps.factors |= FactorKeyfile
+	}
+	fillRand(ps.salt)
+
+	master, err := ps.kek(pass, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	return newBatchKey(ps, master), nil
+}
+
+// newBatchKey returns the BatchKey of the batch slot ps, moving master into protected memory
+func newBatchKey(ps *passStanza, master []byte) *BatchKey {
+	return &BatchKey{
+		factors: ps.factors,
+		kdf:     ps.kdf,
+		salt:    append([]byte{}, ps.salt...),
+		master:  memguard.NewBufferFromBytes(master),
+	}
+}
+
+// Salt returns the salt of the batch, which is stored in the header of each of its files
+func (bk *BatchKey) Salt() []byte {
+	return bk.salt
+}
+
+// KDF returns the KDF and parameters the master key was derived with
+func (bk *BatchKey) KDF() KDFParams {
+	return bk.kdf
+}
+
+// Destroy clears the master key from protected memory
+func (bk *BatchKey) Destroy() {
+	bk.master.Destroy()
+}
+
+// unlocks returns true if bk is the master key of the batch slot ps
+func (bk *BatchKey) unlocks(ps *passStanza) bool {
+	return bk.factors == ps.factors && bk.kdf == ps.kdf && bytes.Equal(bk.salt, ps.salt)
+}
+
+// newBatchStanza creates a key slot for a file of the batch bk
+func newBatchStanza(bk *BatchKey, fileKey *memguard.LockedBuffer) *passStanza {
+	ps := &passStanza{
+		factors:  bk.factors,
+		kdf:      bk.kdf,
+		salt:     bk.salt,
+		fileSalt: make([]byte, lenFileSalt),
+	}
+	fillRand(ps.fileSalt)
+
+	kek := batchKEK(bk.master.Bytes(), ps.fileSalt)
+	defer wipe(kek)
+	ps.wrapped = wrapKey(kek, fileKey)
+
+	return ps
+}
+
+// batchKEK derives the key encryption key of a single file of a batch from its master key
+func batchKEK(master, fileSalt []byte) []byte {
+	kek := make([]byte, keyLenWrap)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, fileSalt, infoBatch), kek); err != nil {
+		panic(err)
+	}
+	return kek
+}
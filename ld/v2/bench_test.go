@@ -0,0 +1,41 @@
+package v2
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"testing"
+)
+
+// BenchmarkEncThreads shows the throughput of sealing chunks with an increasing number of
+// threads, which is what the -threads flag sets. Run it with -bench EncThreads -benchtime 5x
+func BenchmarkEncThreads(b *testing.B) {
+	data := randBytes(b, 1024*1024*64)
+
+	threads := []int{1, 2, 4, 8}
+	if n := runtime.NumCPU(); n > 8 {
+		threads = append(threads, n)
+	}
+
+	for _, t := range threads {
+		b.Run(fmt.Sprintf("threads=%d", t), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				// only the sealing is timed, not deriving the key
+				b.StopTimer()
+				enc, err := NewEncOptions(testPass, fastCP, ioutil.Discard, EncOptions{Threads: t})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				if _, err := enc.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if err := enc.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
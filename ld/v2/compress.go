@@ -0,0 +1,294 @@
+package v2
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression identifies how the plaintext was compressed before it was encrypted
+type Compression uint8
+
+const (
+	CompressNone Compression = 0
+	CompressGzip Compression = 1
+	CompressZstd Compression = 2
+)
+
+var (
+	ErrBadCompression = errors.New("unsupported compression")
+
+	compressionNames = map[Compression]string{
+		CompressNone: "none",
+		CompressGzip: "gzip",
+		CompressZstd: "zstd",
+	}
+)
+
+// ParseCompression returns the Compression matching name
+func ParseCompression(name string) (Compression, error) {
+	for c, n := range compressionNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression (%s)", name)
+}
+
+func (c Compression) String() string {
+	if n, ok := compressionNames[c]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// Valid returns true if c is a supported compression
+func (c Compression) Valid() bool {
+	_, ok := compressionNames[c]
+	return ok
+}
+
+func (c Compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, ErrBadCompression
+	}
+}
+
+func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CompressGzip:
+		return gzip.NewReader(r)
+	case CompressZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, ErrBadCompression
+	}
+}
+
+// compWriter compresses everything written to it before it's encrypted
+type compWriter struct {
+	cw io.WriteCloser
+	ew io.WriteCloser
+}
+
+func (c *compWriter) Write(p []byte) (int, error) {
+	return c.cw.Write(p)
+}
+
+// Close flushes the compressor, then writes the final chunk
+func (c *compWriter) Close() error {
+	err := c.cw.Close()
+	if eErr := c.ew.Close(); err == nil {
+		err = eErr
+	}
+	return err
+}
+
+// compReader decompresses the plaintext of a decReader
+type compReader struct {
+	cr io.ReadCloser
+	dr *decReader
+}
+
+func (c *compReader) Read(p []byte) (int, error) {
+	return c.cr.Read(p)
+}
+
+func (c *compReader) Meta() *Metadata {
+	return c.dr.Meta()
+}
+
+func (c *compReader) Close() error {
+	c.cr.Close()
+	return c.dr.Close()
+}
+
+// compSeekDec decompresses the plaintext of a seekDec. Compressed data can only be read
+// in order, so seeking backwards starts over from the beginning, and seeking forwards
+// decompresses and discards everything in between. The decompressed size isn't stored,
+// so the first call to Size, or a Seek from the end, decompresses the whole file once.
+// If that fails, the error is kept and returned by every later call.
+type compSeekDec struct {
+	mu   *sync.Mutex
+	sd   *seekDec
+	comp Compression
+	cr   io.ReadCloser
+	off  int64
+	size int64
+	err  error
+}
+
+func newCompSeekDec(sd *seekDec, comp Compression) (*compSeekDec, error) {
+	c := &compSeekDec{
+		mu:   &sync.Mutex{},
+		sd:   sd,
+		comp: comp,
+		size: -1,
+	}
+	if err := c.reset(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reset starts decompressing from the beginning again
+func (c *compSeekDec) reset() error {
+	if c.cr != nil {
+		c.cr.Close()
+		c.cr = nil
+	}
+	if _, err := c.sd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cr, err := c.comp.newReader(c.sd)
+	if err != nil {
+		return err
+	}
+	c.cr = cr
+	c.off = 0
+	return nil
+}
+
+func (c *compSeekDec) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.cr.Read(p)
+	c.off += int64(n)
+	return n, err
+}
+
+func (c *compSeekDec) Seek(offset int64, whence int) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.seek(offset, whence)
+}
+
+func (c *compSeekDec) seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.off
+	case io.SeekEnd:
+		size, err := c.sizeLocked()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, ErrBadWhence
+	}
+
+	if offset < 0 {
+		return 0, ErrNegOffset
+	}
+
+	if offset < c.off {
+		if err := c.reset(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.CopyN(ioutil.Discard, c.cr, offset-c.off)
+	c.off += n
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	// seeking past the end is allowed, any read from there returns io.EOF
+	return offset, nil
+}
+
+func (c *compSeekDec) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	cur := c.off
+	defer c.seek(cur, io.SeekStart)
+
+	if _, err := c.seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if c.off < off {
+		return 0, io.EOF
+	}
+
+	n, err := io.ReadFull(c.cr, p)
+	c.off += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Size decompresses the whole file the first time it's called. It returns -1 if any of
+// the file fails to decompress or authenticate, and CheckSize returns why
+func (c *compSeekDec) Size() int64 {
+	size, err := c.CheckSize()
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (c *compSeekDec) CheckSize() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sizeLocked()
+}
+
+func (c *compSeekDec) sizeLocked() (int64, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.size >= 0 {
+		return c.size, nil
+	}
+
+	cur := c.off
+	n, err := io.Copy(ioutil.Discard, c.cr)
+	if err != nil {
+		c.err = err
+		return 0, err
+	}
+	c.size = cur + n
+	c.off = c.size
+
+	if _, err := c.seek(cur, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return c.size, nil
+}
+
+func (c *compSeekDec) Meta() *Metadata {
+	return c.sd.Meta()
+}
+
+func (c *compSeekDec) Close() error {
+	c.cr.Close()
+	return c.sd.Close()
+}
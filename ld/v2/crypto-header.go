@@ -0,0 +1,524 @@
+package v2
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"io"
+	"math"
+)
+
+// a printable representation of a cryptoHeader
+type CryptoHeader struct {
+	Ver         uint16
+	Suite       Suite
+	ChunkSize   uint32
+	NoncePrefix []byte
+	Compression Compression
+	Padding     Padding
+
+	// one key slot per password stanza
+	KeySlots []KeySlot
+
+	// the ephemeral public key of each recipient stanza
+	EphemeralKeys [][]byte
+
+	// true if the file has a sealed metadata section
+	HasMeta bool
+
+	// the key the file was signed with, or nil if it isn't signed
+	Signer *KeyID
+
+	HeaderMAC []byte
+}
+
+// KeySlot describes a password stanza. The Salt of a batch slot is the salt of its batch,
+// and FileSalt is its own. FileSalt is nil for every other slot
+type KeySlot struct {
+	Factors  Factors
+	KDF      KDFParams
+	Salt     []byte
+	FileSalt []byte
+}
+
+func (ch CryptoHeader) String() string {
+	templ := `
+Ver: %d
+Suite: %s
+ChunkSize: %d
+NoncePrefix: %x
+Compression: %s
+Padding: %s
+KeySlots: %d%s
+Recipients: %d%s
+HasMeta: %t
+Signer: %s
+HeaderMAC: %x
+
+`
+	slots := ""
+	for i, ks := range ch.KeySlots {
+		slots += fmt.Sprintf(`
+    Slot %d:
+        Factors: %s
+        KDF: %s
+        Salt: %x`,
+			i,
+			ks.Factors,
+			ks.KDF,
+			ks.Salt)
+		if ks.FileSalt != nil {
+			slots += fmt.Sprintf(`
+        FileSalt: %x`, ks.FileSalt)
+		}
+	}
+
+	signer := "none"
+	if ch.Signer != nil {
+		signer = ch.Signer.String()
+	}
+
+	ephKeys := ""
+	for _, k := range ch.EphemeralKeys {
+		ephKeys += fmt.Sprintf("\n    EphemeralKey: %x", k)
+	}
+
+	return fmt.Sprintf(templ,
+		ch.Ver,
+		ch.Suite,
+		ch.ChunkSize,
+		ch.NoncePrefix,
+		ch.Compression,
+		ch.Padding,
+		len(ch.KeySlots),
+		slots,
+		len(ch.EphemeralKeys),
+		ephKeys,
+		ch.HasMeta,
+		signer,
+		ch.HeaderMAC)
+}
+
+// ReadCryptoHeader reads and parses the header at the start of r. The header is not
+// authenticated, so the result should only be used for inspection.
+func ReadCryptoHeader(r io.Reader) (CryptoHeader, error) {
+	ch, err := readCryptoHeader(r)
+	if err != nil {
+		return CryptoHeader{}, err
+	}
+
+	pch := CryptoHeader{
+		Ver:           ch.ver,
+		Suite:         ch.suite,
+		ChunkSize:     ch.chunkSize,
+		NoncePrefix:   ch.noncePrefix,
+		Compression:   ch.comp,
+		Padding:       ch.pad,
+		KeySlots:      []KeySlot{},
+		EphemeralKeys: [][]byte{},
+		HasMeta:       ch.meta != nil,
+		Signer:        ch.signer,
+		HeaderMAC:     ch.mac,
+	}
+
+	for _, ps := range ch.passes {
+		pch.KeySlots = append(pch.KeySlots, KeySlot{
+			Factors:  ps.factors,
+			KDF:      ps.kdf,
+			Salt:     ps.salt,
+			FileSalt: ps.fileSalt,
+		})
+	}
+
+	for _, xs := range ch.recips {
+		pch.EphemeralKeys = append(pch.EphemeralKeys, xs.ephPub)
+	}
+
+	return pch, nil
+}
+
+func newCryptoHeader(suite Suite, chunkSize uint32) *cryptoHeader {
+	ch := &cryptoHeader{
+		ver:       Version,
+		suite:     suite,
+		chunkSize: chunkSize,
+	}
+	ch.noncePrefix = ch.genNoncePrefix()
+	return ch
+}
+
+type cryptoHeader struct {
+	ver         uint16
+	suite       Suite
+	chunkSize   uint32
+	noncePrefix []byte
+	passes      []*passStanza
+	recips      []*x25519Stanza
+	meta        []byte
+	comp        Compression
+	pad         Padding
+	signer      *KeyID
+	mac         []byte
+
+	// the marshaled header as it was read or written
+	raw []byte
+}
+
+// a single tagged header section
+type section struct {
+	tag uint8
+	val []byte
+}
+
+func (ch *cryptoHeader) genNoncePrefix() []byte {
+	np := make([]byte, ch.suite.lenNoncePrefix())
+	fillRand(np)
+	return np
+}
+
+// unwrap recovers the file key from the first stanza that pass, keyfile, or one of ids can open.
+// Key slots are only tried if their cost is within limit
+func (ch *cryptoHeader) unwrap(pass []byte, keyfile *memguard.LockedBuffer, ids []*Identity, limit v1.CostParams, cache BatchCache) (*memguard.LockedBuffer, error) {
+	for _, xs := range ch.recips {
+		for _, id := range ids {
+			if fileKey, err := xs.unwrap(id); err == nil {
+				return fileKey, nil
+			}
+		}
+	}
+
+	_, fileKey, err := ch.unwrapSlot(pass, keyfile, limit, cache)
+	return fileKey, err
+}
+
+// unwrapSlot returns the index of the key slot that pass and keyfile unlock and the file key.
+// Slots are only tried if all of their factors were given. If none could be tried because
+// a keyfile is missing ErrNeedKeyfile is returned, and if there was nothing to try at all
+// it is ErrNoIdentity. The time of every slot derived is added up, so a header crafted with
+// many slots can't cost more than limit either. Slots that would take the total over limit
+// are skipped, and if none of the others unlock the file, their ErrCostLimit is returned.
+// Batch slots whose master key is in cache are always tried, since their key doesn't need
+// to be derived again.
+func (ch *cryptoHeader) unwrapSlot(pass []byte, keyfile *memguard.LockedBuffer, limit v1.CostParams, cache BatchCache) (int, *memguard.LockedBuffer, error) {
+	tried, needKeyfile := false, false
+	var limitErr error
+	var spent uint64
+	for i, ps := range ch.passes {
+		if !ps.cached(cache) {
+			if err := ps.canTry(pass, keyfile); err != nil {
+				needKeyfile = needKeyfile || err == ErrNeedKeyfile
+				continue
+			}
+			cost := ps.kdf.Cost()
+			total := spent + uint64(cost.Time)
+			if total > math.MaxUint32 {
+				total = math.MaxUint32
+			}
+			cost.Time = uint32(total)
+			if err := cost.Check(limit); err != nil {
+				limitErr = err
+				continue
+			}
+			spent = total
+		}
+		tried = true
+		fileKey, err := ps.unwrap(pass, keyfile, cache)
+		switch err {
+		case nil:
+			return i, fileKey, nil
+		case ErrBadHeader:
+			return 0, nil, err
+		}
+	}
+
+	switch {
+	case limitErr != nil:
+		return 0, nil, limitErr
+	case needKeyfile:
+		return 0, nil, ErrNeedKeyfile
+	case tried:
+		return 0, nil, ErrWrongPassword
+	default:
+		return 0, nil, ErrNoIdentity
+	}
+}
+
+// cipherSection returns the value of the cipher section, which never changes once a file is written
+func (ch *cryptoHeader) cipherSection() []byte {
+	cipherSec := bytes.NewBuffer(nil)
+	cipherSec.Write(ldtools.U8tob(uint8(ch.suite)))
+	cipherSec.Write(ldtools.U32tob(ch.chunkSize))
+	cipherSec.Write(ch.noncePrefix)
+	return cipherSec.Bytes()
+}
+
+func (ch *cryptoHeader) sections() []section {
+	secs := []section{{tag: secCipher, val: ch.cipherSection()}}
+
+	for _, ps := range ch.passes {
+		passSec, _ := ps.MarshalBinary()
+		secs = append(secs, section{tag: ps.tag(), val: passSec})
+	}
+
+	for _, xs := range ch.recips {
+		xSec, _ := xs.MarshalBinary()
+		secs = append(secs, section{tag: secX25519, val: xSec})
+	}
+
+	if ch.comp != CompressNone {
+		secs = append(secs, section{tag: secCompress, val: ldtools.U8tob(uint8(ch.comp))})
+	}
+
+	if ch.pad != PadNone {
+		secs = append(secs, section{tag: secPad, val: ldtools.U8tob(uint8(ch.pad))})
+	}
+
+	if ch.signer != nil {
+		secs = append(secs, section{tag: secSigner, val: ch.signer[:]})
+	}
+
+	if ch.meta != nil {
+		secs = append(secs, section{tag: secMeta, val: ch.meta})
+	}
+
+	return secs
+}
+
+// MarshalBinary returns the header bytes covered by the header MAC, which
+// is everything except the MAC itself
+func (ch *cryptoHeader) MarshalBinary() (data []byte, err error) {
+	body := bytes.NewBuffer(nil)
+	for _, s := range ch.sections() {
+		body.Write(ldtools.U8tob(s.tag))
+		body.Write(ldtools.U16tob(uint16(len(s.val))))
+		body.Write(s.val)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(ldtools.U16tob(ch.ver))
+	buf.Write(ldtools.U32tob(uint32(body.Len())))
+	buf.Write(body.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary parses the header bytes covered by the header MAC
+func (ch *cryptoHeader) UnmarshalBinary(data []byte) error {
+	if len(data) < lenVer+lenHeaderLen {
+		return ErrBadHeader
+	}
+
+	ch.ver = ldtools.Btou16(data[:lenVer])
+	bodyLen := ldtools.Btou32(data[lenVer : lenVer+lenHeaderLen])
+	body := data[lenVer+lenHeaderLen:]
+	if uint32(len(body)) != bodyLen {
+		return ErrBadHeader
+	}
+
+	seen := map[uint8]bool{}
+	for len(body) > 0 {
+		if len(body) < lenSecTag+lenSecLen {
+			return ErrBadHeader
+		}
+		tag := ldtools.Btou8(body[:lenSecTag])
+		secLen := int(ldtools.Btou16(body[lenSecTag : lenSecTag+lenSecLen]))
+		body = body[lenSecTag+lenSecLen:]
+		if len(body) < secLen {
+			return ErrBadHeader
+		}
+
+		// only key slots and recipient stanzas may repeat
+		if seen[tag] && tag != secPass && tag != secKeySlot && tag != secKDFSlot && tag != secBatchSlot && tag != secX25519 {
+			return ErrBadHeader
+		}
+
+		var err error
+		switch tag {
+		case secCipher:
+			err = ch.unmarshalCipher(body[:secLen])
+		case secPass:
+			ps := &passStanza{}
+			err = ps.UnmarshalBinary(body[:secLen])
+			ch.passes = append(ch.passes, ps)
+		case secKeySlot:
+			ps := &passStanza{}
+			err = ps.unmarshalKeySlot(body[:secLen])
+			ch.passes = append(ch.passes, ps)
+		case secKDFSlot:
+			ps := &passStanza{}
+			err = ps.unmarshalKDFSlot(body[:secLen])
+			ch.passes = append(ch.passes, ps)
+		case secBatchSlot:
+			ps := &passStanza{}
+			err = ps.unmarshalBatchSlot(body[:secLen])
+			ch.passes = append(ch.passes, ps)
+		case secMeta:
+			ch.meta = body[:secLen]
+		case secCompress:
+			err = ch.unmarshalCompress(body[:secLen])
+		case secPad:
+			err = ch.unmarshalPad(body[:secLen])
+		case secSigner:
+			err = ch.unmarshalSigner(body[:secLen])
+		case secX25519:
+			xs := &x25519Stanza{}
+			err = xs.UnmarshalBinary(body[:secLen])
+			ch.recips = append(ch.recips, xs)
+		default:
+			err = ErrBadHeader
+		}
+		if err != nil {
+			return err
+		}
+
+		seen[tag] = true
+		body = body[secLen:]
+	}
+
+	if !seen[secCipher] || len(ch.passes)+len(ch.recips) == 0 {
+		return ErrBadHeader
+	}
+
+	return nil
+}
+
+func (ch *cryptoHeader) unmarshalCipher(val []byte) error {
+	if len(val) < lenSuite+lenChunkSize {
+		return ErrBadHeader
+	}
+	ch.suite = Suite(ldtools.Btou8(val[:lenSuite]))
+	ch.chunkSize = ldtools.Btou32(val[lenSuite : lenSuite+lenChunkSize])
+	ch.noncePrefix = val[lenSuite+lenChunkSize:]
+
+	if !ch.suite.Valid() {
+		return ErrBadSuite
+	}
+	if ch.chunkSize == 0 || ch.chunkSize > maxChunkSize {
+		return ErrBadChunkSize
+	}
+	if len(ch.noncePrefix) != ch.suite.lenNoncePrefix() {
+		return ErrBadHeader
+	}
+	return nil
+}
+
+func (ch *cryptoHeader) unmarshalCompress(val []byte) error {
+	if len(val) != lenCompress {
+		return ErrBadHeader
+	}
+	ch.comp = Compression(ldtools.Btou8(val))
+	if ch.comp == CompressNone || !ch.comp.Valid() {
+		return ErrBadCompression
+	}
+	return nil
+}
+
+func (ch *cryptoHeader) unmarshalPad(val []byte) error {
+	if len(val) != lenPad {
+		return ErrBadHeader
+	}
+	ch.pad = Padding(ldtools.Btou8(val))
+	if ch.pad == PadNone || !ch.pad.Valid() {
+		return ErrBadPadding
+	}
+	return nil
+}
+
+func (ch *cryptoHeader) unmarshalSigner(val []byte) error {
+	if len(val) != lenKeyID {
+		return ErrBadHeader
+	}
+	ch.signer = &KeyID{}
+	copy(ch.signer[:], val)
+	return nil
+}
+
+// signed returns true if the file ends with a signature
+func (ch *cryptoHeader) signed() bool {
+	return ch.signer != nil
+}
+
+// readCryptoHeader reads the header and its MAC from the start of r
+func readCryptoHeader(r io.Reader) (*cryptoHeader, error) {
+	pre := make([]byte, lenVer+lenHeaderLen)
+	if err := readFull(r, pre); err != nil {
+		return nil, err
+	}
+
+	if ldtools.Btou16(pre[:lenVer]) != Version {
+		return nil, ErrVerMismatch
+	}
+
+	bodyLen := ldtools.Btou32(pre[lenVer:])
+	if bodyLen > maxHeaderLen {
+		return nil, ErrBadHeader
+	}
+
+	body := make([]byte, bodyLen)
+	mac := make([]byte, lenHeadMAC)
+	if err := readFull(r, body); err != nil {
+		return nil, err
+	}
+	if err := readFull(r, mac); err != nil {
+		return nil, err
+	}
+
+	raw := append(pre, body...)
+	ch := &cryptoHeader{}
+	if err := ch.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	ch.raw = raw
+	ch.mac = mac
+
+	return ch, nil
+}
+
+// readFull is io.ReadFull, except that running out of data is reported as ErrTooSmall
+func readFull(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTooSmall
+	}
+	return err
+}
+
+func (ch *cryptoHeader) Ver() uint16 {
+	return ch.ver
+}
+
+func (ch *cryptoHeader) Suite() Suite {
+	return ch.suite
+}
+
+func (ch *cryptoHeader) ChunkSize() uint32 {
+	return ch.chunkSize
+}
+
+func (ch *cryptoHeader) NoncePrefix() []byte {
+	return ch.noncePrefix
+}
+
+func (ch *cryptoHeader) Compression() Compression {
+	return ch.comp
+}
+
+func (ch *cryptoHeader) Padding() Padding {
+	return ch.pad
+}
+
+// Raw returns the header bytes exactly as they were read, or marshals them
+// if the header is new
+func (ch *cryptoHeader) Raw() []byte {
+	if ch.raw == nil {
+		ch.raw, _ = ch.MarshalBinary()
+	}
+	return ch.raw
+}
+
+// Len is the full size of the header in bytes, including the header MAC
+func (ch *cryptoHeader) Len() int {
+	return len(ch.Raw()) + lenHeadMAC
+}
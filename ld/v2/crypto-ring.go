@@ -0,0 +1,146 @@
+package v2
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/awnumar/memguard"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+)
+
+type cryptoRing struct {
+	mu                 *sync.Mutex
+	headKey, cipherKey *memguard.LockedBuffer
+	metaKey            *memguard.LockedBuffer
+	ch                 *cryptoHeader
+	aead               cipher.AEAD
+}
+
+// newCryptoRing derives the header and payload keys from fileKey
+func newCryptoRing(fileKey *memguard.LockedBuffer, header *cryptoHeader) (*cryptoRing, error) {
+	cr := &cryptoRing{
+		mu: &sync.Mutex{},
+		ch: header,
+	}
+
+	if err := cr.genCrypto(fileKey); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+func (cr *cryptoRing) genCrypto(fileKey *memguard.LockedBuffer) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.cipherKey = deriveKey(fileKey, infoCipher, keyLenCipher)
+	cr.headKey = deriveKey(fileKey, infoHead, keyLenHead)
+	cr.metaKey = deriveKey(fileKey, infoMeta, keyLenMeta)
+
+	aead, err := cr.ch.Suite().newAEAD(cr.cipherKey.Bytes())
+	if err != nil {
+		cr.headKey.Destroy()
+		cr.cipherKey.Destroy()
+		cr.metaKey.Destroy()
+		return err
+	}
+	cr.aead = aead
+
+	return nil
+}
+
+// HeaderMAC returns the hmac-sha256 of the marshaled header
+func (cr *cryptoRing) HeaderMAC() []byte {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	mac := hmac.New(sha256.New, cr.headKey.Bytes())
+	mac.Write(cr.ch.Raw())
+	return mac.Sum(nil)
+}
+
+// ChunkAD returns the additional data every chunk is sealed with, an hmac-sha256 of the
+// version and cipher section. It doesn't cover the stanzas, so they can be rewritten
+// without touching the chunks
+func (cr *cryptoRing) ChunkAD() []byte {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	mac := hmac.New(sha256.New, cr.headKey.Bytes())
+	mac.Write(infoChunkAD)
+	mac.Write(ldtools.U16tob(cr.ch.Ver()))
+	mac.Write(cr.ch.cipherSection())
+	return mac.Sum(nil)
+}
+
+// VerifyHeader returns true if the MAC read with the header is valid
+func (cr *cryptoRing) VerifyHeader() bool {
+	return hmac.Equal(cr.ch.mac, cr.HeaderMAC())
+}
+
+func (cr *cryptoRing) AEAD() cipher.AEAD {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	return cr.aead
+}
+
+// Nonce writes the nonce for chunk i, sealed with flag, into dst and returns it
+func (cr *cryptoRing) Nonce(dst []byte, i uint32, flag uint8) []byte {
+	prefix := cr.ch.NoncePrefix()
+	dst = append(dst[:0], prefix...)
+	dst = append(dst, ldtools.U32tob(i)...)
+	return append(dst, flag)
+}
+
+// OpenChunk opens the sealed chunk i, trying each of flags in turn, and returns the
+// plaintext appended to dst, along with the flag it was sealed with. nonce is
+// scratch space for the nonce
+func (cr *cryptoRing) OpenChunk(dst, nonce, sealed, ad []byte, i uint32, flags ...uint8) ([]byte, uint8, error) {
+	aead := cr.AEAD()
+	for _, flag := range flags {
+		if plain, err := aead.Open(dst, cr.Nonce(nonce, i, flag), sealed, ad); err == nil {
+			return plain, flag, nil
+		}
+	}
+	return nil, 0, ErrSigMismatch
+}
+
+func (cr *cryptoRing) Destroy() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.headKey.Destroy()
+	cr.cipherKey.Destroy()
+	cr.metaKey.Destroy()
+}
+
+// deriveKey expands key into a new key of size keyLen for the purpose described by info
+func deriveKey(key *memguard.LockedBuffer, info []byte, keyLen int) *memguard.LockedBuffer {
+	out := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key.Bytes(), nil, info), out); err != nil {
+		// only possible if keyLen is far larger than any key we use
+		panic(err)
+	}
+	return memguard.NewBufferFromBytes(out)
+}
+
+func fillRand(buf []byte) {
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		// if we can't use the rand reader then all crypto is in question
+		// don't continue
+		panic(err)
+	}
+}
+
+// wipe zeroes b, for key material that can't live in a memguard buffer
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
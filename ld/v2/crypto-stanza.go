@@ -0,0 +1,316 @@
+package v2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/awnumar/memguard"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// every key encryption key is only ever used once, so the nonce can be fixed
+var wrapNonce = make([]byte, chacha20poly1305.NonceSize)
+
+// wrapKey seals fileKey under kek
+func wrapKey(kek []byte, fileKey *memguard.LockedBuffer) []byte {
+	aead, err := chacha20poly1305.New(kek)
+	if err != nil {
+		panic(err)
+	}
+	return aead.Seal(nil, wrapNonce, fileKey.Bytes(), nil)
+}
+
+// unwrapKey opens wrapped under kek, returning ErrSigMismatch if kek is wrong
+func unwrapKey(kek, wrapped []byte) (*memguard.LockedBuffer, error) {
+	aead, err := chacha20poly1305.New(kek)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, wrapNonce, wrapped, nil)
+	if err != nil {
+		return nil, ErrSigMismatch
+	}
+	return memguard.NewBufferFromBytes(fileKey), nil
+}
+
+// passStanza wraps the file key with a key derived from a password, a keyfile, or both.
+// A batch slot, one with a fileSalt, wraps it with a key derived from its batch's master
+// key, and its salt is the salt of the batch
+type passStanza struct {
+	factors  Factors
+	kdf      KDFParams
+	salt     []byte
+	fileSalt []byte
+	wrapped  []byte
+}
+
+// newPassStanza creates a key slot for pass and keyfile, either of which may be empty, but not both
+func newPassStanza(pass []byte, keyfile *memguard.LockedBuffer, kdf KDFParams, fileKey *memguard.LockedBuffer) (*passStanza, error) {
+	ps := &passStanza{
+		kdf:  kdf,
+		salt: make([]byte, lenSalt),
+	}
+	if len(pass) > 0 {
+		ps.factors |= FactorPassword
+	}
+	if keyfile != nil {
+		ps.factors |= FactorKeyfile
+	}
+	fillRand(ps.salt)
+
+	kek, err := ps.kek(pass, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(kek)
+	ps.wrapped = wrapKey(kek, fileKey)
+
+	return ps, nil
+}
+
+// kek runs pass through the slot's KDF and, for slots that use a keyfile, mixes the keyfile
+// into the result with hkdf-sha256. For batch slots the result is the batch's master key
+func (ps *passStanza) kek(pass []byte, keyfile *memguard.LockedBuffer) ([]byte, error) {
+	kek, err := ps.kdf.derive(pass, ps.salt, keyLenWrap)
+	if err != nil || ps.factors&FactorKeyfile == 0 {
+		return kek, err
+	}
+	defer wipe(kek)
+
+	mixed := make([]byte, keyLenWrap)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, kek, keyfile.Bytes(), infoKeyfile), mixed); err != nil {
+		panic(err)
+	}
+	return mixed, nil
+}
+
+// canTry returns ErrNeedKeyfile if the slot needs a keyfile that wasn't given, or
+// ErrNoIdentity if it needs a password that wasn't given
+func (ps *passStanza) canTry(pass []byte, keyfile *memguard.LockedBuffer) error {
+	if ps.factors&FactorKeyfile != 0 && keyfile == nil {
+		return ErrNeedKeyfile
+	}
+	if ps.factors&FactorPassword != 0 && len(pass) == 0 {
+		return ErrNoIdentity
+	}
+	return nil
+}
+
+// unwrap returns the file key if pass and keyfile are the right secrets for this slot.
+// The master key of a batch slot is looked up in cache, if there is one, and added
+// to it once it is derived and unlocks the file
+func (ps *passStanza) unwrap(pass []byte, keyfile *memguard.LockedBuffer, cache BatchCache) (*memguard.LockedBuffer, error) {
+	if ps.fileSalt != nil && cache != nil {
+		if bk := cache.BatchKey(ps.salt); bk != nil && bk.unlocks(ps) {
+			if fileKey, err := ps.unwrapBatch(bk.master.Bytes()); err == nil {
+				return fileKey, nil
+			}
+		}
+	}
+
+	if ps.factors&FactorPassword == 0 {
+		pass = nil
+	}
+	kek, err := ps.kek(pass, keyfile)
+	if err != nil {
+		return nil, ErrBadHeader
+	}
+	defer wipe(kek)
+	if ps.fileSalt == nil {
+		return unwrapKey(kek, ps.wrapped)
+	}
+
+	fileKey, err := ps.unwrapBatch(kek)
+	if err == nil && cache != nil {
+		cache.AddBatchKey(newBatchKey(ps, append([]byte{}, kek...)))
+	}
+	return fileKey, err
+}
+
+// unwrapBatch returns the file key of a batch slot if master is its batch's master key
+func (ps *passStanza) unwrapBatch(master []byte) (*memguard.LockedBuffer, error) {
+	kek := batchKEK(master, ps.fileSalt)
+	defer wipe(kek)
+	return unwrapKey(kek, ps.wrapped)
+}
+
+// cached returns true if ps is a batch slot whose master key is in cache
+func (ps *passStanza) cached(cache BatchCache) bool {
+	if ps.fileSalt == nil || cache == nil {
+		return false
+	}
+	bk := cache.BatchKey(ps.salt)
+	return bk != nil && bk.unlocks(ps)
+}
+
+// tag returns the section tag for the stanza. Argon2id password only slots keep the
+// original layout, other argon2id slots lead with their factors, and slots using any
+// other KDF lead with their factors and KDF. Batch slots lead with their factors and
+// KDF, and have their file's salt after the salt of the batch
+func (ps *passStanza) tag() uint8 {
+	switch {
+	case ps.fileSalt != nil:
+		return secBatchSlot
+	case ps.kdf.KDF() != KDFArgon2id:
+		return secKDFSlot
+	case ps.factors == FactorPassword:
+		return secPass
+	default:
+		return secKeySlot
+	}
+}
+
+func (ps *passStanza) MarshalBinary() (data []byte, err error) {
+	buf := bytes.NewBuffer(nil)
+	switch ps.tag() {
+	case secKeySlot:
+		buf.Write(ldtools.U8tob(uint8(ps.factors)))
+	case secKDFSlot, secBatchSlot:
+		buf.Write(ldtools.U8tob(uint8(ps.factors)))
+		buf.Write(ldtools.U8tob(uint8(ps.kdf.KDF())))
+	}
+	params, err := ps.kdf.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(params)
+	buf.Write(ps.salt)
+	buf.Write(ps.fileSalt)
+	buf.Write(ps.wrapped)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary parses a password only stanza
+func (ps *passStanza) UnmarshalBinary(data []byte) error {
+	if len(data) != lenPassSec {
+		return ErrBadHeader
+	}
+	ps.factors = FactorPassword
+	return ps.unmarshalSlot(KDFArgon2id, data)
+}
+
+// unmarshalKeySlot parses a stanza that leads with its factors
+func (ps *passStanza) unmarshalKeySlot(data []byte) error {
+	if len(data) != lenFactors+lenPassSec {
+		return ErrBadHeader
+	}
+	ps.factors = Factors(ldtools.Btou8(data[:lenFactors]))
+	if !ps.factors.Valid() {
+		return ErrBadHeader
+	}
+	return ps.unmarshalSlot(KDFArgon2id, data[lenFactors:])
+}
+
+// unmarshalKDFSlot parses a stanza that leads with its factors and KDF
+func (ps *passStanza) unmarshalKDFSlot(data []byte) error {
+	if len(data) < lenFactors+lenKDF {
+		return ErrBadHeader
+	}
+	ps.factors = Factors(ldtools.Btou8(data[:lenFactors]))
+	if !ps.factors.Valid() {
+		return ErrBadHeader
+	}
+	kdf := KDF(ldtools.Btou8(data[lenFactors : lenFactors+lenKDF]))
+	return ps.unmarshalSlot(kdf, data[lenFactors+lenKDF:])
+}
+
+// unmarshalBatchSlot parses a batch slot, which is laid out like a KDF slot with the
+// file's salt between the batch's salt and the wrapped key
+func (ps *passStanza) unmarshalBatchSlot(data []byte) error {
+	if len(data) < lenFactors+lenKDF+lenFileSalt+lenWrappedKey {
+		return ErrBadHeader
+	}
+	wrapped := len(data) - lenWrappedKey
+	ps.fileSalt = data[wrapped-lenFileSalt : wrapped]
+	slot := append(append([]byte{}, data[:wrapped-lenFileSalt]...), data[wrapped:]...)
+	return ps.unmarshalKDFSlot(slot)
+}
+
+// unmarshalSlot parses the KDF parameters, salt, and wrapped key shared by every key slot
+func (ps *passStanza) unmarshalSlot(kdf KDF, data []byte) error {
+	lParams := kdf.paramsLen()
+	lSalt := lParams + lenSalt
+	if !kdf.Valid() || len(data) != lSalt+lenWrappedKey {
+		return ErrBadHeader
+	}
+
+	params, err := kdf.unmarshalParams(data[:lParams])
+	if err != nil {
+		return err
+	}
+
+	ps.kdf = params
+	ps.salt = data[lParams:lSalt]
+	ps.wrapped = data[lSalt:]
+	return nil
+}
+
+// x25519Stanza wraps the file key for a single recipient's public key
+type x25519Stanza struct {
+	ephPub  []byte
+	wrapped []byte
+}
+
+func newX25519Stanza(r Recipient, fileKey *memguard.LockedBuffer) (*x25519Stanza, error) {
+	ephPriv := make([]byte, keyLenX25519)
+	fillRand(ephPriv)
+	defer wipe(ephPriv)
+
+	ephPub, err := curve25519.X25519(ephPriv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := curve25519.X25519(ephPriv, r.pub)
+	if err != nil {
+		return nil, ErrBadRecipient
+	}
+	defer wipe(shared)
+
+	xs := &x25519Stanza{ephPub: ephPub}
+	kek := xs.kek(shared, r.pub)
+	defer wipe(kek)
+	xs.wrapped = wrapKey(kek, fileKey)
+
+	return xs, nil
+}
+
+// kek derives the key encryption key from the shared secret, binding it to
+// both public keys
+func (xs *x25519Stanza) kek(shared, recipientPub []byte) []byte {
+	salt := append(append([]byte{}, xs.ephPub...), recipientPub...)
+	kek := make([]byte, keyLenWrap)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, infoX25519), kek); err != nil {
+		panic(err)
+	}
+	return kek
+}
+
+// unwrap returns the file key if id is the identity this stanza was made for
+func (xs *x25519Stanza) unwrap(id *Identity) (*memguard.LockedBuffer, error) {
+	shared, err := curve25519.X25519(id.priv.Bytes(), xs.ephPub)
+	if err != nil {
+		return nil, ErrSigMismatch
+	}
+	defer wipe(shared)
+
+	kek := xs.kek(shared, id.Recipient().pub)
+	defer wipe(kek)
+	return unwrapKey(kek, xs.wrapped)
+}
+
+func (xs *x25519Stanza) MarshalBinary() (data []byte, err error) {
+	return append(append([]byte{}, xs.ephPub...), xs.wrapped...), nil
+}
+
+func (xs *x25519Stanza) UnmarshalBinary(data []byte) error {
+	if len(data) != lenX25519Sec {
+		return ErrBadHeader
+	}
+	xs.ephPub = data[:keyLenX25519]
+	xs.wrapped = data[keyLenX25519:]
+	return nil
+}
@@ -0,0 +1,77 @@
+package v2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Suite identifies the AEAD cipher used to seal each chunk
+type Suite uint8
+
+const (
+	SuiteAESGCM            Suite = 1
+	SuiteXChaCha20Poly1305 Suite = 2
+
+	// DefaultSuite is used when no suite is selected
+	DefaultSuite = SuiteAESGCM
+)
+
+var suiteNames = map[Suite]string{
+	SuiteAESGCM:            "aes-256-gcm",
+	SuiteXChaCha20Poly1305: "xchacha20-poly1305",
+}
+
+// ParseSuite returns the Suite matching name
+func ParseSuite(name string) (Suite, error) {
+	for s, n := range suiteNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite (%s)", name)
+}
+
+func (s Suite) String() string {
+	if n, ok := suiteNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// Valid returns true if s is a supported suite
+func (s Suite) Valid() bool {
+	_, ok := suiteNames[s]
+	return ok
+}
+
+// NonceSize is the full nonce size of the suite in bytes
+func (s Suite) NonceSize() int {
+	switch s {
+	case SuiteXChaCha20Poly1305:
+		return chacha20poly1305.NonceSizeX
+	default:
+		return 12 // standard AES-GCM nonce size
+	}
+}
+
+// lenNoncePrefix is the size of the random per file part of the nonce
+func (s Suite) lenNoncePrefix() int {
+	return s.NonceSize() - lenNonceSuffix
+}
+
+func (s Suite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s {
+	case SuiteAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case SuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, ErrBadSuite
+	}
+}
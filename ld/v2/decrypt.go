@@ -0,0 +1,644 @@
+package v2
+
+import (
+	"bufio"
+	"errors"
+	"github.com/awnumar/memguard"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	ErrTooSmall      = errors.New("the provided io.Reader is too small to be an encrypted file")
+	ErrSigMismatch   = v1.ErrSigMismatch
+	ErrWrongPassword = errors.New("the password or keyfile is wrong")
+	ErrVerMismatch   = errors.New("invalid file version, version must be 2")
+	ErrBadHeader     = errors.New("the encrypted file header is malformed")
+	ErrTruncated     = errors.New("the encrypted data ended before the final chunk, it was likely truncated")
+	ErrBadWhence     = v1.ErrBadWhence
+	ErrNegOffset     = v1.ErrNegOffset
+)
+
+// SizeDecrypter is implemented by the SeekDecrypters returned from NewSeekDecOptions.
+// CheckSize is Size, except that when the size can't be found, the error that stopped it
+// is returned in place of a size of -1. Only compressed files can fail to find their size,
+// since it means decompressing and authenticating all of them
+type SizeDecrypter interface {
+	CheckSize() (int64, error)
+}
+
+// ErrCostLimit is returned when a key slot costs more to derive than DecOptions.MaxCost allows
+type ErrCostLimit = v1.ErrCostLimit
+
+// DecOptions holds the keys that NewDecOptions can use besides a password
+type DecOptions struct {
+	// Identities are tried against each recipient stanza in the header
+	Identities []*Identity
+
+	// Keyfile, from ReadKeyfile, is used with the password for key slots that need one
+	Keyfile *memguard.LockedBuffer
+
+	// MaxCost is the highest argon2id cost a key slot may ask for before it is refused with
+	// an ErrCostLimit, so a crafted file can't exhaust the memory or time of whoever decrypts
+	// it. Zero fields default to those of v1.DefCostLimit
+	MaxCost v1.CostParams
+
+	// Trusted are the keys a file must be signed by. When set, unsigned files return
+	// ErrUnsigned, files signed by any other key return ErrUnknownSigner, and files whose
+	// signature doesn't match return ErrBadSignature. When empty, signatures aren't checked
+	Trusted []VerifyingKey
+
+	// Batches caches the master keys of batch slots, so the other files of a batch, from
+	// EncOptions.Batch, are unlocked without deriving the key again
+	Batches BatchCache
+
+	// SkipMeta stops DecryptFileOptions from restoring the original mode, times, and owner.
+	// SkipOwner only skips the owner
+	SkipMeta  bool
+	SkipOwner bool
+}
+
+// NewDec returns an io.ReadCloser that will decrypt r. If the provided password is incorrect,
+// ErrWrongPassword is returned as soon as the key is derived. ErrSigMismatch only ever means
+// the encrypted file was corrupted or tampered with.
+//
+// Only the header is verified before NewDec returns. Each chunk is authenticated as it is
+// read, and Read returns ErrSigMismatch or ErrTruncated as soon as a chunk fails to verify,
+// so no unauthenticated plaintext is ever returned. Data already read from earlier chunks
+// was authenticated, but callers should discard it if Read fails before io.EOF. The
+// signature of a signed file can only be checked once all of it has been read, so when
+// DecOptions.Trusted is set, a bad signature is returned by Read in place of the final chunk.
+//
+// The returned io.ReadCloser, must be closed once it is no longer needed,
+// in order to clear the derived key from protected memory.
+func NewDec(pass []byte, r io.Reader) (io.ReadCloser, error) {
+	return NewDecOptions(pass, r, DecOptions{})
+}
+
+// NewDecOptions is NewDec, except the file key can also be recovered with one of opts.Identities,
+// or with opts.Keyfile. pass may be empty if an identity or keyfile is provided. If no password,
+// keyfile, or identity can unlock the file, ErrNoIdentity is returned, unless a password was
+// given and the file has a password stanza, in which case it is ErrWrongPassword. If the file has
+// key slots that need a keyfile and none was given, it is ErrNeedKeyfile.
+func NewDecOptions(pass []byte, r io.Reader, opts DecOptions) (io.ReadCloser, error) {
+	ch, cr, meta, err := openHeader(pass, r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	vk, err := trustedSigner(ch, opts.Trusted)
+	if err != nil {
+		cr.Destroy()
+		return nil, err
+	}
+
+	dr := &decReader{
+		cr:     cr,
+		meta:   meta,
+		ad:     cr.ChunkAD(),
+		padded: ch.Padding() != PadNone,
+		in:     make([]byte, int(ch.ChunkSize())+lenTag),
+		nonce:  make([]byte, 0, ch.Suite().NonceSize()),
+	}
+
+	// the signature at the end is held back from the chunks
+	dr.r = bufio.NewReader(r)
+	if ch.signed() {
+		var h hash.Hash
+		if vk != nil {
+			dr.vk = vk
+			dr.sh = newSigHash(ch)
+			h = dr.sh
+		}
+		dr.tail = newTailReader(r, lenSignature, h)
+		dr.r = bufio.NewReader(dr.tail)
+	}
+
+	if ch.Compression() == CompressNone {
+		return dr, nil
+	}
+
+	zr, err := ch.Compression().newReader(dr)
+	if err != nil {
+		dr.Close()
+		return nil, err
+	}
+
+	return &compReader{cr: zr, dr: dr}, nil
+}
+
+type decReader struct {
+	r      *bufio.Reader
+	cr     *cryptoRing
+	meta   *Metadata
+	ad     []byte
+	padded bool
+	inPad  bool
+	in     []byte
+	out    []byte
+	nonce  []byte
+	pos    int
+	seq    uint32
+	done   bool
+	err    error
+
+	// tail holds back the signature of signed files, which is checked
+	// with vk before the final chunk is returned
+	tail *tailReader
+	vk   *VerifyingKey
+	sh   sigHash
+}
+
+// Read returns plaintext from chunks that have already been authenticated
+func (d *decReader) Read(p []byte) (int, error) {
+	for d.pos == len(d.out) {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+
+	n := copy(p, d.out[d.pos:])
+	d.pos += n
+	return n, nil
+}
+
+// next reads and opens the next chunk
+func (d *decReader) next() error {
+	n, err := io.ReadFull(d.r, d.in)
+	final := false
+	switch err {
+	case nil:
+		// a full chunk is only the final one if nothing follows it
+		if _, err := d.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+
+	if n < lenTag {
+		return ErrTruncated
+	}
+
+	ct := d.in[:n]
+	out, flag, err := d.cr.OpenChunk(d.out[:0], d.nonce, ct, d.ad, d.seq, expectFlags(d.padded, d.inPad, final)...)
+	if err != nil {
+		// a chunk that only opens as a non final chunk means the
+		// data was cut off at a chunk boundary
+		if final {
+			if _, _, err := d.cr.OpenChunk(nil, d.nonce, ct, d.ad, d.seq, expectFlags(d.padded, d.inPad, false)...); err == nil {
+				return ErrTruncated
+			}
+		}
+		return ErrSigMismatch
+	}
+
+	if final && d.tail != nil {
+		if len(d.tail.tail) != lenSignature {
+			return ErrTruncated
+		}
+		if d.vk != nil {
+			if err := d.vk.verify(d.sh, d.tail.tail); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch {
+	case flag&flagDataEnd != 0:
+		if out, err = unpad(out); err != nil {
+			return err
+		}
+		d.inPad = true
+	case flag&flagPad != 0:
+		out = out[:0]
+	}
+
+	d.out = out
+	d.pos = 0
+	d.seq++
+	if final {
+		d.done = true
+	} else if d.seq == 0 {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+func (d *decReader) Meta() *Metadata {
+	return d.meta
+}
+
+func (d *decReader) Close() error {
+	d.cr.Destroy()
+	return nil
+}
+
+// openHeader reads the header from r, recovers the file key, verifies the header MAC,
+// and opens the metadata, if there is any
+func openHeader(pass []byte, r io.Reader, opts DecOptions) (*cryptoHeader, *cryptoRing, *Metadata, error) {
+	ch, err := readCryptoHeader(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fileKey, err := ch.unwrap(pass, opts.Keyfile, opts.Identities, opts.MaxCost, opts.Batches)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer fileKey.Destroy()
+
+	cr, err := newCryptoRing(fileKey, ch)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	//if this fails then the header was tampered with
+	if !cr.VerifyHeader() {
+		cr.Destroy()
+		return nil, nil, nil, ErrSigMismatch
+	}
+
+	meta, err := cr.openMeta()
+	if err != nil {
+		cr.Destroy()
+		return nil, nil, nil, err
+	}
+
+	return ch, cr, meta, nil
+}
+
+// NewSeekDec is NewDec, except the returned SeekDecrypter can also Seek and ReadAt any
+// offset of the plaintext. Only the chunks covering the requested range are read and
+// authenticated. The final chunk is authenticated before NewSeekDec returns, so a
+// truncated file is reported right away and Size can be trusted. Compressed files can
+// only be decompressed in order, so seeking backwards starts over from the beginning, and
+// the first call to Size decompresses the whole file. For padded files, the last chunk of
+// data is found with a binary search over the chunks, which authenticates a few more of them.
+// When DecOptions.Trusted is set, a signed file is read in full to check its signature
+// before NewSeekDec returns.
+// If r doesn't implement io.ReaderAt, it must not be used elsewhere until the
+// SeekDecrypter is closed.
+func NewSeekDec(pass []byte, r io.ReadSeeker) (v1.SeekDecrypter, error) {
+	return NewSeekDecOptions(pass, r, DecOptions{})
+}
+
+// NewSeekDecOptions is NewSeekDec with the keys of NewDecOptions
+func NewSeekDecOptions(pass []byte, r io.ReadSeeker, opts DecOptions) (v1.SeekDecrypter, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	start, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, cr, meta, err := openHeader(pass, r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	vk, err := trustedSigner(ch, opts.Trusted)
+	if err != nil {
+		cr.Destroy()
+		return nil, err
+	}
+
+	sealed := int64(ch.ChunkSize()) + lenTag
+	dataSize := end - start - int64(ch.Len())
+	if ch.signed() {
+		dataSize -= lenSignature
+	}
+	chunks := (dataSize + sealed - 1) / sealed
+
+	sd := &seekDec{
+		mu:      &sync.Mutex{},
+		ra:      ldtools.NewReaderAt(r),
+		cr:      cr,
+		meta:    meta,
+		ad:      cr.ChunkAD(),
+		padded:  ch.Padding() != PadNone,
+		start:   start + int64(ch.Len()),
+		payload: dataSize,
+		chunks:  chunks,
+		cs:      int64(ch.ChunkSize()),
+		in:      make([]byte, sealed),
+		nonce:   make([]byte, 0, ch.Suite().NonceSize()),
+		cached:  -1,
+	}
+
+	if chunks <= 0 || dataSize-(chunks-1)*sealed < lenTag {
+		sd.Close()
+		return nil, ErrTruncated
+	}
+
+	if vk != nil {
+		if err := sd.verifySig(ch, vk); err != nil {
+			sd.Close()
+			return nil, err
+		}
+	}
+
+	if chunks > 1<<32 {
+		sd.Close()
+		return nil, ErrTooLarge
+	}
+
+	if err := sd.findLast(); err != nil {
+		sd.Close()
+		return nil, err
+	}
+
+	if err := sd.load(sd.last); err != nil {
+		sd.Close()
+		return nil, err
+	}
+	sd.size = sd.last*sd.cs + int64(len(sd.plain))
+
+	if ch.Compression() == CompressNone {
+		return sd, nil
+	}
+
+	csd, err := newCompSeekDec(sd, ch.Compression())
+	if err != nil {
+		sd.Close()
+		return nil, err
+	}
+
+	return csd, nil
+}
+
+type seekDec struct {
+	mu      *sync.Mutex
+	ra      io.ReaderAt
+	cr      *cryptoRing
+	meta    *Metadata
+	ad      []byte
+	padded  bool
+	start   int64
+	payload int64
+	size    int64
+	off     int64
+	chunks  int64
+	last    int64
+	cs      int64
+	in      []byte
+	nonce   []byte
+	cached  int64
+	plain   []byte
+}
+
+// findLast authenticates the final chunk and finds the last chunk that holds data.
+// Only padded files have chunks after it, and since every chunk before it is sealed
+// as data and every chunk after it as padding, it can be found with a binary search
+func (sd *seekDec) findLast() error {
+	sd.last = sd.chunks - 1
+
+	final, notFinal := expectFlags(false, false, true), expectFlags(false, false, false)
+	if sd.padded {
+		final, notFinal = anyFlags(true), anyFlags(false)
+	}
+
+	flag, err := sd.open(sd.last, final...)
+	if err != nil {
+		// a chunk that only opens as a non final chunk means the
+		// data was cut off at a chunk boundary
+		if _, err := sd.open(sd.last, notFinal...); err == nil {
+			return ErrTruncated
+		}
+		return err
+	}
+
+	if flag&flagPad == 0 {
+		return nil
+	}
+
+	lo, hi := int64(0), sd.last-1
+	for lo <= hi {
+		mid := lo + (hi-lo)/2
+		flag, err := sd.open(mid, notFinal...)
+		if err != nil {
+			return err
+		}
+
+		switch flag {
+		case flagDataEnd:
+			sd.last = mid
+			return nil
+		case flagData:
+			lo = mid + 1
+		default:
+			hi = mid - 1
+		}
+	}
+
+	return ErrBadPadding
+}
+
+// verifySig reads all of the chunks to check the signature that follows them against vk
+func (sd *seekDec) verifySig(ch *cryptoHeader, vk *VerifyingKey) error {
+	sh := newSigHash(ch)
+	if _, err := io.Copy(sh, io.NewSectionReader(sd.ra, sd.start, sd.payload)); err != nil {
+		return err
+	}
+
+	sig := make([]byte, lenSignature)
+	n, err := sd.ra.ReadAt(sig, sd.start+sd.payload)
+	if err != nil && !(err == io.EOF && n == len(sig)) {
+		return err
+	}
+	return vk.verify(sh, sig)
+}
+
+// open reads chunk i into sd.plain, opening it with the first of flags that authenticates it
+func (sd *seekDec) open(i int64, flags ...uint8) (uint8, error) {
+	sd.cached = -1
+
+	sealed := sd.cs + lenTag
+	in := sd.in
+	if i == sd.chunks-1 {
+		in = in[:sd.payload-i*sealed]
+	}
+
+	n, err := sd.ra.ReadAt(in, sd.start+i*sealed)
+	if err != nil && !(err == io.EOF && n == len(in)) {
+		return 0, err
+	}
+
+	plain, flag, err := sd.cr.OpenChunk(sd.plain[:0], sd.nonce, in, sd.ad, uint32(i), flags...)
+	if err != nil {
+		return 0, err
+	}
+
+	sd.plain = plain
+	return flag, nil
+}
+
+// load reads and opens chunk i, keeping its plaintext until another chunk is loaded
+func (sd *seekDec) load(i int64) error {
+	if sd.cached == i {
+		return nil
+	}
+
+	var flag uint8
+	if sd.padded && i == sd.last {
+		flag = flagDataEnd
+	}
+	if i == sd.chunks-1 {
+		flag |= flagFinal
+	}
+
+	if _, err := sd.open(i, flag); err != nil {
+		return err
+	}
+
+	if flag&flagDataEnd != 0 {
+		plain, err := unpad(sd.plain)
+		if err != nil {
+			return err
+		}
+		sd.plain = plain
+	}
+
+	sd.cached = i
+	return nil
+}
+
+func (sd *seekDec) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegOffset
+	}
+
+	n := 0
+	for n < len(p) {
+		if off >= sd.size {
+			return n, io.EOF
+		}
+
+		i := off / sd.cs
+		if err := sd.load(i); err != nil {
+			return n, err
+		}
+
+		c := copy(p[n:], sd.plain[off-i*sd.cs:])
+		n += c
+		off += int64(c)
+	}
+
+	return n, nil
+}
+
+func (sd *seekDec) Meta() *Metadata {
+	return sd.meta
+}
+
+func (sd *seekDec) Read(p []byte) (int, error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	n, err := sd.readAt(p, sd.off)
+	sd.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (sd *seekDec) ReadAt(p []byte, off int64) (int, error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	return sd.readAt(p, off)
+}
+
+func (sd *seekDec) Seek(offset int64, whence int) (int64, error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sd.off
+	case io.SeekEnd:
+		offset += sd.size
+	default:
+		return 0, ErrBadWhence
+	}
+
+	if offset < 0 {
+		return 0, ErrNegOffset
+	}
+
+	sd.off = offset
+	return offset, nil
+}
+
+func (sd *seekDec) Size() int64 {
+	return sd.size
+}
+
+// CheckSize is Size, the size of an uncompressed file is always known
+func (sd *seekDec) CheckSize() (int64, error) {
+	return sd.size, nil
+}
+
+func (sd *seekDec) Close() error {
+	sd.cr.Destroy()
+	return nil
+}
+
+// DecryptFile will decrypt fileIn and store the plaintext result at fileOut.
+// The final chunk is authenticated before fileOut is created, so truncated files
+// never produce any output. If any other chunk fails to authenticate, fileOut is removed.
+func DecryptFile(pass []byte, fileIn, fileOut string) error {
+	return DecryptFileOptions(pass, fileIn, fileOut, DecOptions{})
+}
+
+// DecryptFileOptions is DecryptFile with the options of NewDecOptions. Unless opts.SkipMeta
+// is set, the mode, times, and owner recorded when the file was encrypted are restored.
+// fileOut is kept if they can't be, and an ErrMetaNotRestored is returned.
+func DecryptFileOptions(pass []byte, fileIn, fileOut string, opts DecOptions) error {
+	encFile, err := os.Open(fileIn)
+	if err != nil {
+		return err
+	}
+	defer encFile.Close()
+
+	decR, err := NewSeekDecOptions(pass, encFile, opts)
+	if err != nil {
+		return err
+	}
+	defer decR.Close()
+
+	plainFile, err := os.OpenFile(fileOut, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(plainFile, decR)
+	if cErr := plainFile.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(fileOut)
+		return err
+	}
+	if meta := decR.(MetaDecrypter).Meta(); meta != nil && !opts.SkipMeta {
+		return meta.Apply(fileOut, !opts.SkipOwner)
+	}
+	return nil
+}
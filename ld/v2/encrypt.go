@@ -0,0 +1,439 @@
+package v2
+
+import (
+	"errors"
+	"github.com/awnumar/memguard"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"io"
+	"os"
+)
+
+var (
+	ErrBadPass      = v1.ErrBadPass
+	ErrBadSuite     = errors.New("unsupported cipher suite")
+	ErrBadChunkSize = errors.New("chunk size must be between 1 byte and 16 MiB")
+	ErrTooLarge     = errors.New("too much data written, the chunk counter would overflow")
+	ErrClosed       = errors.New("write to a closed encrypter")
+)
+
+// EncOptions configures how NewEncOptions lays out the encrypted data.
+// Zero values select the defaults.
+type EncOptions struct {
+	// Suite is the AEAD used to seal each chunk
+	Suite Suite
+
+	// ChunkSize is the amount of plaintext sealed in each chunk
+	ChunkSize uint32
+
+	// Recipients can each decrypt the file with their Identity. When there
+	// are recipients, the password may be empty
+	Recipients []Recipient
+
+	// Passwords are extra key slots, each of which can decrypt the file on its own
+	Passwords []Password
+
+	// KDF derives the key of each key slot from its password. When nil, argon2id
+	// is used with the cost parameters passed to NewEncOptions
+	KDF KDFParams
+
+	// Keyfile, from ReadKeyfile, is needed along with the password to decrypt the file.
+	// If the password is empty, the keyfile alone can decrypt the file
+	Keyfile *memguard.LockedBuffer
+
+	// Batch, from NewBatchKey, takes the place of the key slot of the password and Keyfile,
+	// which it should be derived from, so that encrypting a batch of files only runs the KDF
+	// once. The password and KDF aren't used for that slot. Extra Passwords still get their
+	// own key slots
+	Batch *BatchKey
+
+	// Meta is sealed into the header. EncryptFileOptions reads it from the input file,
+	// unless SkipMeta is set
+	Meta     *Metadata
+	SkipMeta bool
+
+	// Compression is applied to the plaintext before it is encrypted. The default is
+	// CompressNone, since the size of compressed data can leak what the plaintext is
+	Compression Compression
+
+	// Padding rounds up the size of the encrypted chunks to hide the size of the plaintext
+	Padding Padding
+
+	// Parity is the percentage of Reed-Solomon parity that ld.NewEncOptions adds around the
+	// encrypted data, so that it can be repaired if it is damaged. The parity is added
+	// outside of the ciphertext by the parity package, so NewEncOptions ignores it
+	Parity int
+
+	// Armor has ld.NewEncOptions write the data as text with ld.NewArmorWriter, outside of
+	// any parity, so it can be pasted where binary data can't. NewEncOptions ignores it
+	Armor bool
+
+	// Split is the size of the volumes, in bytes, that ld.EncryptFileOptions splits the
+	// file into with the volume package. NewEncOptions ignores it
+	Split int64
+
+	// Signer, from ReadSigningKey, signs the file so it can be checked against
+	// DecOptions.Trusted. The key ID of Signer is recorded in the header
+	Signer *SigningKey
+
+	// Threads is the number of chunks sealed at once by a pool of goroutines. The chunks
+	// are still written in order, so the output is the same for any number of threads.
+	// Zero or one seals each chunk as it is written
+	Threads int
+}
+
+// Password is a key slot for EncOptions. KDF, when set, takes the place of Cost, which
+// is an argon2id cost. When both are zero, the slot uses the same KDF as the password
+// passed to NewEncOptions. Keyfile works the same as EncOptions.Keyfile
+type Password struct {
+	Pass    []byte
+	Cost    v1.CostParams
+	KDF     KDFParams
+	Keyfile *memguard.LockedBuffer
+}
+
+func (o EncOptions) withDefaults() EncOptions {
+	if o.Suite == 0 {
+		o.Suite = DefaultSuite
+	}
+	if o.ChunkSize == 0 {
+		o.ChunkSize = defChunkSize
+	}
+	return o
+}
+
+// NewEnc takes a password, key derivation cost parameters, and an io.Writer and returns
+// an io.WriteCloser that encrypts the data written to it, using the default EncOptions.
+//
+// Close must be called on the returned io.WriteCloser when finished writing
+// and before the underlying io.Writer is closed, otherwise the final chunk
+// will never be written and the data will fail to decrypt
+func NewEnc(pass []byte, cp v1.CostParams, w io.Writer) (io.WriteCloser, error) {
+	return NewEncOptions(pass, cp, w, EncOptions{})
+}
+
+// NewEncOptions is NewEnc with a configurable cipher suite, chunk size, recipients, and
+// extra passwords. The file can be decrypted with pass, if it isn't empty, or by any of
+// the recipients or extra passwords.
+func NewEncOptions(pass []byte, cp v1.CostParams, w io.Writer, opts EncOptions) (io.WriteCloser, error) {
+	if len(pass) == 0 && opts.Keyfile == nil && opts.Batch == nil && len(opts.Recipients) == 0 && len(opts.Passwords) == 0 {
+		return nil, ErrBadPass
+	}
+	for _, p := range opts.Passwords {
+		if len(p.Pass) == 0 && p.Keyfile == nil {
+			return nil, ErrBadPass
+		}
+	}
+
+	opts = opts.withDefaults()
+	if !opts.Suite.Valid() {
+		return nil, ErrBadSuite
+	}
+	if opts.ChunkSize > maxChunkSize {
+		return nil, ErrBadChunkSize
+	}
+	if !opts.Compression.Valid() {
+		return nil, ErrBadCompression
+	}
+	if !opts.Padding.Valid() {
+		return nil, ErrBadPadding
+	}
+	if opts.KDF == nil {
+		opts.KDF = KDFArgon2id.Params(cp)
+	}
+	if !opts.KDF.valid() {
+		return nil, ErrBadKDF
+	}
+	for _, p := range opts.Passwords {
+		if p.KDF != nil && !p.KDF.valid() {
+			return nil, ErrBadKDF
+		}
+	}
+
+	fileKey := memguard.NewBufferRandom(keyLenFile)
+	defer fileKey.Destroy()
+
+	ch := newCryptoHeader(opts.Suite, opts.ChunkSize)
+	ch.comp = opts.Compression
+	ch.pad = opts.Padding
+	if opts.Signer != nil {
+		id := opts.Signer.VerifyingKey().ID()
+		ch.signer = &id
+	}
+	switch {
+	case opts.Batch != nil:
+		ch.passes = append(ch.passes, newBatchStanza(opts.Batch, fileKey))
+	case len(pass) > 0 || opts.Keyfile != nil:
+		ps, err := newPassStanza(pass, opts.Keyfile, opts.KDF, fileKey)
+		if err != nil {
+			return nil, err
+		}
+		ch.passes = append(ch.passes, ps)
+	}
+	for _, p := range opts.Passwords {
+		kdf := p.KDF
+		switch {
+		case kdf != nil:
+		case p.Cost != (v1.CostParams{}):
+			kdf = KDFArgon2id.Params(p.Cost)
+		default:
+			kdf = opts.KDF
+		}
+		ps, err := newPassStanza(p.Pass, p.Keyfile, kdf, fileKey)
+		if err != nil {
+			return nil, err
+		}
+		ch.passes = append(ch.passes, ps)
+	}
+	for _, r := range opts.Recipients {
+		xs, err := newX25519Stanza(r, fileKey)
+		if err != nil {
+			return nil, err
+		}
+		ch.recips = append(ch.recips, xs)
+	}
+
+	cr, err := newCryptoRing(fileKey, ch)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Meta != nil && !opts.SkipMeta {
+		ch.meta = cr.sealMeta(opts.Meta)
+	}
+
+	mac := cr.HeaderMAC()
+	ew := &encWriter{
+		w:     w,
+		cr:    cr,
+		ad:    cr.ChunkAD(),
+		pad:   opts.Padding,
+		buf:   make([]byte, 0, opts.ChunkSize),
+		nonce: make([]byte, 0, opts.Suite.NonceSize()),
+	}
+	if opts.Signer != nil {
+		ew.signer = opts.Signer
+		ew.sh = newSigHash(ch)
+	}
+
+	if _, err := w.Write(append(ch.Raw(), mac...)); err != nil {
+		cr.Destroy()
+		return nil, err
+	}
+
+	if opts.Threads > 1 {
+		var sh *sigHash
+		if ew.signer != nil {
+			sh = &ew.sh
+		}
+		ew.pool = newSealPool(opts.Threads, int(opts.ChunkSize), cr, ew.ad, w, sh)
+	}
+
+	if opts.Compression == CompressNone {
+		return ew, nil
+	}
+
+	cw, err := opts.Compression.newWriter(ew)
+	if err != nil {
+		cr.Destroy()
+		return nil, err
+	}
+
+	return &compWriter{cw: cw, ew: ew}, nil
+}
+
+type encWriter struct {
+	w      io.Writer
+	cr     *cryptoRing
+	ad     []byte
+	pad    Padding
+	buf    []byte
+	out    []byte
+	nonce  []byte
+	seq    uint32
+	err    error
+	closed bool
+
+	// signer signs everything written to sh once the final chunk is written
+	signer *SigningKey
+	sh     sigHash
+
+	// pool seals the chunks when EncOptions.Threads is more than one
+	pool *sealPool
+}
+
+// Write buffers b and writes out each chunk once it is known not to be the last one
+func (e *encWriter) Write(b []byte) (int, error) {
+	if e.closed {
+		return 0, ErrClosed
+	}
+
+	n := 0
+	for len(b) > 0 {
+		if e.err != nil {
+			return n, e.err
+		}
+
+		// the buffered chunk can only be sealed once more data
+		// shows up, otherwise it might need to be the final chunk
+		if len(e.buf) == cap(e.buf) {
+			e.err = e.seal(flagData)
+			continue
+		}
+
+		c := copy(e.buf[len(e.buf):cap(e.buf)], b)
+		e.buf = e.buf[:len(e.buf)+c]
+		b = b[c:]
+		n += c
+	}
+
+	return n, e.err
+}
+
+func (e *encWriter) seal(flag uint8) error {
+	if e.pool != nil {
+		buf, err := e.pool.queue(e.buf, e.seq, flag)
+		if err != nil {
+			return err
+		}
+		e.buf = buf
+	} else {
+		nonce := e.cr.Nonce(e.nonce, e.seq, flag)
+		e.out = e.cr.AEAD().Seal(e.out[:0], nonce, e.buf, e.ad)
+
+		if _, err := e.w.Write(e.out); err != nil {
+			return err
+		}
+		if e.signer != nil {
+			e.sh.Write(e.out)
+		}
+		e.buf = e.buf[:0]
+	}
+
+	e.seq++
+	if e.seq == 0 && flag&flagFinal == 0 {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// sealPadded seals the last of the data followed by enough padding to bring the
+// encrypted chunks up to their padded size
+func (e *encWriter) sealPadded() error {
+	cs := int64(cap(e.buf))
+	sealed := cs + lenTag
+
+	// the last data chunk needs room for the pad marker
+	if int64(len(e.buf)) == cs {
+		if err := e.seal(flagData); err != nil {
+			return err
+		}
+	}
+
+	written := int64(e.seq) * sealed
+	min := written + int64(len(e.buf)) + 1 + lenTag
+	rest := e.pad.size(min, sealed) - written
+
+	e.buf = append(e.buf, padMarker)
+	if rest <= sealed {
+		e.zeroFill(rest - lenTag)
+		return e.seal(flagDataEnd | flagFinal)
+	}
+
+	e.zeroFill(cs)
+	if err := e.seal(flagDataEnd); err != nil {
+		return err
+	}
+	rest -= sealed
+
+	for rest > sealed {
+		e.zeroFill(cs)
+		if err := e.seal(flagPad); err != nil {
+			return err
+		}
+		rest -= sealed
+	}
+
+	e.zeroFill(rest - lenTag)
+	return e.seal(flagPad | flagFinal)
+}
+
+// zeroFill pads the buffered chunk with zeros up to size n
+func (e *encWriter) zeroFill(n int64) {
+	l := len(e.buf)
+	e.buf = e.buf[:n]
+	for i := l; i < len(e.buf); i++ {
+		e.buf[i] = 0
+	}
+}
+
+// Close seals and writes the final chunk, followed by the signature of signed files. It must be called once finished writing
+// to e and before closing the underlying writer
+func (e *encWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	defer e.cr.Destroy()
+
+	if e.err == nil && e.pad == PadNone {
+		e.err = e.seal(flagFinal)
+	} else if e.err == nil {
+		e.err = e.sealPadded()
+	}
+
+	// every chunk has to be written before the signature, and before the key is destroyed
+	if e.pool != nil {
+		if err := e.pool.close(); e.err == nil {
+			e.err = err
+		}
+	}
+
+	if e.err == nil && e.signer != nil {
+		_, e.err = e.w.Write(e.signer.sign(e.sh.Sum(nil)))
+	}
+
+	if c, ok := e.w.(io.Closer); ok {
+		if err := c.Close(); err != nil && e.err == nil {
+			return err
+		}
+	}
+	return e.err
+}
+
+// EncryptFile will encrypt fileIn and store the encrypted result at fileOut
+func EncryptFile(pass []byte, cp v1.CostParams, fileIn, fileOut string) error {
+	return EncryptFileOptions(pass, cp, fileIn, fileOut, EncOptions{})
+}
+
+// EncryptFileOptions is EncryptFile with the options of NewEncOptions
+func EncryptFileOptions(pass []byte, cp v1.CostParams, fileIn, fileOut string, opts EncOptions) error {
+	plainFile, err := os.Open(fileIn)
+	if err != nil {
+		return err
+	}
+	defer plainFile.Close()
+
+	if opts.Meta == nil && !opts.SkipMeta {
+		if opts.Meta, err = FileMeta(fileIn); err != nil {
+			return err
+		}
+	}
+
+	encF, err := os.OpenFile(fileOut, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer encF.Close()
+
+	encW, err := NewEncOptions(pass, cp, encF, opts)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(encW, plainFile); err != nil {
+		encW.Close()
+		return err
+	}
+
+	return encW.Close()
+}
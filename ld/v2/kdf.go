@@ -0,0 +1,260 @@
+package v2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"math"
+	"math/bits"
+)
+
+// KDF identifies the function a key slot derives its key encryption key with
+type KDF uint8
+
+const (
+	KDFArgon2id KDF = 1
+	KDFScrypt   KDF = 2
+	KDFPBKDF2   KDF = 3
+
+	// pbkdf2PerTime is the number of pbkdf2 iterations counted as one argon2id
+	// pass when a pbkdf2 slot is checked against DecOptions.MaxCost
+	pbkdf2PerTime = 1 << 17
+)
+
+var (
+	ErrBadKDF = errors.New("unsupported key derivation function or parameters")
+
+	kdfNames = map[KDF]string{
+		KDFArgon2id: "argon2id",
+		KDFScrypt:   "scrypt",
+		KDFPBKDF2:   "pbkdf2",
+	}
+
+	// DefScrypt is the scrypt cost recommended for interactive logins, it uses 128 MB of memory
+	DefScrypt = ScryptParams{LogN: 17, R: 8, P: 1}
+
+	// DefPBKDF2 is the pbkdf2-sha256 cost recommended by OWASP for password storage
+	DefPBKDF2 = PBKDF2Params{Iterations: 600000}
+)
+
+// ParseKDF returns the KDF matching name
+func ParseKDF(name string) (KDF, error) {
+	for k, n := range kdfNames {
+		if n == name {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key derivation function (%s)", name)
+}
+
+func (k KDF) String() string {
+	if n, ok := kdfNames[k]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(k))
+}
+
+// Valid returns true if k is a supported KDF
+func (k KDF) Valid() bool {
+	_, ok := kdfNames[k]
+	return ok
+}
+
+// Params returns the default parameters of k, using cp as the cost of argon2id
+func (k KDF) Params(cp v1.CostParams) KDFParams {
+	switch k {
+	case KDFScrypt:
+		return DefScrypt
+	case KDFPBKDF2:
+		return DefPBKDF2
+	default:
+		return Argon2idParams{Version: argon2.Version, CostParams: cp}
+	}
+}
+
+// paramsLen returns the length of the encoded parameters of k
+func (k KDF) paramsLen() int {
+	switch k {
+	case KDFArgon2id:
+		return lenVerArgon + lenCostParams
+	case KDFScrypt:
+		return lenScryptParams
+	case KDFPBKDF2:
+		return lenPBKDF2Params
+	default:
+		return 0
+	}
+}
+
+// unmarshalParams parses the parameters of k
+func (k KDF) unmarshalParams(data []byte) (KDFParams, error) {
+	if !k.Valid() || len(data) != k.paramsLen() {
+		return nil, ErrBadHeader
+	}
+
+	var p KDFParams
+	switch k {
+	case KDFArgon2id:
+		p = Argon2idParams{
+			Version: ldtools.Btou16(data[:2]),
+			CostParams: v1.CostParams{
+				Time:    ldtools.Btou32(data[2:6]),
+				Memory:  ldtools.Btou32(data[6:10]),
+				Threads: ldtools.Btou8(data[10:11]),
+			},
+		}
+	case KDFScrypt:
+		p = ScryptParams{
+			LogN: ldtools.Btou8(data[:1]),
+			R:    ldtools.Btou32(data[1:5]),
+			P:    ldtools.Btou32(data[5:9]),
+		}
+	case KDFPBKDF2:
+		p = PBKDF2Params{Iterations: ldtools.Btou32(data[:4])}
+	}
+
+	if !p.valid() {
+		return nil, ErrBadHeader
+	}
+	return p, nil
+}
+
+// KDFParams are a KDF along with the parameters a key slot derives its key with.
+// They are one of Argon2idParams, ScryptParams, or PBKDF2Params
+type KDFParams interface {
+	KDF() KDF
+
+	// Cost expresses the cost of deriving a key in argon2id terms, so that every
+	// KDF can be checked against DecOptions.MaxCost
+	Cost() v1.CostParams
+
+	String() string
+	MarshalBinary() ([]byte, error)
+
+	valid() bool
+	derive(pass, salt []byte, keyLen int) ([]byte, error)
+}
+
+// Argon2idParams are the parameters of argon2id, the default KDF
+type Argon2idParams struct {
+	Version    uint16
+	CostParams v1.CostParams
+}
+
+func (p Argon2idParams) KDF() KDF {
+	return KDFArgon2id
+}
+
+func (p Argon2idParams) Cost() v1.CostParams {
+	return p.CostParams
+}
+
+func (p Argon2idParams) String() string {
+	return fmt.Sprintf("argon2id (version: %d, time: %d, memory: %d MB, threads: %d)",
+		p.Version, p.CostParams.Time, p.CostParams.Memory/1024, p.CostParams.Threads)
+}
+
+func (p Argon2idParams) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(ldtools.U16tob(p.Version))
+	buf.Write(ldtools.U32tob(p.CostParams.Time))
+	buf.Write(ldtools.U32tob(p.CostParams.Memory))
+	buf.Write(ldtools.U8tob(p.CostParams.Threads))
+	return buf.Bytes(), nil
+}
+
+func (p Argon2idParams) valid() bool {
+	return p.CostParams.Time > 0 && p.CostParams.Threads > 0
+}
+
+func (p Argon2idParams) derive(pass, salt []byte, keyLen int) ([]byte, error) {
+	return argon2.IDKey(pass, salt, p.CostParams.Time, p.CostParams.Memory, p.CostParams.Threads, uint32(keyLen)), nil
+}
+
+// ScryptParams are the parameters of scrypt. The cost N is 2^LogN
+type ScryptParams struct {
+	LogN uint8
+	R    uint32
+	P    uint32
+}
+
+func (p ScryptParams) KDF() KDF {
+	return KDFScrypt
+}
+
+// Cost counts the memory scrypt needs, 128·R·N bytes, as the memory, and
+// each of P's passes over it as a unit of time
+func (p ScryptParams) Cost() v1.CostParams {
+	mem := uint64(p.R) << p.LogN >> 3
+	if mem > math.MaxUint32 || p.LogN > 56 {
+		mem = math.MaxUint32
+	}
+	return v1.CostParams{Time: p.P, Memory: uint32(mem), Threads: 1}
+}
+
+func (p ScryptParams) String() string {
+	return fmt.Sprintf("scrypt (N: 2^%d, r: %d, p: %d)", p.LogN, p.R, p.P)
+}
+
+func (p ScryptParams) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(ldtools.U8tob(p.LogN))
+	buf.Write(ldtools.U32tob(p.R))
+	buf.Write(ldtools.U32tob(p.P))
+	return buf.Bytes(), nil
+}
+
+// valid checks the limits scrypt.Key enforces on 64 bit systems. R·N is checked by the
+// number of bits it needs, before anything is shifted, so that 128·R·N can't overflow
+func (p ScryptParams) valid() bool {
+	return p.LogN > 0 && p.R > 0 && p.P > 0 &&
+		uint64(p.R)*uint64(p.P) < 1<<30 &&
+		int(p.LogN)+bits.Len32(p.R) <= 56
+}
+
+// derive returns ErrBadKDF if scrypt.Key refuses the parameters, which valid ones
+// only are on systems where int is too small for them
+func (p ScryptParams) derive(pass, salt []byte, keyLen int) ([]byte, error) {
+	key, err := scrypt.Key(pass, salt, 1<<p.LogN, int(p.R), int(p.P), keyLen)
+	if err != nil {
+		return nil, ErrBadKDF
+	}
+	return key, nil
+}
+
+// PBKDF2Params are the parameters of pbkdf2 with hmac-sha256
+type PBKDF2Params struct {
+	Iterations uint32
+}
+
+func (p PBKDF2Params) KDF() KDF {
+	return KDFPBKDF2
+}
+
+// Cost counts every pbkdf2PerTime iterations as a unit of time. pbkdf2 barely
+// uses any memory
+func (p PBKDF2Params) Cost() v1.CostParams {
+	return v1.CostParams{Time: uint32((uint64(p.Iterations) + pbkdf2PerTime - 1) / pbkdf2PerTime), Threads: 1}
+}
+
+func (p PBKDF2Params) String() string {
+	return fmt.Sprintf("pbkdf2-sha256 (iterations: %d)", p.Iterations)
+}
+
+func (p PBKDF2Params) MarshalBinary() ([]byte, error) {
+	return ldtools.U32tob(p.Iterations), nil
+}
+
+func (p PBKDF2Params) valid() bool {
+	return p.Iterations > 0
+}
+
+func (p PBKDF2Params) derive(pass, salt []byte, keyLen int) ([]byte, error) {
+	return pbkdf2.Key(pass, salt, int(p.Iterations), keyLen, sha256.New), nil
+}
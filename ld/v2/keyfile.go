@@ -0,0 +1,64 @@
+package v2
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/awnumar/memguard"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	ErrEmptyKeyfile = errors.New("keyfile is empty")
+	ErrNeedKeyfile  = errors.New("this file also needs a keyfile to decrypt")
+)
+
+// Factors records which secrets a key slot was derived from
+type Factors uint8
+
+const (
+	FactorPassword Factors = 1 << iota
+	FactorKeyfile
+)
+
+func (f Factors) String() string {
+	names := []string{}
+	if f&FactorPassword != 0 {
+		names = append(names, "password")
+	}
+	if f&FactorKeyfile != 0 {
+		names = append(names, "keyfile")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "+")
+}
+
+// Valid returns true if f only has known factors, and at least one of them
+func (f Factors) Valid() bool {
+	return f != 0 && f&^(FactorPassword|FactorKeyfile) == 0
+}
+
+// ReadKeyfile hashes the contents of the file at path into a key that can be used
+// as EncOptions.Keyfile and DecOptions.Keyfile. Any file can be a keyfile, but it
+// should hold at least 32 bytes of random data, and must never change.
+func ReadKeyfile(path string) (*memguard.LockedBuffer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrEmptyKeyfile
+	}
+
+	return memguard.NewBufferFromBytes(h.Sum(nil)), nil
+}
@@ -0,0 +1,151 @@
+package v2
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"golang.org/x/crypto/chacha20poly1305"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// NoOwner is the UID or GID recorded when the owner of a file isn't known
+const NoOwner = -1
+
+// Metadata holds the attributes of the original file. It is sealed in the header
+// under its own key, so nothing about the original file can be read without a key.
+type Metadata struct {
+	Name       string
+	Mode       os.FileMode
+	ModTime    time.Time
+	AccessTime time.Time
+
+	// UID and GID are NoOwner on systems without numeric owners
+	UID, GID int
+}
+
+// ErrMetaNotRestored is returned once a file has been decrypted, when the metadata of the
+// original file couldn't be restored. The decrypted file is kept, so it is only a warning
+type ErrMetaNotRestored struct {
+	Path string
+	Err  error
+}
+
+func (e ErrMetaNotRestored) Error() string {
+	return fmt.Sprintf("failed to restore the original mode and times of (%s), the decrypted file was kept: %v", e.Path, e.Err)
+}
+
+// MetaDecrypter is implemented by the decrypters returned from NewDecOptions and
+// NewSeekDecOptions. Meta returns nil if the file has no metadata.
+type MetaDecrypter interface {
+	Meta() *Metadata
+}
+
+// FileMeta reads the metadata of the file at path
+func FileMeta(path string) (*Metadata, error) {
+	fStat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{
+		Name:       filepath.Base(path),
+		Mode:       fStat.Mode(),
+		ModTime:    fStat.ModTime(),
+		AccessTime: fStat.ModTime(),
+		UID:        NoOwner,
+		GID:        NoOwner,
+	}
+	statMeta(fStat, m)
+
+	return m, nil
+}
+
+// Apply restores the mode and times of the file at path, and its owner if owner is true.
+// Only root can give a file away, so the owner is left alone for everyone else. Any
+// failure is returned as an ErrMetaNotRestored
+func (m *Metadata) Apply(path string, owner bool) error {
+	if owner && m.UID != NoOwner && m.GID != NoOwner && os.Geteuid() == 0 {
+		if err := chown(path, m.UID, m.GID); err != nil {
+			return ErrMetaNotRestored{Path: path, Err: err}
+		}
+	}
+	// chown may clear the setuid and setgid bits, so the mode comes after
+	if err := os.Chmod(path, m.Mode); err != nil {
+		return ErrMetaNotRestored{Path: path, Err: err}
+	}
+	if err := os.Chtimes(path, m.AccessTime, m.ModTime); err != nil {
+		return ErrMetaNotRestored{Path: path, Err: err}
+	}
+	return nil
+}
+
+func (m *Metadata) MarshalBinary() (data []byte, err error) {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(ldtools.U32tob(uint32(m.Mode)))
+	buf.Write(ldtools.U64tob(uint64(m.ModTime.UnixNano())))
+	buf.Write(ldtools.U64tob(uint64(m.AccessTime.UnixNano())))
+	buf.Write(ldtools.U32tob(uint32(m.UID)))
+	buf.Write(ldtools.U32tob(uint32(m.GID)))
+	buf.WriteString(m.Name)
+	return buf.Bytes(), nil
+}
+
+func (m *Metadata) UnmarshalBinary(data []byte) error {
+	if len(data) < lenMetaFixed {
+		return ErrBadHeader
+	}
+
+	lMode := lenMetaMode
+	lMTime := lMode + lenMetaTime
+	lATime := lMTime + lenMetaTime
+	lUID := lATime + lenMetaOwner
+	lGID := lUID + lenMetaOwner
+
+	m.Mode = os.FileMode(ldtools.Btou32(data[:lMode]))
+	m.ModTime = time.Unix(0, int64(ldtools.Btou64(data[lMode:lMTime])))
+	m.AccessTime = time.Unix(0, int64(ldtools.Btou64(data[lMTime:lATime])))
+	m.UID = int(int32(ldtools.Btou32(data[lATime:lUID])))
+	m.GID = int(int32(ldtools.Btou32(data[lUID:lGID])))
+	m.Name = filepath.Base(string(data[lGID:]))
+	return nil
+}
+
+// sealMeta encrypts m for the metadata section. The metadata key is only ever used once,
+// so the nonce can be fixed
+func (cr *cryptoRing) sealMeta(m *Metadata) []byte {
+	aead, err := chacha20poly1305.New(cr.metaKey.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	plain, _ := m.MarshalBinary()
+	return aead.Seal(nil, wrapNonce, plain, cr.metaAD())
+}
+
+// openMeta decrypts the metadata section, returning nil if there is none
+func (cr *cryptoRing) openMeta() (*Metadata, error) {
+	if cr.ch.meta == nil {
+		return nil, nil
+	}
+
+	aead, err := chacha20poly1305.New(cr.metaKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, wrapNonce, cr.ch.meta, cr.metaAD())
+	if err != nil {
+		return nil, ErrSigMismatch
+	}
+
+	m := &Metadata{}
+	if err := m.UnmarshalBinary(plain); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// metaAD binds the metadata to the version and cipher section, the same as the chunks
+func (cr *cryptoRing) metaAD() []byte {
+	return append(ldtools.U16tob(cr.ch.Ver()), cr.ch.cipherSection()...)
+}
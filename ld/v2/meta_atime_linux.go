@@ -0,0 +1,10 @@
+package v2
+
+import (
+	"syscall"
+	"time"
+)
+
+func statAtime(st *syscall.Stat_t, m *Metadata) {
+	m.AccessTime = time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+}
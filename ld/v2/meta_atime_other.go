@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package v2
+
+import (
+	"syscall"
+)
+
+// the access time field has a different name on every other system, so only the
+// modification time, which FileMeta already used for the access time, is kept
+func statAtime(st *syscall.Stat_t, m *Metadata) {}
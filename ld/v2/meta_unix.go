@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package v2
+
+import (
+	"os"
+	"syscall"
+)
+
+func statMeta(fStat os.FileInfo, m *Metadata) {
+	st, ok := fStat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	m.UID = int(st.Uid)
+	m.GID = int(st.Gid)
+	statAtime(st, m)
+}
+
+func chown(path string, uid, gid int) error {
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package v2
+
+import (
+	"os"
+)
+
+// windows has no numeric owners, so they are left as NoOwner
+func statMeta(fStat os.FileInfo, m *Metadata) {}
+
+func chown(path string, uid, gid int) error {
+	return nil
+}
@@ -0,0 +1,136 @@
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Padding identifies how the encrypted size of a file is rounded up to hide the
+// size of its plaintext
+type Padding uint8
+
+const (
+	PadNone  Padding = 0
+	PadPadme Padding = 1
+	PadPow2  Padding = 2
+)
+
+var (
+	ErrBadPadding = errors.New("unsupported or malformed padding")
+
+	paddingNames = map[Padding]string{
+		PadNone:  "none",
+		PadPadme: "padme",
+		PadPow2:  "pow2",
+	}
+)
+
+// ParsePadding returns the Padding matching name
+func ParsePadding(name string) (Padding, error) {
+	for p, n := range paddingNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown padding (%s)", name)
+}
+
+func (p Padding) String() string {
+	if n, ok := paddingNames[p]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(p))
+}
+
+// Valid returns true if p is a supported padding
+func (p Padding) Valid() bool {
+	_, ok := paddingNames[p]
+	return ok
+}
+
+// size returns the padded size of the encrypted chunks, given the smallest size min
+// they could be and the size of a full sealed chunk.
+//
+// The final chunk is the only one that can be short, and it can't be shorter than a
+// tag, so a size that would need a final chunk of 1 to 15 bytes is rounded up to one
+// that is exactly a tag long. That only depends on the padded size, so nothing
+// about the plaintext size leaks from it.
+func (p Padding) size(min, sealed int64) int64 {
+	var s int64
+	switch p {
+	case PadPadme:
+		s = padme(min)
+	case PadPow2:
+		s = pow2(min)
+	default:
+		s = min
+	}
+
+	if m := s % sealed; m > 0 && m < lenTag {
+		s += lenTag - m
+	}
+	return s
+}
+
+// padme rounds l up so that only the top bits of its size are significant, as described
+// in "Reducing Metadata Leakage from Encrypted Files and Communication with PURBs".
+// The overhead is at most 12%, and shrinks as l grows
+func padme(l int64) int64 {
+	if l < 2 {
+		return l
+	}
+	e := bits.Len64(uint64(l)) - 1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<uint(e-s) - 1
+	return (l + mask) &^ mask
+}
+
+// pow2 rounds l up to a power of two
+func pow2(l int64) int64 {
+	if l&(l-1) == 0 {
+		return l
+	}
+	return int64(1) << uint(bits.Len64(uint64(l)))
+}
+
+// unpad strips the zeros and the padMarker from the end of the last data chunk
+func unpad(b []byte) ([]byte, error) {
+	i := len(b) - 1
+	for i >= 0 && b[i] == 0 {
+		i--
+	}
+	if i < 0 || b[i] != padMarker {
+		return nil, ErrBadPadding
+	}
+	return b[:i], nil
+}
+
+// expectFlags returns the flags the next chunk of a stream may have been sealed with,
+// in the order they are most likely to be seen. inPad is true once the last data chunk
+// of a padded file has been read
+func expectFlags(padded, inPad, final bool) []uint8 {
+	switch {
+	case !padded && final:
+		return []uint8{flagFinal}
+	case !padded:
+		return []uint8{flagData}
+	case inPad && final:
+		return []uint8{flagPad | flagFinal}
+	case inPad:
+		return []uint8{flagPad}
+	case final:
+		return []uint8{flagDataEnd | flagFinal}
+	default:
+		return []uint8{flagData, flagDataEnd}
+	}
+}
+
+// anyFlags returns every flag a chunk of a padded file may have been sealed with,
+// for when it isn't known which side of the last data chunk it is on
+func anyFlags(final bool) []uint8 {
+	if final {
+		return []uint8{flagDataEnd | flagFinal, flagPad | flagFinal}
+	}
+	return []uint8{flagData, flagDataEnd, flagPad}
+}
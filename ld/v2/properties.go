@@ -0,0 +1,219 @@
+package v2
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Below is a representation of the finished data that will be written to the io.Writer passed into NewEnc:
+// Data:
+//     Version|HeaderLen|HeaderSections|HeaderMAC|Chunk0|Chunk1|...|ChunkN|Signature
+// Bytes:
+//     2|4|variable|32|chunk size + 16|chunk size + 16|...|variable + 16|64
+//
+// The Signature is only there when the header has a signer section.
+//
+// The header sections are a list of tagged values:
+// Data:
+//     Tag|Len|Value
+// Bytes:
+//     1|2|variable
+//
+// Cipher section value:
+//     Suite|ChunkSize|NoncePrefix
+//     1|4|nonce size - 5
+//
+// Password stanza value, one per key slot:
+//     Argon2Version|CostTime|CostMemory|CostThreads|Salt|WrappedFileKey
+//     2|4|4|1|64|48
+//
+// Key slot stanza value, for slots that use a keyfile, one per key slot:
+//     Factors|Argon2Version|CostTime|CostMemory|CostThreads|Salt|WrappedFileKey
+//     1|2|4|4|1|64|48
+//
+// KDF slot stanza value, for slots that derive their key with scrypt or pbkdf2-sha256:
+//     Factors|KDF|KDFParams|Salt|WrappedFileKey
+//     1|1|variable|64|48
+//
+// scrypt KDFParams:
+//     LogN|R|P
+//     1|4|4
+//
+// pbkdf2-sha256 KDFParams:
+//     Iterations
+//     4
+//
+// Batch slot stanza value, for files encrypted with a batch's master key, one per key slot:
+//     Factors|KDF|KDFParams|BatchSalt|FileSalt|WrappedFileKey
+//     1|1|variable|64|32|48
+//
+// X25519 stanza value, one per recipient:
+//     EphemeralPublicKey|WrappedFileKey
+//     32|48
+//
+// Compression section value, optional, left out when the data isn't compressed:
+//     Compression
+//     1
+//
+// Padding section value, optional, left out when the data isn't padded:
+//     Padding
+//     1
+//
+// Signer section value, optional, left out when the file isn't signed:
+//     KeyID
+//     8
+//
+// Metadata section value, optional, sealed with chacha20-poly1305:
+//     Mode|ModTime|AccessTime|UID|GID|Name + 16
+//     4|8|8|4|4|variable + 16
+//
+// Every file has a random file key. Each stanza wraps the file key with
+// chacha20-poly1305 under a key encryption key derived from a password with
+// argon2id, scrypt, or pbkdf2-sha256, or from an X25519 exchange with a recipient's public key. Each
+// password stanza is a key slot with its own salt and cost, so a file can be
+// shared by several passwords. A key slot's factors record whether it also needs a
+// keyfile, whose sha256 is mixed into the argon2id output with hkdf-sha256, or uses
+// the keyfile alone. Any one stanza is enough to recover the file key.
+//
+// A batch slot's key encryption key is derived with hkdf-sha256 from the master key of its
+// batch, using FileSalt as the salt. The master key is derived like any other key slot's key,
+// with BatchSalt as the salt, so every file of a batch shares the cost of a single derivation.
+//
+// The poly1305 tag of a key slot's WrappedFileKey is its key check value. It can only
+// be verified with the argon2id output of the right password, so a wrong password is
+// caught as soon as the key is derived, without reading any of the payload, and is
+// reported as ErrWrongPassword. Once the file key is recovered, any failure to verify
+// the header or a chunk can only mean the file was corrupted or tampered with.
+//
+// The header, payload, and metadata keys are derived from the file key with hkdf-sha256.
+// HeaderMAC is an hmac-sha256 of everything that comes before it. Each chunk is
+// sealed with the selected AEAD suite using the nonce NoncePrefix|ChunkIndex|Flag
+// and an hmac-sha256 of the version and cipher section as additional data, so chunks
+// can't be reordered, dropped, appended to, or moved between files. The stanzas aren't
+// part of the additional data, so a file can be rekeyed by rewriting only its header.
+//
+// Flag is 1 for the final chunk and 0 for every other chunk, unless the file is padded.
+// The chunks of a padded file are sized to the padded length. The last chunk holding any
+// data has flag 2, and its plaintext ends with 0x80 followed by zeros. Every chunk after
+// it has flag 4 and only holds zeros. The final chunk also has flag 1 set. Since the
+// padding is sealed along with the data, the size of the plaintext can't be read or
+// changed without the key.
+//
+// The HeaderMAC and the chunk tags only prove the file was written by someone who could
+// unlock it. A signed file also proves who wrote it. Its Signature is an Ed25519 signature
+// of the sha512 of the version, every header section other than the key stanzas, and every
+// chunk. KeyID is the first 8 bytes of the sha256 of the signer's public key, and is used to
+// pick the trusted key to check the signature with. Leaving out the stanzas means a signed
+// file can still be rekeyed.
+
+const (
+	Version uint16 = 2
+	FileExt        = v1.FileExt
+
+	//lengths of the keys used for encryption and verification
+	keyLenFile   = 32
+	keyLenWrap   = chacha20poly1305.KeySize
+	keyLenCipher = 32 //keysize for AES-256-GCM and XChaCha20-Poly1305
+	keyLenHead   = 32
+	keyLenX25519 = curve25519.ScalarSize
+	keyLenMeta   = chacha20poly1305.KeySize
+
+	//default chunk size
+	defChunkSize = 1024 * 64
+
+	//maximum sizes accepted when parsing a header
+	maxChunkSize = 1024 * 1024 * 16
+	maxHeaderLen = 1024 * 1024
+
+	//header data length
+	lenVer        = 2
+	lenHeaderLen  = 4
+	lenSecTag     = 1
+	lenSecLen     = 2
+	lenSuite      = 1
+	lenChunkSize  = 4
+	lenCompress   = 1
+	lenPad        = 1
+	lenVerArgon   = 2
+	lenFactors    = 1
+	lenKDF        = 1
+	lenSalt       = 64
+	lenFileSalt   = 32
+	lenWrappedKey = keyLenFile + chacha20poly1305.Overhead
+	lenHeadMAC    = sha256.Size
+	lenKeyID      = 8
+	lenSignature  = ed25519.SignatureSize
+
+	//time cost data length
+	lenCostTime   = 4
+	lenCostMem    = 4
+	lenCostThread = 1
+
+	//kdf parameter lengths, other than argon2id's
+	lenScryptParams = 1 + 4 + 4
+	lenPBKDF2Params = 4
+
+	//metadata length, not counting the name
+	lenMetaMode  = 4
+	lenMetaTime  = 8
+	lenMetaOwner = 4
+	lenMetaFixed = lenMetaMode + lenMetaTime*2 + lenMetaOwner*2
+
+	//nonce suffix length
+	lenNonceCounter = 4
+	lenNonceFlag    = 1
+	lenNonceSuffix  = lenNonceCounter + lenNonceFlag
+
+	//aead tag length, the same for both suites
+	lenTag = 16
+
+	//combined lengths
+	lenCostParams = lenCostTime + lenCostMem + lenCostThread
+	lenPassSec    = lenVerArgon + lenCostParams + lenSalt + lenWrappedKey
+	lenX25519Sec  = keyLenX25519 + lenWrappedKey
+
+	//exported lengths
+	LenHeadMAC   = lenHeadMAC
+	LenTag       = lenTag
+	LenSignature = lenSignature
+)
+
+// chunk flags, the last byte of each chunk's nonce
+const (
+	flagData    uint8 = 0
+	flagFinal   uint8 = 1
+	flagDataEnd uint8 = 2
+	flagPad     uint8 = 4
+
+	// padMarker ends the plaintext in the last data chunk of a padded file
+	padMarker = 0x80
+)
+
+// header section tags
+const (
+	secCipher    uint8 = 1
+	secPass      uint8 = 2
+	secX25519    uint8 = 3
+	secKeySlot   uint8 = 4
+	secMeta      uint8 = 5
+	secCompress  uint8 = 6
+	secPad       uint8 = 7
+	secKDFSlot   uint8 = 8
+	secSigner    uint8 = 9
+	secBatchSlot uint8 = 10
+)
+
+// hkdf info strings, one for each derived key
+var (
+	infoHead    = []byte("lockdown v2 header")
+	infoCipher  = []byte("lockdown v2 payload")
+	infoX25519  = []byte("lockdown v2 x25519")
+	infoChunkAD = []byte("lockdown v2 chunk ad")
+	infoKeyfile = []byte("lockdown v2 keyfile")
+	infoMeta    = []byte("lockdown v2 metadata")
+	infoSig     = []byte("lockdown v2 signature")
+	infoBatch   = []byte("lockdown v2 batch")
+)
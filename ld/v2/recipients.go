@@ -0,0 +1,162 @@
+package v2
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/curve25519"
+	"io"
+	"strings"
+)
+
+const (
+	// RecipientPrefix starts every encoded public key
+	RecipientPrefix = "lockdown-pub-"
+
+	// IdentityPrefix starts every encoded private key
+	IdentityPrefix = "LOCKDOWN-SECRET-"
+)
+
+var (
+	ErrBadRecipient = errors.New("invalid recipient public key")
+	ErrBadIdentity  = errors.New("invalid identity private key")
+	ErrNoIdentity   = errors.New("none of the provided identities or passwords can unlock the file")
+
+	errBadKey = errors.New("invalid key encoding")
+
+	keyEncoding = base64.RawURLEncoding
+)
+
+// Recipient is an X25519 public key that files can be encrypted to
+type Recipient struct {
+	pub []byte
+}
+
+// ParseRecipient decodes a public key encoded by Recipient.String
+func ParseRecipient(s string) (Recipient, error) {
+	pub, err := decodeKey(s, RecipientPrefix, keyLenX25519)
+	if err != nil {
+		return Recipient{}, ErrBadRecipient
+	}
+
+	return Recipient{pub: pub}, nil
+}
+
+func (r Recipient) String() string {
+	return RecipientPrefix + keyEncoding.EncodeToString(r.pub)
+}
+
+// Identity is an X25519 private key that can decrypt files encrypted to its Recipient
+type Identity struct {
+	priv *memguard.LockedBuffer
+	pub  []byte
+}
+
+// GenerateIdentity creates a new random Identity
+func GenerateIdentity() (*Identity, error) {
+	priv := make([]byte, keyLenX25519)
+	fillRand(priv)
+	return newIdentity(priv)
+}
+
+// ParseIdentity decodes a private key encoded by Identity.String
+func ParseIdentity(s string) (*Identity, error) {
+	priv, err := decodeKey(s, IdentityPrefix, keyLenX25519)
+	if err != nil {
+		return nil, ErrBadIdentity
+	}
+
+	return newIdentity(priv)
+}
+
+// newIdentity takes ownership of priv, which is wiped once it is moved into protected memory
+func newIdentity(priv []byte) (*Identity, error) {
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		wipe(priv)
+		return nil, ErrBadIdentity
+	}
+
+	return &Identity{priv: memguard.NewBufferFromBytes(priv), pub: pub}, nil
+}
+
+// Recipient returns the public key for id
+func (id *Identity) Recipient() Recipient {
+	return Recipient{pub: id.pub}
+}
+
+// String encodes the private key. Treat the result as a secret
+func (id *Identity) String() string {
+	return IdentityPrefix + keyEncoding.EncodeToString(id.priv.Bytes())
+}
+
+// Destroy clears the private key from protected memory
+func (id *Identity) Destroy() {
+	id.priv.Destroy()
+}
+
+// ReadIdentities parses one identity per line from r. Blank lines and lines starting with # are skipped
+func ReadIdentities(r io.Reader) ([]*Identity, error) {
+	ids := []*Identity{}
+	err := readKeyLines(r, func(line string) error {
+		id, err := ParseIdentity(line)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		for _, id := range ids {
+			id.Destroy()
+		}
+		return nil, err
+	}
+	return ids, nil
+}
+
+// ReadRecipients parses one recipient per line from r. Blank lines and lines starting with # are skipped
+func ReadRecipients(r io.Reader) ([]Recipient, error) {
+	recips := []Recipient{}
+	err := readKeyLines(r, func(line string) error {
+		recip, err := ParseRecipient(line)
+		if err != nil {
+			return err
+		}
+		recips = append(recips, recip)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recips, nil
+}
+
+// decodeKey decodes a key of length size encoded with prefix
+func decodeKey(s, prefix string, size int) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errBadKey
+	}
+
+	key, err := keyEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil || len(key) != size {
+		return nil, errBadKey
+	}
+	return key, nil
+}
+
+func readKeyLines(r io.Reader, parse func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parse(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,105 @@
+package v2
+
+import (
+	"github.com/raz-varren/lockdown/ld/v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Rekey replaces the key slot that oldPass unlocks with one for newPass, derived with
+// newCost. Only the header is rewritten: the file key, and so the encrypted chunks,
+// stay the same. Other key slots and recipients are kept. Slots that need a keyfile
+// can't be rekeyed, and return ErrNeedKeyfile. Slots that cost more than limit to derive
+// are refused with an ErrCostLimit, as described by DecOptions.MaxCost. newCost only
+// applies to argon2id slots, slots using another KDF keep their parameters.
+//
+// The file is copied, still encrypted, to a temp file in the same directory with the new
+// header, which is renamed over the original, so a crash part way through leaves either
+// the old file or the new one, never a file with a half written header.
+func Rekey(oldPass, newPass []byte, newCost, limit v1.CostParams, path string) error {
+	if len(newPass) == 0 {
+		return ErrBadPass
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ch, err := readCryptoHeader(f)
+	if err != nil {
+		return err
+	}
+	oldLen := ch.Len()
+
+	slot, fileKey, err := ch.unwrapSlot(oldPass, nil, limit, nil)
+	if err != nil {
+		return err
+	}
+	defer fileKey.Destroy()
+
+	cr, err := newCryptoRing(fileKey, ch)
+	if err != nil {
+		return err
+	}
+	defer cr.Destroy()
+
+	//if this fails then the header was tampered with
+	if !cr.VerifyHeader() {
+		return ErrSigMismatch
+	}
+
+	kdf := ch.passes[slot].kdf
+	if kdf.KDF() == KDFArgon2id {
+		kdf = KDFArgon2id.Params(newCost)
+	}
+	ps, err := newPassStanza(newPass, nil, kdf, fileKey)
+	if err != nil {
+		return err
+	}
+	ch.passes[slot] = ps
+	ch.raw = nil
+	head := append(ch.Raw(), cr.HeaderMAC()...)
+
+	return replaceHeader(f, path, head, int64(oldLen))
+}
+
+// replaceHeader writes head followed by everything in f after its old header of
+// length oldLen to a temp file, then renames the temp file to path
+func replaceHeader(f *os.File, path string, head []byte, oldLen int64) error {
+	fStat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".rekey*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(head); err != nil {
+		return err
+	}
+	if _, err := f.Seek(oldLen, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, f); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(fStat.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,123 @@
+package v2
+
+import (
+	"crypto/cipher"
+	"io"
+	"sync"
+)
+
+// sealJob is one chunk handed to the workers of a sealPool
+type sealJob struct {
+	seq   uint32
+	flag  uint8
+	buf   []byte
+	out   []byte
+	nonce []byte
+	done  chan struct{}
+}
+
+// sealPool seals chunks on several goroutines at once, and writes them out in the
+// order they were queued. Every chunk is sealed under its own nonce, so the output
+// is the same as sealing the chunks one at a time.
+type sealPool struct {
+	jobs    chan *sealJob
+	ordered chan *sealJob
+	free    chan *sealJob
+	wg      sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// newSealPool starts threads workers sealing chunks of up to chunkSize bytes with cr,
+// and a goroutine writing them to w, along with sh if the file is signed. Twice as many
+// chunks as workers are buffered, so the workers have more chunks ready while w is written to
+func newSealPool(threads int, chunkSize int, cr *cryptoRing, ad []byte, w io.Writer, sh *sigHash) *sealPool {
+	n := threads * 2
+	p := &sealPool{
+		jobs:    make(chan *sealJob, n),
+		ordered: make(chan *sealJob, n),
+		free:    make(chan *sealJob, n),
+	}
+	for i := 0; i < n; i++ {
+		p.free <- &sealJob{
+			buf:  make([]byte, 0, chunkSize),
+			done: make(chan struct{}, 1),
+		}
+	}
+
+	aead := cr.AEAD()
+	for i := 0; i < threads; i++ {
+		go p.seal(cr, aead, ad)
+	}
+
+	p.wg.Add(1)
+	go p.write(w, sh)
+
+	return p
+}
+
+// seal is run by each worker
+func (p *sealPool) seal(cr *cryptoRing, aead cipher.AEAD, ad []byte) {
+	for job := range p.jobs {
+		job.nonce = cr.Nonce(job.nonce, job.seq, job.flag)
+		job.out = aead.Seal(job.out[:0], job.nonce, job.buf, ad)
+		job.done <- struct{}{}
+	}
+}
+
+// write writes out each sealed chunk in order, and recycles its job
+func (p *sealPool) write(w io.Writer, sh *sigHash) {
+	defer p.wg.Done()
+
+	for job := range p.ordered {
+		<-job.done
+		if p.failed() == nil {
+			if _, err := w.Write(job.out); err != nil {
+				p.fail(err)
+			} else if sh != nil {
+				sh.Write(job.out)
+			}
+		}
+		p.free <- job
+	}
+}
+
+// queue hands buf off to be sealed as chunk seq, and returns an empty buffer to fill
+// with the next chunk in its place. It blocks while every buffered chunk is in use
+func (p *sealPool) queue(buf []byte, seq uint32, flag uint8) ([]byte, error) {
+	if err := p.failed(); err != nil {
+		return buf, err
+	}
+
+	job := <-p.free
+	job.seq, job.flag = seq, flag
+	job.buf, buf = buf, job.buf[:0]
+
+	p.ordered <- job
+	p.jobs <- job
+	return buf, nil
+}
+
+// close waits for every queued chunk to be written, stops the goroutines, and returns
+// the first error writing the chunks
+func (p *sealPool) close() error {
+	close(p.jobs)
+	close(p.ordered)
+	p.wg.Wait()
+	return p.failed()
+}
+
+func (p *sealPool) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *sealPool) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
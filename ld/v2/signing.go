@@ -0,0 +1,251 @@
+package v2
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"hash"
+	"io"
+)
+
+const (
+	// VerifyingKeyPrefix starts every encoded signature public key
+	VerifyingKeyPrefix = "lockdown-sigpub-"
+
+	// SigningKeyPrefix starts every encoded signature private key
+	SigningKeyPrefix = "LOCKDOWN-SIGN-SECRET-"
+)
+
+var (
+	ErrBadSigningKey   = errors.New("invalid signing private key")
+	ErrBadVerifyingKey = errors.New("invalid signing public key")
+	ErrNoSigningKey    = errors.New("no signing key found")
+	ErrUnsigned        = errors.New("the file isn't signed, but it was required to be signed by a trusted key")
+	ErrBadSignature    = errors.New("the signature doesn't match the file, it was tampered with or corrupted")
+)
+
+// ErrUnknownSigner is returned when a file is signed by a key that isn't one of DecOptions.Trusted
+type ErrUnknownSigner struct {
+	ID KeyID
+}
+
+func (e ErrUnknownSigner) Error() string {
+	return fmt.Sprintf("the file was signed by key (%s), which isn't one of the trusted keys", e.ID)
+}
+
+// KeyID identifies the key a file was signed with. It is the start of the sha256 of the public key
+type KeyID [lenKeyID]byte
+
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// VerifyingKey is an Ed25519 public key that signatures are checked with
+type VerifyingKey struct {
+	pub ed25519.PublicKey
+}
+
+// ParseVerifyingKey decodes a public key encoded by VerifyingKey.String
+func ParseVerifyingKey(s string) (VerifyingKey, error) {
+	pub, err := decodeKey(s, VerifyingKeyPrefix, ed25519.PublicKeySize)
+	if err != nil {
+		return VerifyingKey{}, ErrBadVerifyingKey
+	}
+	return VerifyingKey{pub: pub}, nil
+}
+
+func (vk VerifyingKey) String() string {
+	return VerifyingKeyPrefix + keyEncoding.EncodeToString(vk.pub)
+}
+
+// ID returns the KeyID that files signed by vk's SigningKey carry in their header
+func (vk VerifyingKey) ID() KeyID {
+	var id KeyID
+	sum := sha256.Sum256(vk.pub)
+	copy(id[:], sum[:])
+	return id
+}
+
+// SigningKey is an Ed25519 private key that files can be signed with
+type SigningKey struct {
+	seed *memguard.LockedBuffer
+	pub  ed25519.PublicKey
+}
+
+// GenerateSigningKey creates a new random SigningKey
+func GenerateSigningKey() (*SigningKey, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	fillRand(seed)
+	return newSigningKey(seed), nil
+}
+
+// ParseSigningKey decodes a private key encoded by SigningKey.String
+func ParseSigningKey(s string) (*SigningKey, error) {
+	seed, err := decodeKey(s, SigningKeyPrefix, ed25519.SeedSize)
+	if err != nil {
+		return nil, ErrBadSigningKey
+	}
+	return newSigningKey(seed), nil
+}
+
+// newSigningKey takes ownership of seed, which is wiped once it is moved into protected memory
+func newSigningKey(seed []byte) *SigningKey {
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := ed25519.PublicKey(append([]byte{}, priv[ed25519.SeedSize:]...))
+	wipe(priv)
+	return &SigningKey{seed: memguard.NewBufferFromBytes(seed), pub: pub}
+}
+
+// VerifyingKey returns the public key for sk
+func (sk *SigningKey) VerifyingKey() VerifyingKey {
+	return VerifyingKey{pub: sk.pub}
+}
+
+// String encodes the private key. Treat the result as a secret
+func (sk *SigningKey) String() string {
+	return SigningKeyPrefix + keyEncoding.EncodeToString(sk.seed.Bytes())
+}
+
+// Destroy clears the private key from protected memory
+func (sk *SigningKey) Destroy() {
+	sk.seed.Destroy()
+}
+
+func (sk *SigningKey) sign(msg []byte) []byte {
+	priv := ed25519.NewKeyFromSeed(sk.seed.Bytes())
+	defer wipe(priv)
+	return ed25519.Sign(priv, msg)
+}
+
+// ReadSigningKey parses the first signing key in r. Blank lines and lines starting with # are skipped
+func ReadSigningKey(r io.Reader) (*SigningKey, error) {
+	var sk *SigningKey
+	err := readKeyLines(r, func(line string) error {
+		if sk != nil {
+			return nil
+		}
+		var err error
+		sk, err = ParseSigningKey(line)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sk == nil {
+		return nil, ErrNoSigningKey
+	}
+	return sk, nil
+}
+
+// ReadVerifyingKeys parses one public key per line from r. Blank lines and lines starting with # are skipped
+func ReadVerifyingKeys(r io.Reader) ([]VerifyingKey, error) {
+	vks := []VerifyingKey{}
+	err := readKeyLines(r, func(line string) error {
+		vk, err := ParseVerifyingKey(line)
+		if err != nil {
+			return err
+		}
+		vks = append(vks, vk)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vks, nil
+}
+
+// sigHash is the running hash of the data a file's signature covers
+type sigHash struct {
+	hash.Hash
+}
+
+// newSigHash starts the hash with the parts of ch that can't change once the file is written
+func newSigHash(ch *cryptoHeader) sigHash {
+	sh := sigHash{sha512.New()}
+	sh.Write(infoSig)
+	sh.Write(ch.signedHeader())
+	return sh
+}
+
+// trustedSigner returns the key to check ch's signature with, or nil if the signature
+// doesn't need to be checked because no keys are trusted
+func trustedSigner(ch *cryptoHeader, trusted []VerifyingKey) (*VerifyingKey, error) {
+	if len(trusted) == 0 {
+		return nil, nil
+	}
+	if ch.signer == nil {
+		return nil, ErrUnsigned
+	}
+	for i, vk := range trusted {
+		if vk.ID() == *ch.signer {
+			return &trusted[i], nil
+		}
+	}
+	return nil, ErrUnknownSigner{ID: *ch.signer}
+}
+
+// verify checks sig against everything written to sh
+func (vk *VerifyingKey) verify(sh sigHash, sig []byte) error {
+	if !ed25519.Verify(vk.pub, sh.Sum(nil), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// tailReader reads everything from r but the last n bytes, which are kept in tail.
+// Everything it returns is also written to h, if there is one
+type tailReader struct {
+	r    io.Reader
+	h    hash.Hash
+	n    int
+	tail []byte
+	buf  []byte
+}
+
+func newTailReader(r io.Reader, n int, h hash.Hash) *tailReader {
+	return &tailReader{r: r, h: h, n: n, tail: make([]byte, 0, n)}
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	held := len(t.tail)
+	if cap(t.buf) < held+len(p) {
+		t.buf = make([]byte, held+len(p))
+	}
+	buf := append(t.buf[:0], t.tail...)
+
+	m, err := t.r.Read(buf[held : held+len(p)])
+	buf = buf[:held+m]
+
+	out := len(buf) - t.n
+	if out < 0 {
+		out = 0
+	}
+	copy(p, buf[:out])
+	t.tail = append(t.tail[:0], buf[out:]...)
+
+	if t.h != nil {
+		t.h.Write(p[:out])
+	}
+	return out, err
+}
+
+// signedHeader returns the version and the header sections other than the key stanzas,
+// so that a signed file can still be rekeyed
+func (ch *cryptoHeader) signedHeader() []byte {
+	buf := ldtools.U16tob(ch.ver)
+	for _, s := range ch.sections() {
+		switch s.tag {
+		case secPass, secKeySlot, secKDFSlot, secBatchSlot, secX25519:
+			continue
+		}
+		buf = append(buf, ldtools.U8tob(s.tag)...)
+		buf = append(buf, ldtools.U16tob(uint16(len(s.val)))...)
+		buf = append(buf, s.val...)
+	}
+	return buf
+}
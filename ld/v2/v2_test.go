@@ -0,0 +1,1365 @@
+package v2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"github.com/raz-varren/lockdown/ld/v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fileT struct {
+	name string
+	size int64
+}
+
+var (
+	fastCP   = v1.CostParams{Time: 1, Memory: 1024 * 128, Threads: 4}
+	testPass = []byte("testpassword")
+
+	// tiny chunks so the chunk boundaries get exercised
+	smallChunks = EncOptions{ChunkSize: 16}
+)
+
+const (
+	tmpDirPrefix = "lockdown_v2_tests_"
+)
+
+func TestV2(t *testing.T) {
+	files := []fileT{
+		{name: "0-byte_*.file", size: 0},
+		{name: "1-byte_*.file", size: 1},
+		{name: "2-byte_*.file", size: 2},
+		{name: "1-kibibyte_*.file", size: 1024},
+		{name: "1-chunk_*.file", size: defChunkSize},
+		{name: "1-chunk-plus-1_*.file", size: defChunkSize + 1},
+		{name: "1-mebibyte_*.file", size: 1024 * 1024},
+		{name: "10-mebibyte_*.file", size: 1024 * 1024 * 10},
+	}
+
+	tmpDir, err := ioutil.TempDir("", tmpDirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, f := range files {
+		rtf, err := ldtools.NewRandTmpFile(tmpDir, f.name, f.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fileName := rtf.File().Name()
+		encFileName := fileName + ".lkd"
+		decFileName := fileName + ".dec"
+
+		err = EncryptFile(testPass, fastCP, fileName, encFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = DecryptFile(testPass, encFileName, decFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum, err := ldtools.FileSha256(decFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !rtf.Equal(sum) {
+			t.Fatal("decrypted file doesn't match original")
+		}
+
+		rtf.Close()
+		os.Remove(encFileName)
+		os.Remove(decFileName)
+	}
+}
+
+func TestSuites(t *testing.T) {
+	for _, suite := range []Suite{SuiteAESGCM, SuiteXChaCha20Poly1305} {
+		for _, size := range []int{0, 1, 15, 16, 17, 48, 49} {
+			opts := EncOptions{Suite: suite, ChunkSize: 16}
+			data := randBytes(t, size)
+
+			dec, err := decBytes(testPass, encBytes(t, data, opts))
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", suite, size, err)
+			}
+			if !bytes.Equal(data, dec) {
+				t.Fatalf("%s, %d bytes: decrypted data doesn't match original", suite, size)
+			}
+		}
+	}
+}
+
+func TestBadPass(t *testing.T) {
+	enc := encBytes(t, randBytes(t, 64), smallChunks)
+
+	_, err := decBytes([]byte("bad password"), enc)
+	if err != ErrWrongPassword {
+		t.Fatalf("expected (%v), but got (%v)", ErrWrongPassword, err)
+	}
+
+	// the key check fails before any of the payload is read
+	dec, err := NewDec([]byte("bad password"), io.LimitReader(bytes.NewReader(enc), int64(len(enc)-64)))
+	if err == nil {
+		dec.Close()
+	}
+	if err != ErrWrongPassword {
+		t.Fatalf("expected (%v), but got (%v)", ErrWrongPassword, err)
+	}
+}
+
+func TestTamperedHeader(t *testing.T) {
+	enc := encBytes(t, randBytes(t, 64), smallChunks)
+
+	// flip a bit in the nonce prefix, the cipher section is always first
+	enc[lenVer+lenHeaderLen+lenSecTag+lenSecLen+lenSuite+lenChunkSize] ^= 1
+
+	_, err := decBytes(testPass, enc)
+	if err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+}
+
+func TestTamperedChunk(t *testing.T) {
+	enc := encBytes(t, randBytes(t, 64), smallChunks)
+	enc[len(enc)-lenTag-20] ^= 1
+
+	_, err := decBytes(testPass, enc)
+	if err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	enc := encBytes(t, randBytes(t, 64), smallChunks)
+	sealed := int(smallChunks.ChunkSize) + lenTag
+
+	// dropping whole chunks is detected as truncation
+	_, err := decBytes(testPass, enc[:len(enc)-sealed])
+	if err != ErrTruncated {
+		t.Fatalf("expected (%v), but got (%v)", ErrTruncated, err)
+	}
+
+	// dropping part of a chunk just fails to authenticate
+	_, err = decBytes(testPass, enc[:len(enc)-1])
+	if err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+}
+
+func TestAppended(t *testing.T) {
+	enc := encBytes(t, randBytes(t, 64), smallChunks)
+	enc = append(enc, enc[len(enc)-lenTag-16:]...)
+
+	_, err := decBytes(testPass, enc)
+	if err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+}
+
+func TestReordered(t *testing.T) {
+	enc := encBytes(t, randBytes(t, 64), smallChunks)
+	ch, err := readCryptoHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := int(smallChunks.ChunkSize) + lenTag
+	first := enc[ch.Len() : ch.Len()+sealed]
+	second := enc[ch.Len()+sealed : ch.Len()+sealed*2]
+
+	swapped := append([]byte{}, enc[:ch.Len()]...)
+	swapped = append(swapped, second...)
+	swapped = append(swapped, first...)
+	swapped = append(swapped, enc[ch.Len()+sealed*2:]...)
+
+	_, err = decBytes(testPass, swapped)
+	if err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+}
+
+func TestNewDecTooSmall(t *testing.T) {
+	dec, err := NewDec(testPass, bytes.NewReader(nil))
+	if err == nil {
+		dec.Close()
+	}
+	if err != ErrTooSmall {
+		t.Fatalf("expected (%v), but got (%v)", ErrTooSmall, err)
+	}
+}
+
+func TestNewDecBadVer(t *testing.T) {
+	enc := encBytes(t, nil, smallChunks)
+	copy(enc, ldtools.U16tob(v1.Version))
+
+	dec, err := NewDec(testPass, bytes.NewReader(enc))
+	if err == nil {
+		dec.Close()
+	}
+	if err != ErrVerMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrVerMismatch, err)
+	}
+}
+
+func TestNewEncBadOptions(t *testing.T) {
+	_, err := NewEncOptions(testPass, fastCP, ioutil.Discard, EncOptions{Suite: 99})
+	if err != ErrBadSuite {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadSuite, err)
+	}
+
+	_, err = NewEncOptions(testPass, fastCP, ioutil.Discard, EncOptions{ChunkSize: maxChunkSize + 1})
+	if err != ErrBadChunkSize {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadChunkSize, err)
+	}
+
+	_, err = NewEnc(nil, fastCP, ioutil.Discard)
+	if err != ErrBadPass {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadPass, err)
+	}
+}
+
+func TestDecryptFileTampered(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", tmpDirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// break a middle chunk, so some plaintext is written before the failure
+	enc := encBytes(t, randBytes(t, defChunkSize*3), EncOptions{})
+	enc[len(enc)/2] ^= 1
+
+	encFileName := filepath.Join(tmpDir, "tampered.file.lkd")
+	decFileName := filepath.Join(tmpDir, "tampered.file")
+	if err := ioutil.WriteFile(encFileName, enc, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = DecryptFile(testPass, encFileName, decFileName)
+	if err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+
+	if _, err := os.Stat(decFileName); !os.IsNotExist(err) {
+		t.Fatalf("expected partially decrypted file to be removed, but got (%v)", err)
+	}
+}
+
+func TestEncryptFileNotExists(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", tmpDirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	encFileName := filepath.Join(tmpDir, "encrypted.file")
+	err = EncryptFile(testPass, fastCP, filepath.Join(tmpDir, "nonexistent.file"), encFileName)
+	if err == nil || !os.IsNotExist(err) {
+		t.Fatalf("expected (file not exists error), but got (%v)", err)
+	}
+
+	if _, err := os.Stat(encFileName); !os.IsNotExist(err) {
+		t.Fatalf("expected no encrypted file to be created, but got (%v)", err)
+	}
+}
+
+func randBytes(t testing.TB, size int) []byte {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func encBytes(t testing.TB, data []byte, opts EncOptions) []byte {
+	buf := bytes.NewBuffer(nil)
+	enc, err := NewEncOptions(testPass, fastCP, buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decBytes(pass, data []byte) ([]byte, error) {
+	dec, err := NewDec(pass, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	return ioutil.ReadAll(dec)
+}
+
+func TestSeekDecTruncated(t *testing.T) {
+	enc := encBytes(t, randBytes(t, 64), smallChunks)
+	sealed := int(smallChunks.ChunkSize) + lenTag
+
+	dec, err := NewSeekDec(testPass, bytes.NewReader(enc[:len(enc)-sealed]))
+	if err == nil {
+		dec.Close()
+	}
+	if err != ErrTruncated {
+		t.Fatalf("expected (%v), but got (%v)", ErrTruncated, err)
+	}
+}
+
+func TestSeekDecTamperedChunk(t *testing.T) {
+	data := randBytes(t, 64)
+	enc := encBytes(t, data, smallChunks)
+	ch, err := readCryptoHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// break the second chunk
+	sealed := int(smallChunks.ChunkSize) + lenTag
+	enc[ch.Len()+sealed] ^= 1
+
+	dec, err := NewSeekDec(testPass, bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	// the first chunk is still readable
+	p := make([]byte, 16)
+	if _, err := dec.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[:16]) {
+		t.Fatal("decrypted data doesn't match original")
+	}
+
+	if _, err := dec.ReadAt(p, 20); err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	ids := []*Identity{}
+	recips := []Recipient{}
+	for i := 0; i < 3; i++ {
+		id, err := GenerateIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer id.Destroy()
+		ids = append(ids, id)
+		recips = append(recips, id.Recipient())
+	}
+
+	data := randBytes(t, 1024)
+	buf := bytes.NewBuffer(nil)
+	enc, err := NewEncOptions(nil, fastCP, buf, EncOptions{Recipients: recips})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(data)
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range ids {
+		dec, err := NewDecOptions(nil, bytes.NewReader(buf.Bytes()), DecOptions{Identities: []*Identity{id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decData, err := ioutil.ReadAll(dec)
+		dec.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, decData) {
+			t.Fatal("decrypted data does not match original data")
+		}
+	}
+
+	other, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Destroy()
+
+	_, err = NewDecOptions(nil, bytes.NewReader(buf.Bytes()), DecOptions{Identities: []*Identity{other}})
+	if err != ErrNoIdentity {
+		t.Fatalf("expected (%v), but got (%v)", ErrNoIdentity, err)
+	}
+
+	_, err = decBytes(testPass, buf.Bytes())
+	if err != ErrNoIdentity {
+		t.Fatalf("expected (%v), but got (%v)", ErrNoIdentity, err)
+	}
+}
+
+func TestRecipientsAndPass(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer id.Destroy()
+
+	data := randBytes(t, 64)
+	enc := encBytes(t, data, EncOptions{Recipients: []Recipient{id.Recipient()}})
+
+	decData, err := decBytes(testPass, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, decData) {
+		t.Fatal("decrypted data does not match original data")
+	}
+
+	dec, err := NewDecOptions(nil, bytes.NewReader(enc), DecOptions{Identities: []*Identity{id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	decData, err = ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, decData) {
+		t.Fatal("decrypted data does not match original data")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer id.Destroy()
+
+	r, err := ParseRecipient(id.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != id.Recipient().String() {
+		t.Fatal("parsed recipient does not match")
+	}
+
+	keyFile := "# a comment\n\n" + id.String() + "\n"
+	ids, err := ReadIdentities(strings.NewReader(keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0].Recipient().String() != r.String() {
+		t.Fatal("parsed identity does not match")
+	}
+	ids[0].Destroy()
+
+	if _, err := ParseRecipient(IdentityPrefix + "abc"); err != ErrBadRecipient {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadRecipient, err)
+	}
+	if _, err := ParseIdentity(id.Recipient().String()); err != ErrBadIdentity {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadIdentity, err)
+	}
+}
+
+func TestKeySlots(t *testing.T) {
+	passes := [][]byte{[]byte("first password"), []byte("second password"), []byte("third password")}
+	data := randBytes(t, 64)
+
+	buf := bytes.NewBuffer(nil)
+	enc, err := NewEncOptions(passes[0], fastCP, buf, EncOptions{
+		Passwords: []Password{
+			{Pass: passes[1]},
+			{Pass: passes[2], Cost: v1.CostParams{Time: 2, Memory: 1024, Threads: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(data)
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := ReadCryptoHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.KeySlots) != len(passes) {
+		t.Fatalf("expected %d key slots, but got %d", len(passes), len(ch.KeySlots))
+	}
+	if ch.KeySlots[1].KDF.Cost() != fastCP || ch.KeySlots[2].KDF.Cost().Time != 2 {
+		t.Fatal("key slot cost params do not match")
+	}
+
+	for _, pass := range passes {
+		decData, err := decBytes(pass, buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, decData) {
+			t.Fatal("decrypted data does not match original data")
+		}
+	}
+
+	_, err = decBytes([]byte("wrong password"), buf.Bytes())
+	if err != ErrWrongPassword {
+		t.Fatalf("expected (%v), but got (%v)", ErrWrongPassword, err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	oldPass, newPass, otherPass := []byte("old password"), []byte("new password"), []byte("other password")
+	data := randBytes(t, 1024)
+
+	buf := bytes.NewBuffer(nil)
+	enc, err := NewEncOptions(oldPass, fastCP, buf, EncOptions{
+		ChunkSize: 128,
+		Passwords: []Password{{Pass: otherPass}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(data)
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "lockdown_rekey_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rekey.lkd")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Rekey(newPass, otherPass, fastCP, v1.CostParams{}, path); err != ErrWrongPassword {
+		t.Fatalf("expected (%v), but got (%v)", ErrWrongPassword, err)
+	}
+	if _, ok := Rekey(oldPass, newPass, fastCP, v1.CostParams{Memory: 1024}, path).(ErrCostLimit); !ok {
+		t.Fatal("expected (ErrCostLimit) rekeying a slot over the limit")
+	}
+
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Rekey(oldPass, newPass, fastCP, v1.CostParams{}, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the header is never rewritten in place, the new file is renamed over the old one
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Fatal("expected the rekeyed file to replace the original")
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 1 {
+		t.Fatalf("expected only the rekeyed file to be left, but got (%d) files (%v)", len(files), err)
+	}
+
+	rekeyed, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := readCryptoHeader(bytes.NewReader(rekeyed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rekeyed[ch.Len():], buf.Bytes()[ch.Len():]) {
+		t.Fatal("rekey changed the encrypted chunks")
+	}
+
+	if _, err := decBytes(oldPass, rekeyed); err != ErrWrongPassword {
+		t.Fatalf("expected (%v), but got (%v)", ErrWrongPassword, err)
+	}
+
+	for _, pass := range [][]byte{newPass, otherPass} {
+		decData, err := decBytes(pass, rekeyed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, decData) {
+			t.Fatal("decrypted data does not match original data")
+		}
+	}
+}
+
+func TestKeyfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_keyfile_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kfPath := filepath.Join(dir, "keyfile")
+	if err := ioutil.WriteFile(kfPath, randBytes(t, 64), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kf, err := ReadKeyfile(kfPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kf.Destroy()
+
+	emptyPath := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadKeyfile(emptyPath); err != ErrEmptyKeyfile {
+		t.Fatalf("expected (%v), but got (%v)", ErrEmptyKeyfile, err)
+	}
+
+	data := randBytes(t, 64)
+	encrypt := func(pass []byte) []byte {
+		buf := bytes.NewBuffer(nil)
+		enc, err := NewEncOptions(pass, fastCP, buf, EncOptions{Keyfile: kf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.Write(data)
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	decrypt := func(pass []byte, enc []byte, opts DecOptions) error {
+		dec, err := NewDecOptions(pass, bytes.NewReader(enc), opts)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		decData, err := ioutil.ReadAll(dec)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, decData) {
+			t.Fatal("decrypted data does not match original data")
+		}
+		return nil
+	}
+
+	// password and keyfile
+	enc := encrypt(testPass)
+	ch, err := ReadCryptoHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.KeySlots[0].Factors != FactorPassword|FactorKeyfile {
+		t.Fatalf("expected factors (%s), but got (%s)", FactorPassword|FactorKeyfile, ch.KeySlots[0].Factors)
+	}
+	if err := decrypt(testPass, enc, DecOptions{Keyfile: kf}); err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt(testPass, enc, DecOptions{}); err != ErrNeedKeyfile {
+		t.Fatalf("expected (%v), but got (%v)", ErrNeedKeyfile, err)
+	}
+	if err := decrypt([]byte("wrong password"), enc, DecOptions{Keyfile: kf}); err != ErrWrongPassword {
+		t.Fatalf("expected (%v), but got (%v)", ErrWrongPassword, err)
+	}
+
+	// keyfile only
+	enc = encrypt(nil)
+	if err := decrypt(nil, enc, DecOptions{Keyfile: kf}); err != nil {
+		t.Fatal(err)
+	}
+	if err := decrypt(testPass, enc, DecOptions{}); err != ErrNeedKeyfile {
+		t.Fatalf("expected (%v), but got (%v)", ErrNeedKeyfile, err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_meta_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plainPath := filepath.Join(dir, "meta.file")
+	if err := ioutil.WriteFile(plainPath, randBytes(t, 64), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(plainPath, 0640); err != nil {
+		t.Fatal(err)
+	}
+	mTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(plainPath, mTime, mTime); err != nil {
+		t.Fatal(err)
+	}
+
+	encPath := plainPath + ".lkd"
+	if err := EncryptFileOptions(testPass, fastCP, plainPath, encPath, EncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := readCryptoHeaderFile(encPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ch.HasMeta {
+		t.Fatal("expected the header to have metadata")
+	}
+
+	decPath := filepath.Join(dir, "restored.file")
+	if err := DecryptFile(testPass, encPath, decPath); err != nil {
+		t.Fatal(err)
+	}
+
+	fStat, err := os.Stat(decPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fStat.Mode().Perm() != 0640 {
+		t.Fatalf("expected mode (%v), but got (%v)", os.FileMode(0640), fStat.Mode().Perm())
+	}
+	if !fStat.ModTime().Equal(mTime) {
+		t.Fatalf("expected mod time (%v), but got (%v)", mTime, fStat.ModTime())
+	}
+
+	f, err := os.Open(encPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dec, err := NewDec(testPass, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	meta := dec.(MetaDecrypter).Meta()
+	if meta == nil || meta.Name != "meta.file" {
+		t.Fatalf("expected the original name in the metadata, but got (%+v)", meta)
+	}
+
+	skipPath := filepath.Join(dir, "skipped.file")
+	if err := DecryptFileOptions(testPass, encPath, skipPath, DecOptions{SkipMeta: true}); err != nil {
+		t.Fatal(err)
+	}
+	fStat, err = os.Stat(skipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fStat.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode (%v), but got (%v)", os.FileMode(0600), fStat.Mode().Perm())
+	}
+
+	// only root can restore another owner, so anyone else keeps the file as their own
+	other := *meta
+	other.UID, other.GID = os.Getuid()+1, os.Getgid()+1
+	if os.Geteuid() != 0 {
+		if err := other.Apply(skipPath, true); err != nil {
+			t.Fatalf("expected (nil), but got (%v)", err)
+		}
+	}
+	if _, ok := other.Apply(filepath.Join(dir, "missing.file"), true).(ErrMetaNotRestored); !ok {
+		t.Fatal("expected (ErrMetaNotRestored) for a file that doesn't exist")
+	}
+}
+
+func readCryptoHeaderFile(path string) (CryptoHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return CryptoHeader{}, err
+	}
+	defer f.Close()
+	return ReadCryptoHeader(f)
+}
+
+func TestCostLimit(t *testing.T) {
+	enc := encBytes(t, randBytes(t, 64), smallChunks)
+
+	// a crafted key slot that would need 4TB of memory to derive its key
+	ch, err := readCryptoHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.passes[0].kdf = KDFArgon2id.Params(v1.CostParams{Time: 1, Memory: 1<<32 - 1, Threads: 4})
+	ch.raw = nil
+	crafted := append(ch.Raw(), enc[len(ch.Raw()):]...)
+
+	_, err = decBytes(testPass, crafted)
+	if _, ok := err.(ErrCostLimit); !ok {
+		t.Fatalf("expected (ErrCostLimit), but got (%v)", err)
+	}
+
+	dec, err := NewDecOptions(testPass, bytes.NewReader(enc), DecOptions{MaxCost: v1.CostParams{Memory: 1024}})
+	if err == nil {
+		dec.Close()
+	}
+	if _, ok := err.(ErrCostLimit); !ok {
+		t.Fatalf("expected (ErrCostLimit), but got (%v)", err)
+	}
+
+	if _, err := decBytes(testPass, enc); err != nil {
+		t.Fatal(err)
+	}
+
+	// slots that are each within the limit can't add up to more than it
+	ch, err = readCryptoHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hLen := len(ch.Raw())
+	ch.passes[0].kdf = KDFArgon2id.Params(v1.CostParams{Time: 1, Memory: 1024 * 8, Threads: 1})
+	for i := 0; i < 3; i++ {
+		wrong := *ch.passes[0]
+		wrong.salt = randBytes(t, lenSalt)
+		ch.passes = append([]*passStanza{&wrong}, ch.passes...)
+	}
+	ch.raw = nil
+	crafted = append(ch.Raw(), enc[hLen:]...)
+
+	limited := DecOptions{MaxCost: v1.CostParams{Time: 3}}
+	dec, err = NewDecOptions(testPass, bytes.NewReader(crafted), limited)
+	if err == nil {
+		dec.Close()
+	}
+	if _, ok := err.(ErrCostLimit); !ok {
+		t.Fatalf("expected (ErrCostLimit), but got (%v)", err)
+	}
+	limited.MaxCost.Time = 4
+	dec, err = NewDecOptions(testPass, bytes.NewReader(crafted), limited)
+	if err == nil {
+		dec.Close()
+	}
+	if _, ok := err.(ErrCostLimit); ok {
+		t.Fatalf("expected all of the slots to be tried, but got (%v)", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("a compressible line of text\n"), 4096)
+
+	for _, comp := range []Compression{CompressGzip, CompressZstd} {
+		enc := encBytes(t, data, EncOptions{Compression: comp})
+		if len(enc) > len(data)/4 {
+			t.Fatalf("%s: expected the encrypted data to be compressed, but it is %d bytes", comp, len(enc))
+		}
+
+		ch, err := ReadCryptoHeader(bytes.NewReader(enc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.Compression != comp {
+			t.Fatalf("expected compression (%s), but got (%s)", comp, ch.Compression)
+		}
+
+		decData, err := decBytes(testPass, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, decData) {
+			t.Fatalf("%s: decrypted data does not match original data", comp)
+		}
+
+		sd, err := NewSeekDec(testPass, bytes.NewReader(enc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sd.Size() != int64(len(data)) {
+			t.Fatalf("%s: expected size (%d), but got (%d)", comp, len(data), sd.Size())
+		}
+
+		p := make([]byte, 100)
+		for _, off := range []int64{5000, 10, int64(len(data)) - 100} {
+			if _, err := sd.ReadAt(p, off); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p, data[off:off+100]) {
+				t.Fatalf("%s: ReadAt(%d) does not match original data", comp, off)
+			}
+		}
+
+		if _, err := sd.Seek(-50, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		tail, err := ioutil.ReadAll(sd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tail, data[len(data)-50:]) {
+			t.Fatalf("%s: data read after seeking does not match original data", comp)
+		}
+		sd.Close()
+	}
+
+	// a tampered chunk in the middle is only found once the size is worked out, and
+	// the error sticks
+	enc := encBytes(t, randBytes(t, 4096), EncOptions{Compression: CompressGzip, ChunkSize: 256})
+	ch, err := ReadCryptoHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc[len(enc)-(int(ch.ChunkSize)+lenTag)*3] ^= 1
+
+	sd, err := NewSeekDec(testPass, bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	if size := sd.Size(); size != -1 {
+		t.Fatalf("expected size (-1), but got (%d)", size)
+	}
+	if _, err := sd.(SizeDecrypter).CheckSize(); err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+	if _, err := sd.Read(make([]byte, 16)); err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+	if _, err := sd.Seek(0, io.SeekStart); err != ErrSigMismatch {
+		t.Fatalf("expected (%v), but got (%v)", ErrSigMismatch, err)
+	}
+
+	_, err = NewEncOptions(testPass, fastCP, ioutil.Discard, EncOptions{Compression: 99})
+	if err != ErrBadCompression {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadCompression, err)
+	}
+}
+
+func TestPadding(t *testing.T) {
+	for _, pad := range []Padding{PadPadme, PadPow2} {
+		opts := EncOptions{ChunkSize: 16, Padding: pad}
+		for _, size := range []int{0, 1, 15, 16, 17, 100, 1000} {
+			data := randBytes(t, size)
+			enc := encBytes(t, data, opts)
+
+			decData, err := decBytes(testPass, enc)
+			if err != nil {
+				t.Fatalf("%s %d: %v", pad, size, err)
+			}
+			if !bytes.Equal(data, decData) {
+				t.Fatalf("%s %d: decrypted data does not match original data", pad, size)
+			}
+
+			sd, err := NewSeekDec(testPass, bytes.NewReader(enc))
+			if err != nil {
+				t.Fatalf("%s %d: %v", pad, size, err)
+			}
+			if sd.Size() != int64(size) {
+				t.Fatalf("%s: expected size (%d), but got (%d)", pad, size, sd.Size())
+			}
+			seekData, err := ioutil.ReadAll(sd)
+			sd.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, seekData) {
+				t.Fatalf("%s %d: seek decrypted data does not match original data", pad, size)
+			}
+		}
+
+		// sizes in the same bucket can't be told apart
+		if a, b := encBytes(t, randBytes(t, 100), opts), encBytes(t, randBytes(t, 101), opts); len(a) != len(b) {
+			t.Fatalf("%s: expected equal encrypted sizes, but got (%d) and (%d)", pad, len(a), len(b))
+		}
+
+		enc := encBytes(t, randBytes(t, 100), opts)
+		sealed := int(opts.ChunkSize) + lenTag
+		trunc := enc[:len(enc)-sealed]
+		if _, err := decBytes(testPass, trunc); err != ErrTruncated {
+			t.Fatalf("%s: expected (%v), but got (%v)", pad, ErrTruncated, err)
+		}
+		if _, err := NewSeekDec(testPass, bytes.NewReader(trunc)); err != ErrTruncated {
+			t.Fatalf("%s: expected (%v), but got (%v)", pad, ErrTruncated, err)
+		}
+	}
+
+	for l := int64(1); l < 1<<20; l = l*3 + 1 {
+		if p := padme(l); p < l || float64(p-l) > float64(l)*0.12 {
+			t.Fatalf("padme(%d) = %d, which is outside the expected overhead", l, p)
+		}
+	}
+
+	_, err := NewEncOptions(testPass, fastCP, ioutil.Discard, EncOptions{Padding: 99})
+	if err != ErrBadPadding {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadPadding, err)
+	}
+}
+
+func TestKDF(t *testing.T) {
+	data := randBytes(t, 64)
+	kdfs := []KDFParams{
+		ScryptParams{LogN: 10, R: 8, P: 1},
+		PBKDF2Params{Iterations: 1000},
+	}
+
+	for _, kdf := range kdfs {
+		enc := encBytes(t, data, EncOptions{KDF: kdf})
+
+		ch, err := ReadCryptoHeader(bytes.NewReader(enc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.KeySlots[0].KDF != kdf {
+			t.Fatalf("expected kdf (%s), but got (%s)", kdf, ch.KeySlots[0].KDF)
+		}
+
+		decData, err := decBytes(testPass, enc)
+		if err != nil {
+			t.Fatalf("%s: %v", kdf.KDF(), err)
+		}
+		if !bytes.Equal(data, decData) {
+			t.Fatalf("%s: decrypted data does not match original data", kdf.KDF())
+		}
+
+		if _, err := decBytes([]byte("wrong password"), enc); err != ErrWrongPassword {
+			t.Fatalf("expected (%v), but got (%v)", ErrWrongPassword, err)
+		}
+	}
+
+	// key slots with different KDFs can share a file
+	otherPass := []byte("otherpassword")
+	enc := encBytes(t, data, EncOptions{
+		KDF:       kdfs[0],
+		Passwords: []Password{{Pass: otherPass, KDF: kdfs[1]}, {Pass: []byte("argonpassword"), Cost: fastCP}},
+	})
+	for _, pass := range [][]byte{testPass, otherPass, []byte("argonpassword")} {
+		if _, err := decBytes(pass, enc); err != nil {
+			t.Fatalf("%s: %v", pass, err)
+		}
+	}
+
+	// scrypt's memory counts against the memory limit
+	dec, err := NewDecOptions(testPass, bytes.NewReader(enc), DecOptions{MaxCost: v1.CostParams{Memory: 512}})
+	if err == nil {
+		dec.Close()
+	}
+	if _, ok := err.(ErrCostLimit); !ok {
+		t.Fatalf("expected (ErrCostLimit), but got (%v)", err)
+	}
+
+	// 128·R·N would overflow 64 bits with these
+	overflow := ScryptParams{LogN: 35, R: 1 << 29, P: 1}
+	for _, kdf := range []KDFParams{ScryptParams{LogN: 0, R: 8, P: 1}, overflow, PBKDF2Params{}, Argon2idParams{}} {
+		_, err := NewEncOptions(testPass, fastCP, ioutil.Discard, EncOptions{KDF: kdf})
+		if err != ErrBadKDF {
+			t.Fatalf("expected (%v), but got (%v)", ErrBadKDF, err)
+		}
+	}
+
+	// a header crafted with them is refused before any key is derived
+	enc = encBytes(t, data, EncOptions{KDF: kdfs[0]})
+	ch, err := ReadCryptoHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := lenVer + lenHeaderLen +
+		lenSecTag + lenSecLen + lenSuite + lenChunkSize + len(ch.NoncePrefix) +
+		lenSecTag + lenSecLen + lenFactors + lenKDF
+	crafted, _ := overflow.MarshalBinary()
+	copy(enc[params:], crafted)
+	if _, err := decBytes(testPass, enc); err != ErrBadHeader {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadHeader, err)
+	}
+}
+
+// decTrusted decrypts data with both decrypters, checking its signature against trusted
+func decTrusted(data []byte, trusted []VerifyingKey) ([]byte, error) {
+	opts := DecOptions{Trusted: trusted}
+	sd, err := NewSeekDecOptions(testPass, bytes.NewReader(data), opts)
+	if err != nil {
+		return nil, err
+	}
+	sd.Close()
+
+	dec, err := NewDecOptions(testPass, bytes.NewReader(data), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	return ioutil.ReadAll(dec)
+}
+
+func TestSign(t *testing.T) {
+	sk, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sk.Destroy()
+	other, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Destroy()
+
+	parsed, err := ReadSigningKey(strings.NewReader("# comment\n" + sk.String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parsed.Destroy()
+	trusted, err := ReadVerifyingKeys(strings.NewReader(other.VerifyingKey().String() + "\n" + parsed.VerifyingKey().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseVerifyingKey(sk.String()); err != ErrBadVerifyingKey {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadVerifyingKey, err)
+	}
+
+	data := randBytes(t, 1000)
+	opts := smallChunks
+	opts.Signer = sk
+	signed := encBytes(t, data, opts)
+	unsigned := encBytes(t, data, smallChunks)
+
+	for _, trust := range [][]VerifyingKey{trusted, nil} {
+		decData, err := decTrusted(signed, trust)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, decData) {
+			t.Fatal("decrypted data does not match original data")
+		}
+	}
+
+	ch, err := ReadCryptoHeader(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Signer == nil || *ch.Signer != sk.VerifyingKey().ID() {
+		t.Fatalf("expected signer (%s), but got (%v)", sk.VerifyingKey().ID(), ch.Signer)
+	}
+
+	_, err = decTrusted(signed, trusted[:1])
+	if e, ok := err.(ErrUnknownSigner); !ok || e.ID != sk.VerifyingKey().ID() {
+		t.Fatalf("expected (%v), but got (%v)", ErrUnknownSigner{ID: sk.VerifyingKey().ID()}, err)
+	}
+
+	if _, err := decTrusted(unsigned, trusted); err != ErrUnsigned {
+		t.Fatalf("expected (%v), but got (%v)", ErrUnsigned, err)
+	}
+
+	tampered := append([]byte{}, signed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := decTrusted(tampered, trusted); err != ErrBadSignature {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadSignature, err)
+	}
+	dec, err := NewDecOptions(testPass, bytes.NewReader(tampered), DecOptions{Trusted: trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decData, err := ioutil.ReadAll(dec)
+	dec.Close()
+	if err != ErrBadSignature || len(decData) == len(data) {
+		t.Fatalf("expected (%v) before the final chunk, but got (%v) after (%d) bytes", ErrBadSignature, err, len(decData))
+	}
+	if _, err := decTrusted(tampered, nil); err != nil {
+		t.Fatalf("expected (nil) without trusted keys, but got (%v)", err)
+	}
+
+	// rekeying a signed file keeps its signature valid
+	dir, err := ioutil.TempDir("", "lockdown_sign_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "signed.lkd")
+	if err := ioutil.WriteFile(path, signed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	newPass := []byte("new password")
+	if err := Rekey(testPass, newPass, fastCP, v1.CostParams{}, path); err != nil {
+		t.Fatal(err)
+	}
+	rekeyed, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := NewSeekDecOptions(newPass, bytes.NewReader(rekeyed), DecOptions{Trusted: trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.Close()
+}
+
+// failWriter fails once more than n bytes are written to it
+type failWriter struct {
+	n int
+}
+
+func (fw *failWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.n {
+		return 0, io.ErrShortWrite
+	}
+	fw.n -= len(p)
+	return len(p), nil
+}
+
+func TestThreads(t *testing.T) {
+	sk, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sk.Destroy()
+
+	for _, opts := range []EncOptions{
+		{ChunkSize: 16, Threads: 4},
+		{ChunkSize: 16, Threads: 3, Padding: PadPadme},
+		{ChunkSize: 16, Threads: 2, Signer: sk},
+	} {
+		for _, size := range []int{0, 1, 16, 17, 1000, 1024 * 10} {
+			data := randBytes(t, size)
+			enc := encBytes(t, data, opts)
+
+			decData, err := decTrusted(enc, []VerifyingKey{sk.VerifyingKey()})
+			if opts.Signer == nil {
+				decData, err = decBytes(testPass, enc)
+			}
+			if err != nil {
+				t.Fatalf("%d threads %d: %v", opts.Threads, size, err)
+			}
+			if !bytes.Equal(data, decData) {
+				t.Fatalf("%d threads %d: decrypted data does not match original data", opts.Threads, size)
+			}
+
+			serial := opts
+			serial.Threads = 0
+			if l := len(encBytes(t, data, serial)); l != len(enc) {
+				t.Fatalf("%d threads %d: expected (%d) bytes, the same as sealing serially, but got (%d)", opts.Threads, size, l, len(enc))
+			}
+		}
+	}
+
+	// a failed write of a chunk is returned by a later Write or Close
+	fw := &failWriter{n: 1024}
+	enc, err := NewEncOptions(testPass, fastCP, fw, EncOptions{ChunkSize: 16, Threads: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = enc.Write(randBytes(t, 1024*10))
+	if cErr := enc.Close(); err == nil {
+		err = cErr
+	}
+	if err != io.ErrShortWrite {
+		t.Fatalf("expected (%v), but got (%v)", io.ErrShortWrite, err)
+	}
+}
+
+// batchCache is a BatchCache that counts the master keys added to it
+type batchCache struct {
+	keys []*BatchKey
+}
+
+func (c *batchCache) BatchKey(salt []byte) *BatchKey {
+	for _, bk := range c.keys {
+		if bytes.Equal(bk.Salt(), salt) {
+			return bk
+		}
+	}
+	return nil
+}
+
+func (c *batchCache) AddBatchKey(bk *BatchKey) {
+	c.keys = append(c.keys, bk)
+}
+
+func TestBatch(t *testing.T) {
+	bk, err := NewBatchKey(testPass, nil, KDFArgon2id.Params(fastCP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bk.Destroy()
+
+	files := [][]byte{randBytes(t, 64), randBytes(t, 1024), randBytes(t, 0)}
+	encs := [][]byte{}
+	for _, data := range files {
+		encs = append(encs, encBytes(t, data, EncOptions{Batch: bk, ChunkSize: 128}))
+	}
+
+	fileSalts := map[string]bool{}
+	for _, enc := range encs {
+		ch, err := ReadCryptoHeader(bytes.NewReader(enc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ch.KeySlots) != 1 {
+			t.Fatalf("expected 1 key slot, but got %d", len(ch.KeySlots))
+		}
+		ks := ch.KeySlots[0]
+		if !bytes.Equal(ks.Salt, bk.Salt()) {
+			t.Fatal("batch salt does not match")
+		}
+		if len(ks.FileSalt) != lenFileSalt || fileSalts[string(ks.FileSalt)] {
+			t.Fatal("each file should have a salt of its own")
+		}
+		fileSalts[string(ks.FileSalt)] = true
+	}
+
+	cache := &batchCache{}
+	defer func() {
+		for _, bk := range cache.keys {
+			bk.Destroy()
+		}
+	}()
+	for i, enc := range encs {
+		if decData, err := decBytes(testPass, enc); err != nil || !bytes.Equal(files[i], decData) {
+			t.Fatalf("expected file %d to decrypt without a cache, but got (%v)", i, err)
+		}
+
+		dec, err := NewDecOptions(testPass, bytes.NewReader(enc), DecOptions{Batches: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decData, err := ioutil.ReadAll(dec)
+		dec.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(files[i], decData) {
+			t.Fatal("decrypted data does not match original data")
+		}
+	}
+	if len(cache.keys) != 1 {
+		t.Fatalf("expected the master key to be cached once, but it was cached %d times", len(cache.keys))
+	}
+
+	_, err = decBytes([]byte("wrong password"), encs[0])
+	if err != ErrWrongPassword {
+		t.Fatalf("expected (%v), but got (%v)", ErrWrongPassword, err)
+	}
+
+	// a cached master key unlocks the batch without its slow key derivation, even
+	// with a cost limit that the batch slot is over
+	dec, err := NewDecOptions(nil, bytes.NewReader(encs[1]), DecOptions{
+		Batches: cache,
+		MaxCost: v1.CostParams{Time: 1, Memory: 1024, Threads: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec.Close()
+
+	// another batch with the same password can't be unlocked by the cached key
+	other, err := NewBatchKey(testPass, nil, KDFArgon2id.Params(fastCP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Destroy()
+	enc := encBytes(t, files[0], EncOptions{Batch: other})
+	if _, err := NewDecOptions(nil, bytes.NewReader(enc), DecOptions{Batches: cache}); err != ErrNoIdentity {
+		t.Fatalf("expected (%v), but got (%v)", ErrNoIdentity, err)
+	}
+
+	if _, err := NewBatchKey(nil, nil, KDFArgon2id.Params(fastCP)); err != ErrBadPass {
+		t.Fatalf("expected (%v), but got (%v)", ErrBadPass, err)
+	}
+}
@@ -0,0 +1,176 @@
+package volume
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/raz-varren/lockdown/ld/ldtools"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Below is a representation of each volume file written by a Writer:
+// Volume:
+//     Header|Data|Trailer
+// Bytes:
+//     22|data length|41
+//
+// Header:
+//     Version|SetID|Index
+//     2|16|4
+//
+// Trailer:
+//     Final|DataLen|Hash
+//     1|8|32
+//
+// The data of the volumes, read in order, is the data written to the Writer, which is
+// normally an encrypted file, so it still authenticates itself once it is reassembled.
+// Every volume of a set carries the same random SetID and its own Index, starting at 0,
+// and only the last volume has Final set. The Hash is the sha256 of everything in the
+// volume before it, so a volume that is damaged, cut short, renamed out of order, or taken
+// from another set is found before any of the data is read, and reported by name.
+
+const (
+	// Version starts each volume, in place of the version bytes of the data it splits
+	Version uint16 = 0x7f01
+
+	// Ext is the format of the index added to the name of each volume, starting at 1
+	Ext = "%03d"
+
+	// MinSize is the smallest volume size accepted by NewWriter
+	MinSize = 1024
+
+	//header data length
+	lenVer   = 2
+	lenSetID = 16
+	lenIndex = 4
+
+	//trailer data length
+	lenFinal   = 1
+	lenDataLen = 8
+	lenHash    = sha256.Size
+
+	//combined lengths
+	lenHeader  = lenVer + lenSetID + lenIndex
+	lenTrailer = lenFinal + lenDataLen + lenHash
+)
+
+var (
+	ErrSize       = fmt.Errorf("volumes must be at least (%d) bytes", MinSize)
+	ErrBadVolume  = errors.New("the file isn't a valid volume")
+	ErrNotFirst   = errors.New("split volumes must be read from their first volume, which ends in .001")
+	ErrClosed     = errors.New("the volume writer is already closed")
+	errBadTrailer = errors.New("bad volume trailer")
+)
+
+// ErrMissing is returned when a volume of a set can't be found
+type ErrMissing struct {
+	Name string
+}
+
+func (e ErrMissing) Error() string {
+	return fmt.Sprintf("volume (%s) is missing, every volume of the set is needed", e.Name)
+}
+
+// ErrOrder is returned when a volume is named as a different index than the one it holds
+type ErrOrder struct {
+	Name  string
+	Index int
+}
+
+func (e ErrOrder) Error() string {
+	return fmt.Sprintf("volume (%s) is actually volume (%d) of its set, it was renamed or reordered", e.Name, e.Index)
+}
+
+// ErrSet is returned when a volume belongs to a different set than the first volume
+type ErrSet struct {
+	Name string
+}
+
+func (e ErrSet) Error() string {
+	return fmt.Sprintf("volume (%s) belongs to a different set of volumes", e.Name)
+}
+
+// ErrDamaged is returned when a volume doesn't match its hash
+type ErrDamaged struct {
+	Name string
+}
+
+func (e ErrDamaged) Error() string {
+	return fmt.Sprintf("volume (%s) is damaged or incomplete", e.Name)
+}
+
+// Name returns the name of volume index of the set named base. Indexes start at 0,
+// but the names start at .001
+func Name(base string, index int) string {
+	return base + "." + fmt.Sprintf(Ext, index+1)
+}
+
+// Base returns the name of the set that path is the first volume of, and whether path
+// is named like a first volume
+func Base(path string) (string, bool) {
+	first := "." + fmt.Sprintf(Ext, 1)
+	if !strings.HasSuffix(path, first) {
+		return path, false
+	}
+	return strings.TrimSuffix(path, first), true
+}
+
+// IsVolume returns true if path is named like a volume of any index
+func IsVolume(path string) bool {
+	i := strings.LastIndex(path, ".")
+	if i < 0 || len(path)-i-1 < len(fmt.Sprintf(Ext, 1)) {
+		return false
+	}
+	n, err := strconv.Atoi(path[i+1:])
+	return err == nil && n > 0
+}
+
+// header is the start of a volume
+type header struct {
+	setID [lenSetID]byte
+	index uint32
+}
+
+func (h header) marshal() []byte {
+	buf := ldtools.U16tob(Version)
+	buf = append(buf, h.setID[:]...)
+	return append(buf, ldtools.U32tob(h.index)...)
+}
+
+func parseHeader(b []byte) (header, bool) {
+	var h header
+	if len(b) != lenHeader || ldtools.Btou16(b[:lenVer]) != Version {
+		return h, false
+	}
+	copy(h.setID[:], b[lenVer:lenVer+lenSetID])
+	h.index = ldtools.Btou32(b[lenVer+lenSetID:])
+	return h, true
+}
+
+// trailer returns the end of a volume whose header and data were written to h
+func trailer(h hash.Hash, final bool, dataLen uint64) []byte {
+	buf := []byte{0}
+	if final {
+		buf[0] = 1
+	}
+	buf = append(buf, ldtools.U64tob(dataLen)...)
+	h.Write(buf)
+	return h.Sum(buf)
+}
+
+// checkTrailer checks b against h, which the header and data of the volume were written to,
+// and returns whether it is the final volume and the length of its data
+func checkTrailer(h hash.Hash, b []byte) (bool, uint64, error) {
+	if len(b) != lenTrailer || b[0] > 1 {
+		return false, 0, errBadTrailer
+	}
+	fields := b[:lenFinal+lenDataLen]
+	h.Write(fields)
+	if !bytes.Equal(h.Sum(nil), b[len(fields):]) {
+		return false, 0, errBadTrailer
+	}
+	return b[0] == 1, ldtools.Btou64(b[lenFinal:len(fields)]), nil
+}
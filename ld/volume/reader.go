@@ -0,0 +1,211 @@
+package volume
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	ErrNegativeOffset = errors.New("negative offset")
+)
+
+// Reader reads back the data of a set of volumes written by a Writer, as if it
+// were one file. It is not safe for concurrent use.
+type Reader struct {
+	vols    []vol
+	dataLen int64
+	off     int64
+}
+
+// vol is an open volume and where its data starts in the set
+type vol struct {
+	f       *os.File
+	start   int64
+	dataLen int64
+}
+
+// Detect returns true if r starts with the header of a volume
+func Detect(r io.ReadSeeker) bool {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	hb := make([]byte, lenHeader)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		return false
+	}
+	_, ok := parseHeader(hb)
+	return ok
+}
+
+// Open opens the set of volumes that first is the first volume of. Every volume is
+// checked against its hash, set, and index before Open returns, so a missing volume
+// returns ErrMissing, a volume named as the wrong index returns ErrOrder, a volume from
+// another set returns ErrSet, and a damaged volume returns ErrDamaged, each naming the
+// volume. first must be named like a first volume, or ErrNotFirst is returned.
+//
+// The returned Reader must be closed to close the volumes.
+func Open(first string) (*Reader, error) {
+	base, ok := Base(first)
+	if !ok {
+		return nil, ErrNotFirst
+	}
+
+	vr := &Reader{}
+	var setID [lenSetID]byte
+	for i := 0; ; i++ {
+		name := Name(base, i)
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			vr.Close()
+			return nil, ErrMissing{Name: name}
+		}
+		if err != nil {
+			vr.Close()
+			return nil, err
+		}
+
+		h, final, dataLen, err := check(f, name)
+		if err == nil && i == 0 {
+			setID = h.setID
+		}
+		if err == nil && h.setID != setID {
+			err = ErrSet{Name: name}
+		}
+		if err == nil && int(h.index) != i {
+			err = ErrOrder{Name: name, Index: int(h.index) + 1}
+		}
+		if err != nil {
+			f.Close()
+			vr.Close()
+			return nil, err
+		}
+
+		vr.vols = append(vr.vols, vol{f: f, start: vr.dataLen, dataLen: dataLen})
+		vr.dataLen += dataLen
+		if final {
+			return vr, nil
+		}
+	}
+}
+
+// check reads the volume f through its hash and returns its header, whether it is the
+// last volume of its set, and the length of its data
+func check(f *os.File, name string) (header, bool, int64, error) {
+	hb := make([]byte, lenHeader)
+	if _, err := io.ReadFull(f, hb); err != nil {
+		return header{}, false, 0, ErrBadVolume
+	}
+	h, ok := parseHeader(hb)
+	if !ok {
+		return header{}, false, 0, ErrBadVolume
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return header{}, false, 0, err
+	}
+	dataLen := size - lenHeader - lenTrailer
+	if dataLen < 0 {
+		return header{}, false, 0, ErrDamaged{Name: name}
+	}
+
+	if _, err := f.Seek(lenHeader, io.SeekStart); err != nil {
+		return header{}, false, 0, err
+	}
+	sum := sha256.New()
+	sum.Write(hb)
+	if _, err := io.CopyN(sum, f, dataLen); err != nil {
+		return header{}, false, 0, err
+	}
+
+	tb := make([]byte, lenTrailer)
+	if _, err := io.ReadFull(f, tb); err != nil {
+		return header{}, false, 0, err
+	}
+	final, n, err := checkTrailer(sum, tb)
+	if err != nil || n != uint64(dataLen) {
+		return header{}, false, 0, ErrDamaged{Name: name}
+	}
+	return h, final, dataLen, nil
+}
+
+// Size returns the length of the data of the whole set
+func (vr *Reader) Size() int64 {
+	return vr.dataLen
+}
+
+// Volumes returns the number of volumes in the set
+func (vr *Reader) Volumes() int {
+	return len(vr.vols)
+}
+
+func (vr *Reader) Read(p []byte) (int, error) {
+	n, err := vr.ReadAt(p, vr.off)
+	vr.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (vr *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += vr.off
+	case io.SeekEnd:
+		offset += vr.dataLen
+	}
+	if offset < 0 {
+		return 0, ErrNegativeOffset
+	}
+	vr.off = offset
+	return offset, nil
+}
+
+func (vr *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+
+	n := 0
+	for _, v := range vr.vols {
+		if n == len(p) {
+			break
+		}
+		if off >= v.start+v.dataLen {
+			continue
+		}
+
+		c := int64(len(p) - n)
+		if rest := v.start + v.dataLen - off; rest < c {
+			c = rest
+		}
+		m, err := v.f.ReadAt(p[n:n+int(c)], lenHeader+off-v.start)
+		n += m
+		off += int64(m)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if int64(m) < c {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes every volume of the set
+func (vr *Reader) Close() error {
+	var err error
+	for _, v := range vr.vols {
+		if cErr := v.f.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
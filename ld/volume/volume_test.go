@@ -0,0 +1,127 @@
+package volume
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// split writes data to volumes of size named base, and returns the names of the volumes
+func split(t *testing.T, base string, size int64, data []byte) []string {
+	vw, err := NewWriter(base, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := vw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return vw.Names()
+}
+
+func TestVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown_volume_tests_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	size := int64(MinSize)
+	per := int(size) - lenHeader - lenTrailer
+	for i, dataLen := range []int{0, 1, per, per + 1, per*3 + 7} {
+		data := make([]byte, dataLen)
+		rand.Read(data)
+
+		base := filepath.Join(dir, "set"+string(rune('a'+i)))
+		names := split(t, base, size, data)
+		expected := dataLen/per + 1
+		if dataLen > 0 && dataLen%per == 0 {
+			expected--
+		}
+		if len(names) != expected {
+			t.Fatalf("expected (%d) volumes, but got (%d)", expected, len(names))
+		}
+
+		vr, err := Open(names[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(vr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) || vr.Size() != int64(dataLen) {
+			t.Fatalf("expected (%d) bytes back, but got (%d)", dataLen, len(got))
+		}
+
+		if dataLen > per*2 {
+			p := make([]byte, 10)
+			if _, err := vr.ReadAt(p, int64(per-5)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p, data[per-5:per+5]) {
+				t.Fatal("ReadAt across volumes doesn't match")
+			}
+		}
+		vr.Close()
+	}
+
+	data := make([]byte, per*3)
+	rand.Read(data)
+	base := filepath.Join(dir, "errors")
+	names := split(t, base, size, data)
+
+	if _, err := Open(names[1]); err != ErrNotFirst {
+		t.Fatalf("expected (%v), but got (%v)", ErrNotFirst, err)
+	}
+
+	// swap the second and third volumes
+	os.Rename(names[1], base+".tmp")
+	os.Rename(names[2], names[1])
+	os.Rename(base+".tmp", names[2])
+	if _, err := Open(names[0]); err != (ErrOrder{Name: names[1], Index: 3}) {
+		t.Fatalf("expected (%v), but got (%v)", ErrOrder{Name: names[1], Index: 3}, err)
+	}
+
+	os.Remove(names[1])
+	if _, err := Open(names[0]); err != (ErrMissing{Name: names[1]}) {
+		t.Fatalf("expected (%v), but got (%v)", ErrMissing{Name: names[1]}, err)
+	}
+
+	other := split(t, filepath.Join(dir, "other"), size, data)
+	os.Rename(other[1], names[1])
+	if _, err := Open(names[0]); err != (ErrSet{Name: names[1]}) {
+		t.Fatalf("expected (%v), but got (%v)", ErrSet{Name: names[1]}, err)
+	}
+
+	// a volume cut short
+	names = split(t, filepath.Join(dir, "short"), size, data)
+	if err := os.Truncate(names[1], size-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(names[0]); err != (ErrDamaged{Name: names[1]}) {
+		t.Fatalf("expected (%v), but got (%v)", ErrDamaged{Name: names[1]}, err)
+	}
+
+	if _, err := NewWriter(filepath.Join(dir, "small"), MinSize-1); err != ErrSize {
+		t.Fatalf("expected (%v), but got (%v)", ErrSize, err)
+	}
+	if _, err := NewWriter(base, size); !os.IsExist(err) {
+		t.Fatalf("expected an existing volume not to be overwritten, but got (%v)", err)
+	}
+
+	f, err := os.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !Detect(f) || Detect(io.NewSectionReader(f, 1, size)) {
+		t.Fatal("expected only the volume to be detected")
+	}
+}
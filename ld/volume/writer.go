@@ -0,0 +1,130 @@
+package volume
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"hash"
+	"os"
+)
+
+// Writer splits the data written to it into volume files of a fixed size
+type Writer struct {
+	base    string
+	size    int64
+	setID   [lenSetID]byte
+	f       *os.File
+	h       hash.Hash
+	index   int
+	dataLen int64
+	names   []string
+	closed  bool
+	err     error
+}
+
+// NewWriter returns a Writer that splits the data written to it into volumes of at most
+// size bytes, named base.001, base.002, and so on. Every volume is created with O_EXCL,
+// so no existing file is overwritten. The first volume is created right away, and each
+// one after it once the one before it is full and more data is written.
+//
+// Close must be called on the returned Writer when finished writing, to mark the last
+// volume as the end of the set.
+func NewWriter(base string, size int64) (*Writer, error) {
+	if size < MinSize {
+		return nil, ErrSize
+	}
+
+	vw := &Writer{base: base, size: size}
+	if _, err := rand.Read(vw.setID[:]); err != nil {
+		return nil, err
+	}
+	if err := vw.next(); err != nil {
+		return nil, err
+	}
+	return vw, nil
+}
+
+// Names returns the names of the volumes created so far
+func (vw *Writer) Names() []string {
+	return vw.names
+}
+
+func (vw *Writer) Write(p []byte) (int, error) {
+	if vw.closed {
+		return 0, ErrClosed
+	}
+	if vw.err != nil {
+		return 0, vw.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		free := vw.size - lenHeader - lenTrailer - vw.dataLen
+		if free == 0 {
+			if vw.err = vw.finish(false); vw.err != nil {
+				return n, vw.err
+			}
+			if vw.err = vw.next(); vw.err != nil {
+				return n, vw.err
+			}
+			continue
+		}
+
+		c := len(p)
+		if int64(c) > free {
+			c = int(free)
+		}
+		if _, vw.err = vw.f.Write(p[:c]); vw.err != nil {
+			return n, vw.err
+		}
+		vw.h.Write(p[:c])
+		vw.dataLen += int64(c)
+		n += c
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// Close writes the trailer of the last volume, marking it as the end of the set
+func (vw *Writer) Close() error {
+	if vw.closed {
+		return nil
+	}
+	vw.closed = true
+	if vw.err != nil {
+		vw.f.Close()
+		return vw.err
+	}
+	return vw.finish(true)
+}
+
+// next creates the next volume and writes its header
+func (vw *Writer) next() error {
+	name := Name(vw.base, vw.index)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	vw.names = append(vw.names, name)
+
+	hb := header{setID: vw.setID, index: uint32(vw.index)}.marshal()
+	if _, err := f.Write(hb); err != nil {
+		f.Close()
+		return err
+	}
+
+	vw.f = f
+	vw.h = sha256.New()
+	vw.h.Write(hb)
+	vw.dataLen = 0
+	vw.index++
+	return nil
+}
+
+// finish writes the trailer of the current volume and closes it
+func (vw *Writer) finish(final bool) error {
+	_, err := vw.f.Write(trailer(vw.h, final, uint64(vw.dataLen)))
+	if cErr := vw.f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
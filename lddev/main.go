@@ -6,8 +6,10 @@ import (
 	"crypto/sha256"
 	"flag"
 	"fmt"
+	"github.com/raz-varren/lockdown/ld"
 	"github.com/raz-varren/lockdown/ld/ldtools"
 	"github.com/raz-varren/lockdown/ld/v1"
+	"github.com/raz-varren/lockdown/ld/v2"
 	"github.com/raz-varren/log"
 	"io"
 	"io/ioutil"
@@ -112,7 +114,7 @@ func processCompareHash(arg string) error {
 	if len(flag.Args()) > 1 {
 		fmt.Printf("%s - %s: %x - %x\n\n", arg, matchStr, compareSum, sum)
 	} else {
-		fmt.Printf(matchStr)
+		fmt.Print(matchStr)
 	}
 
 	return nil
@@ -140,6 +142,34 @@ func processSig(arg string) error {
 	}
 	defer f.Close()
 
+	ver, err := readVer(f)
+	if err != nil {
+		return err
+	}
+
+	// the header MAC of v2 binds the chunk tags together, and signed
+	// files also end with the Ed25519 signature of their signer
+	if ver == v2.Version {
+		ch, err := v2.ReadCryptoHeader(f)
+		if err != nil {
+			return err
+		}
+		if ch.Signer == nil {
+			fmt.Printf("file: %s\nHeaderMAC: %x\n\n", arg, ch.HeaderMAC)
+			return nil
+		}
+
+		if _, err := f.Seek(v2.LenSignature*-1, io.SeekEnd); err != nil {
+			return err
+		}
+		sig := make([]byte, v2.LenSignature)
+		if _, err := io.ReadFull(f, sig); err != nil {
+			return err
+		}
+		fmt.Printf("file: %s\nHeaderMAC: %x\nSigner: %s\nSignature: %x\n\n", arg, ch.HeaderMAC, ch.Signer, sig)
+		return nil
+	}
+
 	if _, err := f.Seek(v1.LenSig*-1, io.SeekEnd); err != nil {
 		return err
 	}
@@ -160,17 +190,29 @@ func processHeader(arg string) error {
 	}
 	defer f.Close()
 
-	hb := make([]byte, v1.LenHeader)
-	_, err = io.ReadFull(f, hb)
+	ch, err := ld.ReadHeader(f)
 	if err != nil {
 		return err
 	}
 
-	ch := v1.ExtractCryptoHeader(hb)
 	fmt.Printf("file: %s\n%s", arg, ch.String())
 	return nil
 }
 
+// readVer reads the version bytes at the start of f then seeks f back to the start
+func readVer(f io.ReadSeeker) (uint16, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return ldtools.Btou16(b), nil
+}
+
 func getHash(hashFilePath string) ([]byte, error) {
 	hashFile, err := os.Open(hashFilePath)
 	if err != nil {
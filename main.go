@@ -6,18 +6,34 @@ import (
 	"fmt"
 	"github.com/awnumar/memguard"
 	"github.com/raz-varren/lockdown/ld"
+	"github.com/raz-varren/lockdown/ld/parity"
 	"github.com/raz-varren/lockdown/ld/v1"
+	"github.com/raz-varren/lockdown/ld/v2"
+	"github.com/raz-varren/lockdown/ld/volume"
 	"github.com/raz-varren/log"
 	"golang.org/x/crypto/ssh/terminal"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// costAuto is the -cost option that calibrates the cost to -costtarget
+	costAuto = "auto"
+
+	// secondsPerYear is used to put brute force estimates into years
+	secondsPerYear = 60 * 60 * 24 * 365
 )
 
 var (
 	pws      = NewPWSystem()
+	newPws   = NewPWSystem()
 	pm       = NewPaddedMsgs()
 	firstExt = ""
 	extMap   = make(map[string]bool)
@@ -29,26 +45,81 @@ var (
 		"fast":   v1.CostFast,
 	}
 	costSelected = costMap["normal"]
+	encOpts      = v2.EncOptions{}
+	decOpts      = v2.DecOptions{}
+	encBatch     *v2.BatchKey
+
+	flagRecipients stringList
+	flagIdentities stringList
+	flagTrusted    stringList
 
 	flagDryRun      = flag.Bool("dry", false, fuDryRun)
 	flagExt         = flag.String("ext", v1.FileExt, fuExt)
 	flagRecurse     = flag.Bool("r", false, fuRecurse)
 	flagDecrypt     = flag.Bool("d", false, fuDecrypt)
 	flagEncrypt     = flag.Bool("e", false, fuEncrypt)
+	flagRekey       = flag.Bool("rekey", false, fuRekey)
+	flagUpgrade     = flag.Bool("upgrade", false, fuUpgrade)
+	flagRepair      = flag.Bool("repair", false, fuRepair)
 	flagPass        = flag.String("password", "", fuPass)
+	flagNewPass     = flag.String("newpassword", "", fuNewPass)
 	flagCost        = flag.String("cost", "", fuCost)
 	flagCostTime    = flag.Uint("costtime", uint(v1.CostNormal.Time), fuCostTime)
 	flagCostMemory  = flag.Uint("costmem", uint(v1.CostNormal.Memory/1024), fuCostMemory)
 	flagCostThreads = flag.Uint("costthreads", uint(v1.CostNormal.Threads), fuCostThreads)
+	flagCostTarget  = flag.Duration("costtarget", 2*time.Second, fuCostTarget)
+	flagKDF         = flag.String("kdf", v2.KDFArgon2id.String(), fuKDF)
+	flagMaxTime     = flag.Uint("maxcosttime", uint(v1.DefCostLimit.Time), fuMaxTime)
+	flagMaxMemory   = flag.Uint("maxcostmem", uint(v1.DefCostLimit.Memory/1024), fuMaxMemory)
+	flagMaxThreads  = flag.Uint("maxcostthreads", uint(v1.DefCostLimit.Threads), fuMaxThreads)
+	flagKeySlots    = flag.Int("keyslots", 1, fuKeySlots)
+	flagKeyfile     = flag.String("keyfile", "", fuKeyfile)
+	flagKeyfileOnly = flag.Bool("keyfileonly", false, fuKeyfileOnly)
+	flagNoMeta      = flag.Bool("nometa", false, fuNoMeta)
+	flagCompress    = flag.String("compress", v2.CompressNone.String(), fuCompress)
+	flagPad         = flag.String("pad", v2.PadNone.String(), fuPad)
+	flagParity      = flag.String("parity", "", fuParity)
+	flagArmor       = flag.Bool("armor", false, fuArmor)
+	flagArchive     = flag.String("archive", "", fuArchive)
+	flagList        = flag.Bool("list", false, fuList)
+	flagExtract     = flag.Bool("extract", false, fuExtract)
+	flagSplit       = flag.String("split", "", fuSplit)
+	flagThreads     = flag.Int("threads", 1, fuThreads)
+	flagBatch       = flag.Bool("batch", false, fuBatch)
+	flagNoOwner     = flag.Bool("noowner", false, fuNoOwner)
+	flagSign        = flag.String("sign", "", fuSign)
 
 	errNoFiles       = errors.New("no files provided")
 	errQuantumCrypto = errors.New("you can't encrypt AND decrypt a file at the same time... yet")
-	errNoCrypto      = errors.New("you must either encrypt files or decrypt files")
+	errNoCrypto      = errors.New("you must either encrypt, decrypt, rekey, upgrade, repair, list, or extract files")
+	errStdioInPlace  = errors.New("stdin can't be rekeyed, upgraded, repaired, archived, listed, or extracted, only files can")
+	errArchiveEnc    = errors.New("-archive can only be used with -e")
+	errParity        = errors.New("-parity must be a percentage, like 10%")
+	errSplit         = errors.New("-split must be a size, like 4G or 500M")
 	errEmptyExt      = errors.New("file extension can't be blank")
 	errFileExists    = errors.New("encrypted and unencrypted version of the same file found. something probabaly went wrong, inspect the files and delete the one you don't need")
+	errKeySlots      = errors.New("-keyslots must be at least 1")
+	errKeyfileOnly   = errors.New("-keyfileonly needs a -keyfile, and can't be used with -password")
+	errStdioPass     = errors.New("the -password, -recipient, or -identity flag is required when reading from stdin, since stdin can't also be used to prompt for a password")
+)
+
+const (
+	// stdioArg in place of a file reads from stdin and writes to stdout
+	stdioArg = "-"
 )
 
+func init() {
+	flag.Var(&flagRecipients, "recipient", fuRecipient)
+	flag.Var(&flagIdentities, "identity", fuIdentity)
+	flag.Var(&flagTrusted, "trust", fuTrust)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == keygenCmd {
+		keygen(os.Args[2:])
+		return
+	}
+
 	flag.Usage = ldUsage
 	flag.Parse()
 
@@ -74,18 +145,143 @@ func main() {
 
 	mapExtensions()
 
-	if *flagDecrypt && *flagEncrypt {
+	if *flagKeySlots < 1 {
+		log.Err.Fatalln(errKeySlots)
+	}
+
+	modes := 0
+	for _, m := range []bool{*flagEncrypt, *flagDecrypt, *flagRekey, *flagUpgrade, *flagRepair, *flagList, *flagExtract} {
+		if m {
+			modes++
+		}
+	}
+
+	if modes > 1 {
 		log.Err.Fatalln(errQuantumCrypto)
 	}
 
-	if !*flagEncrypt && !*flagDecrypt {
+	if modes == 0 {
 		log.Err.Fatalln(errNoCrypto)
 	}
 
+	if *flagArchive != "" && !*flagEncrypt {
+		log.Err.Fatalln(errArchiveEnc)
+	}
+
+	recips, err := loadRecipients(flagRecipients)
+	if err != nil {
+		log.Err.Fatalln(err)
+	}
+	encOpts.Recipients = recips
+
+	ids, err := loadIdentities(flagIdentities)
+	if err != nil {
+		log.Err.Fatalln(err)
+	}
+	decOpts.Identities = ids
+	defer destroyIdentities(ids)
+
+	if *flagSign != "" {
+		sk, err := loadSigner(*flagSign)
+		if err != nil {
+			log.Err.Fatalln(err)
+		}
+		defer sk.Destroy()
+		encOpts.Signer = sk
+	}
+
+	trusted, err := loadTrusted(flagTrusted)
+	if err != nil {
+		log.Err.Fatalln(err)
+	}
+	decOpts.Trusted = trusted
+
+	encOpts.SkipMeta = *flagNoMeta
+
+	comp, err := v2.ParseCompression(*flagCompress)
+	if err != nil {
+		log.Err.Fatalln(err)
+	}
+	encOpts.Compression = comp
+
+	pad, err := v2.ParsePadding(*flagPad)
+	if err != nil {
+		log.Err.Fatalln(err)
+	}
+	encOpts.Padding = pad
+
+	if *flagParity != "" {
+		percent, err := strconv.Atoi(strings.TrimSuffix(*flagParity, "%"))
+		if err != nil {
+			log.Err.Fatalln(errParity)
+		}
+		if percent < 1 || percent > 100 {
+			log.Err.Fatalln(parity.ErrBadPercent)
+		}
+		encOpts.Parity = percent
+	}
+	encOpts.Armor = *flagArmor
+	encOpts.Threads = *flagThreads
+
+	if *flagSplit != "" {
+		size, err := parseSize(*flagSplit)
+		if err != nil {
+			log.Err.Fatalln(errSplit)
+		}
+		if size < volume.MinSize {
+			log.Err.Fatalln(volume.ErrSize)
+		}
+		encOpts.Split = size
+	}
+
+	kdf, err := v2.ParseKDF(*flagKDF)
+	if err != nil {
+		log.Err.Fatalln(err)
+	}
+	decOpts.SkipMeta = *flagNoMeta
+	decOpts.MaxCost = v1.CostParams{
+		Time:    uint32(*flagMaxTime),
+		Memory:  uint32(*flagMaxMemory * 1024),
+		Threads: uint8(*flagMaxThreads),
+	}
+	decOpts.SkipOwner = *flagNoOwner
+	decOpts.Batches = pws
+
+	if *flagKeyfileOnly && (*flagKeyfile == "" || *flagPass != "") {
+		log.Err.Fatalln(errKeyfileOnly)
+	}
+
+	if *flagKeyfile != "" {
+		kf, err := v2.ReadKeyfile(*flagKeyfile)
+		if err != nil {
+			log.Err.Fatalln(err)
+		}
+		defer kf.Destroy()
+		encOpts.Keyfile = kf
+		decOpts.Keyfile = kf
+	}
+
 	if *flagDryRun {
 		log.Warn.Println("doing a dry run, no changes will actually be made")
 	}
 
+	if hasStdioArg() && (*flagRekey || *flagUpgrade || *flagRepair || *flagList || *flagExtract || *flagArchive != "") {
+		log.Err.Fatalln(errStdioInPlace)
+	}
+
+	if hasStdioArg() {
+		// stdout is reserved for the encrypted or decrypted data
+		log.SetDefaultLogger(log.NewLogger(os.Stderr, log.LogLevelDbg))
+		if *flagPass == "" && !hasKeys() {
+			log.Err.Fatalln(errStdioPass)
+		}
+	}
+
+	if *flagCost == costAuto && (*flagEncrypt || *flagRekey || *flagUpgrade) && kdf == v2.KDFArgon2id {
+		costSelected = calibrateCost()
+	}
+	encOpts.KDF = kdf.Params(costSelected)
+
 	termState, err := terminal.GetState(sysTerm)
 	if err != nil && hasSysTerm {
 		log.Err.Fatalln(err)
@@ -105,21 +301,140 @@ func main() {
 		}
 		pws.AddPass([]byte(*flagPass))
 	}
+	defer newPws.Destroy()
+
+	if *flagNewPass != "" {
+		if len(*flagNewPass) < minPassLen {
+			log.Err.Fatalln(errMinPass{min: minPassLen})
+		}
+		newPws.AddPass([]byte(*flagNewPass))
+	}
+
+	if *flagArchive != "" {
+		if err := archiveFiles(flag.Args()); err != nil {
+			log.Err.Fatalln(err)
+		}
+		return
+	}
 
 	for _, arg := range flag.Args() {
+		if arg == stdioArg {
+			if err := processStdio(); err != nil {
+				log.Err.Fatalln(err)
+			}
+			continue
+		}
+
 		err := processArg(arg)
 		if err != nil {
 			log.Err.Fatalln(err)
 		}
 	}
+
+	if *flagUpgrade {
+		printUpgrades()
+	}
+	if *flagRepair {
+		printRepairs()
+	}
+}
+
+// hasKeys returns true if files can be encrypted or decrypted without a password
+func hasKeys() bool {
+	if *flagKeyfileOnly {
+		return true
+	}
+	if *flagEncrypt {
+		return len(encOpts.Recipients) > 0
+	}
+	return len(decOpts.Identities) > 0
+}
+
+// slotOpts returns encOpts with every password after the first in its own key slot
+func slotOpts() v2.EncOptions {
+	opts := encOpts
+	opts.Passwords = []v2.Password{}
+	for i, pw := range pws.All() {
+		if i == 0 {
+			continue
+		}
+		opts.Passwords = append(opts.Passwords, v2.Password{Pass: pw, KDF: encOpts.KDF, Keyfile: encOpts.Keyfile})
+	}
+	if *flagBatch && (pws.Len() > 0 || encOpts.Keyfile != nil) {
+		opts.Batch = batchKey()
+	}
+	return opts
+}
+
+// batchKey derives the master key that every file encrypted with -batch shares, the first
+// time it is needed. It is kept by pws, which destroys it
+func batchKey() *v2.BatchKey {
+	if encBatch != nil {
+		return encBatch
+	}
+
+	bk, err := v2.NewBatchKey(pws.First(), encOpts.Keyfile, encOpts.KDF)
+	if err != nil {
+		log.Err.Fatalln(err)
+	}
+	pws.AddBatchKey(bk)
+	encBatch = bk
+	return bk
+}
+
+func hasStdioArg() bool {
+	for _, arg := range flag.Args() {
+		if arg == stdioArg {
+			return true
+		}
+	}
+	return false
+}
+
+// processStdio encrypts or decrypts stdin to stdout. Decryption never needs
+// to seek, so this works with pipes
+func processStdio() error {
+	if *flagDryRun {
+		pm.Info("skipping stdin:", "- dry run")
+		return nil
+	}
+
+	if *flagEncrypt {
+		pm.Info("encrypting:", "stdin")
+		encW, err := ld.NewEncOptions(pws.First(), costSelected, os.Stdout, slotOpts())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(encW, os.Stdin); err != nil {
+			encW.Close()
+			return err
+		}
+		return encW.Close()
+	}
+
+	pm.Info("decrypting:", "stdin")
+	decR, err := ld.NewStreamDecOptions(pws.First(), os.Stdin, decOpts)
+	if err != nil {
+		return err
+	}
+	defer decR.Close()
+
+	_, err = io.Copy(os.Stdout, decR)
+	return err
 }
 
 func processArg(arg string) error {
 	fmt.Println("")
 	arg = filepath.Clean(arg)
 	pm.Info("processing file:", arg)
-	ext := strings.TrimLeft(filepath.Ext(arg), ".")
-	hasMatchingExt := extMap[ext]
+	_, hasMatchingExt := trimExt(arg)
+
+	// checked before the stat, since later volumes are removed along with the first one
+	if laterVolume(arg) {
+		pm.Info("skipping file:", arg, "- part of a split encrypted file, which is read from its first volume")
+		stats.AddSkip(arg)
+		return nil
+	}
 
 	fStat, err := os.Lstat(arg)
 	if err != nil {
@@ -166,7 +481,7 @@ func processArg(arg string) error {
 		return nil
 	}
 
-	if *flagDecrypt && !hasMatchingExt {
+	if (*flagDecrypt || *flagRekey || *flagUpgrade || *flagRepair || *flagList || *flagExtract) && !hasMatchingExt {
 		pm.Info("skipping file:", arg, "- doesn't have encrypted file extension")
 		stats.AddSkip(arg)
 		return nil
@@ -182,29 +497,59 @@ func processArg(arg string) error {
 		return decFile(arg)
 	}
 
+	if *flagRekey {
+		pm.Info("rekeying file:", arg)
+		return rekeyFile(arg)
+	}
+
+	if *flagUpgrade {
+		pm.Info("upgrading file:", arg)
+		return upgradeFile(arg)
+	}
+
+	if *flagRepair {
+		pm.Info("repairing file:", arg)
+		return repairFile(arg)
+	}
+
+	if *flagList {
+		pm.Info("listing archive:", arg)
+		return listFile(arg)
+	}
+
+	if *flagExtract {
+		pm.Info("extracting archive:", arg)
+		return extractFile(arg)
+	}
+
 	return nil
 }
 
 func encFile(arg string) error {
 	fName := extFileName(arg)
 
-	if fileExists(fName) {
+	if fileExists(fName) || fileExists(volume.Name(fName, 0)) {
 		return errFileExists
 	}
 
 	if !*flagDryRun {
-		if pws.Len() < 1 {
-			pws.PromptConfirm("please enter a password:", "confirm your password:", "passwords do not match")
-		}
+		promptNewPasswords()
 
-		err := ld.EncryptFile(pws.First(), costSelected, arg, fName)
+		err := ld.EncryptFileOptions(pws.First(), costSelected, arg, fName, slotOpts())
 		if err != nil {
 			return err
 		}
 	}
 
-	pm.Info("created file:", fName)
-	stats.AddMk(fName)
+	if encOpts.Split > 0 && !*flagDryRun {
+		for _, v := range volumeFiles(volume.Name(fName, 0)) {
+			pm.Info("created file:", v)
+			stats.AddMk(v)
+		}
+	} else {
+		pm.Info("created file:", fName)
+		stats.AddMk(fName)
+	}
 
 	if !*flagDryRun {
 		os.Remove(arg)
@@ -216,63 +561,345 @@ func encFile(arg string) error {
 	return nil
 }
 
-func decFile(arg string) error {
-	fName := strings.TrimSuffix(arg, filepath.Ext(arg))
-	if fileExists(fName) {
+// promptNewPasswords asks for a password to encrypt with, and one for each other key slot
+func promptNewPasswords() {
+	if pws.Len() < 1 && !hasKeys() {
+		pws.PromptConfirm("please enter a password:", "confirm your password:", "passwords do not match")
+	}
+	for pws.Len() < *flagKeySlots && (pws.Len() > 0 || *flagKeySlots > 1) {
+		pws.PromptConfirm(
+			fmt.Sprintf("please enter a password for key slot %d:", pws.Len()+1),
+			"confirm your password:",
+			"passwords do not match")
+	}
+}
+
+// archiveFiles encrypts the files and directories in args into the single archive -archive.
+// The originals are left in place
+func archiveFiles(args []string) error {
+	fmt.Println("")
+	for _, arg := range args {
+		pm.Info("archiving:", filepath.Clean(arg))
+	}
+
+	if fileExists(*flagArchive) {
 		return errFileExists
 	}
 
 	if !*flagDryRun {
-		if pws.Len() == 0 {
+		promptNewPasswords()
+
+		err := ld.EncryptArchive(pws.First(), costSelected, *flagArchive, args, slotOpts())
+		if err != nil {
+			return err
+		}
+	}
+
+	pm.Info("created file:", *flagArchive)
+	stats.AddMk(*flagArchive)
+
+	return nil
+}
+
+// listFile prints the entries of the archive arg, once all of it is authenticated
+func listFile(arg string) error {
+	if *flagDryRun {
+		return nil
+	}
+	if pws.Len() == 0 && !hasKeys() {
+		pws.Prompt("please enter your password:", false)
+	}
+
+	var entries []ld.ArchiveEntry
+	ok, err := tryPasswords(arg, "list", "listing", func(pass []byte) error {
+		var err error
+		entries, err = ld.ListArchive(pass, arg, decOpts)
+		return err
+	})
+	if err != nil || !ok {
+		return err
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%s %12d %s %s\n", e.Mode, e.Size, e.ModTime.Format("2006-01-02 15:04"), e.Name)
+	}
+	return nil
+}
+
+// extractFile restores the archive arg into the directory it is in. The archive is left in place
+func extractFile(arg string) error {
+	dest := filepath.Dir(arg)
+
+	if !*flagDryRun {
+		if pws.Len() == 0 && !hasKeys() {
 			pws.Prompt("please enter your password:", false)
 		}
 
-		pws.Rewind()
-		for {
-			err := ld.DecryptFile(pws.Next(), arg, fName)
+		var entries []ld.ArchiveEntry
+		ok, err := tryPasswords(arg, "extract", "extracting", func(pass []byte) error {
+			var err error
+			entries, err = ld.ExtractArchive(pass, arg, dest, decOpts)
+			return metaWarning(err)
+		})
+		if err != nil || !ok {
+			return err
+		}
 
-			if err == v1.ErrSigMismatch && pws.HasNext() {
-				log.Info.Println("password failed, trying other password")
-				continue
-			}
-			if err == v1.ErrSigMismatch {
-				log.Warn.Println("Your password didn't match the signature of the encrypted file:", arg)
-				log.Warn.Println("This could be because someone tampered with the file, but most likely this file uses a different password that the ones you've entered.")
-				if *flagPass != "" {
-					log.Err.Fatalln("exitting because -password flag was used")
-				}
-				fmt.Println("type another password and hit enter to try again to decrypt the file.")
-				if nil == pws.Prompt("hit enter without typing a password to skip decrypting this file.\n", true) {
-					pm.Info("skipping file:", arg)
-					stats.AddSkip(arg)
-					return nil
-				}
-				log.Info.Println("trying new password")
-				continue
+		for _, e := range entries {
+			if !strings.Contains(e.Name, "/") {
+				pm.Info("created file:", filepath.Join(dest, e.Name))
+				stats.AddMk(filepath.Join(dest, e.Name))
 			}
+		}
+	}
 
-			//any other errors are show stoppers
-			if err != nil {
-				return err
-			}
+	return nil
+}
+
+func decFile(arg string) error {
+	fName, _ := trimExt(arg)
+	if fileExists(fName) {
+		return errFileExists
+	}
 
-			break
+	if !*flagDryRun {
+		if pws.Len() == 0 && !hasKeys() {
+			pws.Prompt("please enter your password:", false)
+		}
+
+		var meta *v2.Metadata
+		ok, err := tryPasswords(arg, "decrypt", "decrypting", func(pass []byte) error {
+			var err error
+			meta, err = ld.DecryptFileMeta(pass, arg, fName, decOpts)
+			return metaWarning(err)
+		})
+		if err != nil || !ok {
+			return err
 		}
+
+		fName = restoreName(fName, meta)
 	}
 
 	pm.Info("created file:", fName)
 	stats.AddMk(fName)
 
+	for _, v := range volumeFiles(arg) {
+		if !*flagDryRun {
+			os.Remove(v)
+		}
+
+		pm.Info("deleted file:", v)
+		stats.AddDel(v)
+	}
+
+	return nil
+}
+
+// metaWarning logs a failure to restore the metadata of a decrypted file, which is kept,
+// and returns any other error as is
+func metaWarning(err error) error {
+	if _, ok := err.(v2.ErrMetaNotRestored); ok {
+		log.Warn.Println(err)
+		return nil
+	}
+	return err
+}
+
+// restoreName renames the decrypted file fName back to the name it had when it was
+// encrypted, if that name is free, and returns the new name
+func restoreName(fName string, meta *v2.Metadata) string {
+	if meta == nil || *flagNoMeta || meta.Name == "" || meta.Name == filepath.Base(fName) {
+		return fName
+	}
+
+	origName := filepath.Join(filepath.Dir(fName), meta.Name)
+	if fileExists(origName) {
+		log.Warn.Println("not restoring the original name of", fName, "- a file named", origName, "already exists")
+		return fName
+	}
+
+	if err := os.Rename(fName, origName); err != nil {
+		log.Warn.Println("failed to restore the original name of", fName+":", err)
+		return fName
+	}
+	return origName
+}
+
+func rekeyFile(arg string) error {
 	if !*flagDryRun {
-		os.Remove(arg)
+		if pws.Len() == 0 {
+			pws.Prompt("please enter the current password:", false)
+		}
+		if newPws.Len() == 0 {
+			newPws.PromptConfirm("please enter the new password:", "confirm the new password:", "passwords do not match")
+		}
+
+		ok, err := tryPasswords(arg, "rekey", "rekeying", func(pass []byte) error {
+			return ld.Rekey(pass, newPws.First(), costSelected, decOpts.MaxCost, arg)
+		})
+		if err == ld.ErrRekeyV1 || err == ld.ErrParityInPlace || err == ld.ErrArmorInPlace || err == ld.ErrVolumeInPlace {
+			log.Warn.Println(err)
+			pm.Info("skipping file:", arg)
+			stats.AddSkip(arg)
+			return nil
+		}
+		if err != nil || !ok {
+			return err
+		}
 	}
 
-	pm.Info("deleted file:", arg)
-	stats.AddDel(arg)
+	pm.Info("rekeyed file:", arg)
+	stats.AddRekey(arg)
 
 	return nil
 }
 
+// upgradeFile re-encrypts arg as the latest version, if it isn't already
+func upgradeFile(arg string) error {
+	from, err := ld.FileVersion(arg)
+	if err == ld.ErrParityInPlace || err == ld.ErrArmorInPlace || err == ld.ErrVolumeInPlace {
+		log.Warn.Println(err)
+		pm.Info("skipping file:", arg)
+		stats.AddSkip(arg)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if from == ld.LatestVersion {
+		pm.Info("skipping file:", arg, fmt.Sprintf("- already version %d", from))
+		stats.AddSkip(arg)
+		return nil
+	}
+
+	if !*flagDryRun {
+		if pws.Len() == 0 && !hasKeys() {
+			pws.Prompt("please enter your password:", false)
+		}
+
+		ok, err := tryPasswords(arg, "upgrade", "upgrading", func(pass []byte) error {
+			return ld.UpgradeOptions(pass, arg, ld.LatestVersion, costSelected, encOpts, decOpts)
+		})
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	pm.Info("upgraded file:", arg, fmt.Sprintf("(version %d to %d)", from, ld.LatestVersion))
+	stats.AddUpgrade(arg, from, ld.LatestVersion)
+
+	return nil
+}
+
+// printUpgrades lists the versions every file was upgraded from and to
+func printUpgrades() {
+	fmt.Println("")
+	pm.Info("upgraded files:", stats.UpgradeCount)
+	for _, u := range stats.Upgrades {
+		pm.Info(fmt.Sprintf("version %d to %d:", u.From, u.To), u.File)
+	}
+}
+
+// repairFile rewrites arg if any of it is damaged, using its parity. Files without
+// parity, or with too much damage to repair, are skipped
+func repairFile(arg string) error {
+	if *flagDryRun {
+		pm.Info("skipping file:", arg, "- dry run")
+		stats.AddSkip(arg)
+		return nil
+	}
+
+	n, err := ld.Repair(arg)
+	switch err {
+	case nil:
+	case parity.ErrBadParity, parity.ErrTooDamaged, parity.ErrTruncated:
+		log.Warn.Println(arg+":", err)
+		pm.Info("skipping file:", arg)
+		stats.AddErr(arg)
+		return nil
+	default:
+		return err
+	}
+
+	if n == 0 {
+		pm.Info("skipping file:", arg, "- not damaged")
+		stats.AddSkip(arg)
+		return nil
+	}
+
+	pm.Info("repaired file:", arg, fmt.Sprintf("(%d damaged blocks)", n))
+	stats.AddRepair(arg)
+
+	return nil
+}
+
+// printRepairs lists the files that were repaired
+func printRepairs() {
+	fmt.Println("")
+	pm.Info("repaired files:", stats.RepairCount)
+	for _, f := range stats.RepairFiles {
+		pm.Info("repaired file:", f)
+	}
+}
+
+// tryPasswords calls try with each password, and any identities, until one of them unlocks arg.
+// When they all fail, the user is prompted for another password. It returns false if the user
+// chose to skip arg instead
+func tryPasswords(arg, action, acting string, try func(pass []byte) error) (bool, error) {
+	pws.Rewind()
+	for {
+		err := try(pws.Next())
+		// version 1 files can't tell a wrong password apart from a signature mismatch
+		keyFailed := err == v2.ErrWrongPassword || err == v1.ErrSigMismatch || err == v2.ErrNoIdentity
+
+		if _, ok := err.(v1.ErrCostLimit); ok {
+			log.Warn.Println(arg+":", err)
+			log.Warn.Println("If you trust this file, raise the limits with -maxcosttime, -maxcostmem, and -maxcostthreads.")
+			pm.Info("skipping file:", arg)
+			stats.AddSkip(arg)
+			return false, nil
+		}
+
+		_, unknownSigner := err.(v2.ErrUnknownSigner)
+		if unknownSigner || err == v2.ErrUnsigned || err == v2.ErrBadSignature {
+			log.Warn.Println(arg+":", err)
+			pm.Info("skipping file:", arg)
+			stats.AddErr(arg)
+			return false, nil
+		}
+
+		if keyFailed && pws.HasNext() {
+			log.Info.Println("password failed, trying other password")
+			continue
+		}
+		if keyFailed {
+			switch err {
+			case v2.ErrNoIdentity:
+				log.Warn.Println("None of your identities or passwords can unlock the encrypted file:", arg)
+			case v2.ErrWrongPassword:
+				log.Warn.Println("None of the passwords you've entered can unlock the encrypted file:", arg)
+			default:
+				log.Warn.Println("Your password didn't match the signature of the encrypted file:", arg)
+				log.Warn.Println("This could be because someone tampered with the file, but most likely this file uses a different password that the ones you've entered.")
+			}
+			if *flagPass != "" || *flagKeyfileOnly {
+				log.Err.Fatalln("exitting because -password or -keyfileonly flag was used")
+			}
+			fmt.Printf("type another password and hit enter to try again to %s the file.\n", action)
+			if nil == pws.Prompt(fmt.Sprintf("hit enter without typing a password to skip %s this file.\n", acting), true) {
+				pm.Info("skipping file:", arg)
+				stats.AddSkip(arg)
+				return false, nil
+			}
+			log.Info.Println("trying new password")
+			continue
+		}
+
+		//any other errors are show stoppers
+		return err == nil, err
+	}
+}
+
 func fileExists(arg string) bool {
 	if _, err := os.Stat(arg); os.IsNotExist(err) {
 		return false
@@ -281,9 +908,25 @@ func fileExists(arg string) bool {
 }
 
 func extFileName(arg string) string {
+	if *flagArmor {
+		return strings.Join([]string{arg, firstExt, ld.ArmorExt}, ".")
+	}
 	return strings.Join([]string{arg, firstExt}, ".")
 }
 
+// trimExt returns arg without its encrypted file extension, and whether it had one.
+// Armored files have ld.ArmorExt after the encrypted file extension, and the first
+// volume of a split file has its volume index after that
+func trimExt(arg string) (string, bool) {
+	name, _ := volume.Base(arg)
+	name = strings.TrimSuffix(name, "."+ld.ArmorExt)
+	ext := filepath.Ext(name)
+	if !extMap[strings.TrimLeft(ext, ".")] {
+		return arg, false
+	}
+	return strings.TrimSuffix(name, ext), true
+}
+
 func mapExtensions() {
 	exts := strings.Split(*flagExt, ",")
 	for i, ext := range exts {
@@ -298,11 +941,72 @@ func mapExtensions() {
 	}
 }
 
+// calibrateCost benchmarks argon2 to pick the cost for -cost auto, and reports what
+// it picked along with how long it would take to brute force a password with it
+func calibrateCost() v1.CostParams {
+	log.Info.Println("calibrating the password key cost to take", *flagCostTarget, "on this machine")
+	cp := v1.Calibrate(*flagCostTarget, uint32(*flagCostMemory*1024))
+	guess := v1.Benchmark(cp)
+
+	log.Info.Println(fmt.Sprintf("picked cost (time: %d, memory: %dMB, threads: %d), each password guess takes %s",
+		cp.Time, cp.Memory/1024, cp.Threads, guess.Round(time.Millisecond)))
+	if guess*2 < *flagCostTarget {
+		log.Warn.Println("the cost was capped at the highest cost files can be decrypted with by default, so it takes less than", *flagCostTarget)
+	}
+
+	// on average half of the possible passwords have to be tried
+	years := math.Pow(62, 8) / 2 * guess.Seconds() / secondsPerYear
+	log.Info.Println(fmt.Sprintf("brute forcing a random 8 character password of letters and digits would take about %.0f years on a machine like this one", years))
+
+	return cp
+}
+
 func costOptsStr() string {
-	opts := []string{}
+	opts := []string{costAuto}
 	for opt, _ := range costMap {
 		opts = append(opts, opt)
 	}
 	sort.Strings(opts)
 	return "(" + strings.Join(opts, ", ") + ")"
 }
+
+// laterVolume returns true if arg is a volume of a split encrypted file, other than the first
+func laterVolume(arg string) bool {
+	if _, first := volume.Base(arg); first || !volume.IsVolume(arg) {
+		return false
+	}
+	_, hasExt := trimExt(strings.TrimSuffix(arg, filepath.Ext(arg)))
+	return hasExt
+}
+
+// volumeFiles returns arg, along with the rest of its volumes if it is the first volume of a split file
+func volumeFiles(arg string) []string {
+	base, ok := volume.Base(arg)
+	if !ok {
+		return []string{arg}
+	}
+	files := []string{}
+	for i := 0; fileExists(volume.Name(base, i)); i++ {
+		files = append(files, volume.Name(base, i))
+	}
+	return files
+}
+
+// parseSize parses a size in bytes, with an optional K, M, G, or T suffix for powers of 1024
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(s), "B")
+
+	var shift uint
+	if l := len(s); l > 0 {
+		if i := strings.IndexByte("KMGT", s[l-1]); i >= 0 {
+			shift = 10 * uint(i+1)
+			s = s[:l-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 1 || (n<<shift)>>shift != n {
+		return 0, errSplit
+	}
+	return n << shift, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/awnumar/memguard"
+	"github.com/raz-varren/lockdown/ld/v2"
 	"github.com/raz-varren/log"
 	"golang.org/x/crypto/ssh/terminal"
 	"sync"
@@ -34,6 +35,9 @@ type PWSystem struct {
 	mu  *sync.Mutex
 	pws []*memguard.LockedBuffer
 	c   int
+
+	// the master keys of the batches unlocked so far
+	batches []*v2.BatchKey
 }
 
 func (p *PWSystem) Prompt(ask string, allowEmpty bool) []byte {
@@ -90,9 +94,13 @@ func (p *PWSystem) AddPass(pass []byte) []byte {
 	return pw.Bytes()
 }
 
+// First returns the first password, or nil if there are none
 func (p *PWSystem) First() []byte {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if len(p.pws) == 0 {
+		return nil
+	}
 	return p.pws[0].Bytes()
 }
 
@@ -140,10 +148,35 @@ func (p *PWSystem) Len() int {
 	return len(p.pws)
 }
 
+// BatchKey returns the master key of the batch with salt, if it has been unlocked
+func (p *PWSystem) BatchKey(salt []byte) *v2.BatchKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, bk := range p.batches {
+		if bytes.Equal(bk.Salt(), salt) {
+			return bk
+		}
+	}
+	return nil
+}
+
+// AddBatchKey keeps the master key of a batch, so that the rest of its files are
+// unlocked without deriving it again
+func (p *PWSystem) AddBatchKey(bk *v2.BatchKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.batches = append(p.batches, bk)
+}
+
 func (p *PWSystem) Destroy() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	for _, pw := range p.pws {
 		pw.Destroy()
 	}
+	for _, bk := range p.batches {
+		bk.Destroy()
+	}
 }
@@ -12,10 +12,26 @@ type Stats struct {
 
 	ErrCount int64
 	ErrFiles []string
+
+	RekeyCount int64
+	RekeyFiles []string
+
+	UpgradeCount int64
+	Upgrades     []Upgrade
+
+	RepairCount int64
+	RepairFiles []string
+}
+
+// Upgrade is a file that was upgraded from one version to another
+type Upgrade struct {
+	File string
+	From uint16
+	To   uint16
 }
 
 func (s *Stats) TotalFiles() int64 {
-	return s.SkipCount + s.MkCount + s.ErrCount
+	return s.SkipCount + s.MkCount + s.ErrCount + s.RekeyCount + s.UpgradeCount + s.RepairCount
 }
 
 func (s *Stats) AllFiles() []string {
@@ -37,6 +53,18 @@ func (s *Stats) AllFiles() []string {
 		fList = append(fList, f)
 	}
 
+	for _, f := range s.RekeyFiles {
+		fList = append(fList, f)
+	}
+
+	for _, u := range s.Upgrades {
+		fList = append(fList, u.File)
+	}
+
+	for _, f := range s.RepairFiles {
+		fList = append(fList, f)
+	}
+
 	return fList
 }
 
@@ -60,11 +88,29 @@ func (s *Stats) AddErr(f string) {
 	s.ErrFiles = append(s.ErrFiles, f)
 }
 
+func (s *Stats) AddRekey(f string) {
+	s.RekeyCount++
+	s.RekeyFiles = append(s.RekeyFiles, f)
+}
+
+func (s *Stats) AddUpgrade(f string, from, to uint16) {
+	s.UpgradeCount++
+	s.Upgrades = append(s.Upgrades, Upgrade{File: f, From: from, To: to})
+}
+
+func (s *Stats) AddRepair(f string) {
+	s.RepairCount++
+	s.RepairFiles = append(s.RepairFiles, f)
+}
+
 func NewStats() *Stats {
 	return &Stats{
-		SkipFiles: []string{},
-		DelFiles:  []string{},
-		MkFiles:   []string{},
-		ErrFiles:  []string{},
+		SkipFiles:   []string{},
+		DelFiles:    []string{},
+		MkFiles:     []string{},
+		ErrFiles:    []string{},
+		RekeyFiles:  []string{},
+		Upgrades:    []Upgrade{},
+		RepairFiles: []string{},
 	}
 }
@@ -35,17 +35,93 @@ decryption. don't change this unless you really need to`
 subdirectories`
 	fuDecrypt = `decrypt files`
 	fuEncrypt = `encrypt files`
-	fuPass    = `the ` + "`password`" + ` to use for encrypting/decrypting files. if using
+	fuRekey   = `change the password of encrypted files without decrypting them. only
+the key slot unlocked by the current password is replaced, using the
+selected cost`
+	fuUpgrade = `re-encrypt encrypted files as the latest version. the plaintext is
+streamed straight into the new encrypted file, which is verified before
+it replaces the original, so the plaintext is never written to disk`
+	fuRepair = `rebuild the damaged parts of encrypted files that were encrypted with
+-parity. no password is needed, and files that aren't damaged are left
+alone`
+	fuThreads = `number of ` + "`threads`" + ` to encrypt the chunks of each file with. each thread
+holds a couple of chunks in memory. files encrypted with any number of threads
+decrypt the same way`
+	fuBatch = `derive the key from the password once for every file encrypted in this run,
+rather than once for each file. every file still gets a key of its own,
+derived from the shared one. decrypting reuses the key across a batch
+whether or not this is set`
+	fuSplit = "`size`" + ` of the volumes to split encrypted files into, like 4G or 500M. the
+volumes are named .001, .002, and so on, and decrypting the first volume
+finds and checks the rest`
+	fuArchive = `encrypt the files and directories given into the single archive ` + "`file`" + `,
+so their names, sizes, and layout stay hidden and the key is only derived
+once. the originals are left in place. used with -e`
+	fuList    = `list the contents of archives made with -archive, once they are authenticated`
+	fuExtract = `restore the contents of archives made with -archive into the directory
+the archive is in. nothing is extracted if any of it already exists, and the
+archive is left in place`
+	fuPass = `the ` + "`password`" + ` to use for encrypting/decrypting files. if using
 this flag, you will not be prompted for passwords and failed decryptions
 will cause the program to exit. using the flag is NOT recommended as doing
 so will make the password visible to process managers`
+	fuNewPass = `the new ` + "`password`" + ` to use when rekeying files. the same warnings as
+-password apply`
 	fuCost = "`cost`" + ` determines the amount of time it will take to generate encryption
 keys from your password. the longer it takes, the better, as this parameter
 directly determines how long it will take to bruteforce your password. when
-in doubt, just use the defaults. possible options are ` + costOptsStr()
+in doubt, just use the defaults. auto benchmarks this machine to pick a cost
+that takes -costtarget, using up to -costmem of memory. possible options
+are ` + costOptsStr()
+	fuCostTarget = "`duration`" + ` that generating a key should take with -cost auto`
+	fuKDF        = "`function`" + ` to derive keys from passwords with, one of (argon2id, scrypt,
+pbkdf2). the -cost flags only apply to argon2id, scrypt and pbkdf2 use their
+recommended parameters. only use scrypt or pbkdf2 when something else
+requires them`
 	fuCostTime    = `password key time cost parameter`
 	fuCostMemory  = `password key memory (in MB) cost parameter`
 	fuCostThreads = `password key threads cost parameter`
+	fuMaxTime     = `highest password key time cost parameter a file may ask for when
+decrypting it. files over any of the limits are skipped, since a crafted
+file could otherwise use up all of the memory or time of the machine`
+	fuMaxMemory  = `highest password key memory (in MB) cost parameter a file may ask for`
+	fuMaxThreads = `highest password key threads cost parameter a file may ask for`
+	fuKeySlots   = `the ` + "`number`" + ` of passwords to prompt for when encrypting. each password
+gets its own key slot, and any one of them can decrypt the files`
+	fuKeyfile = "`file`" + ` whose contents are needed along with the password to encrypt or
+decrypt files. the keyfile must never change, or the files it protects
+can't be decrypted`
+	fuKeyfileOnly = `use the -keyfile as the only secret, without a password. useful for
+unattended jobs`
+	fuNoMeta = `don't record the original name, mode, times, and owner of files when
+encrypting, and don't restore them when decrypting`
+	fuNoOwner = `restore everything but the owner of files when decrypting. use this
+when decrypting files that were encrypted by another user`
+	fuCompress = "`algorithm`" + ` to compress files with before they are encrypted, one of
+(none, gzip, zstd). compression can leak information about the plaintext
+through the size of the encrypted file, so it is off by default`
+	fuPad = "`scheme`" + ` to pad encrypted files with, so their size reveals less about the
+plaintext, one of (none, padme, pow2). padme adds at most 12%, pow2 rounds
+up to the next power of two`
+	fuParity = "`percent`" + ` of Reed-Solomon parity to add to encrypted files, like 10%, so
+they can be repaired if they are damaged on disk. it is rounded up to the
+next 5%, and files with damage to no more than that share of any 80KB
+block are decrypted as if they were never damaged`
+	fuArmor = `write encrypted files as text, between BEGIN and END lines with a checksum,
+so they can be pasted into email, chat, or tickets. armored files get a .asc
+extension after the encrypted file extension, and are decrypted like any other`
+	fuRecipient = `encrypt to a public ` + "`key`" + `, or a file of public keys, generated by the
+keygen command. may be used more than once. when recipients are set, a
+password is only used if one is also given with -password`
+	fuIdentity = `decrypt with the private keys in an identity ` + "`file`" + ` generated by the
+keygen command. may be used more than once`
+	fuSign = `sign encrypted files with the signing key in ` + "`file`" + `, generated by
+keygen -sign, so whoever decrypts them can tell they came from you`
+	fuTrust = `only decrypt files signed by one of the public keys in ` + "`file`" + `, one per
+line. unsigned files, files signed by any other key, and files whose
+signature doesn't match are skipped. may be used more than once`
+	fuKeygenOut  = "`file`" + ` to write the new identity to, instead of stdout`
+	fuKeygenSign = `generate a signing key for -sign instead of an identity`
 )
 
 const (
@@ -85,6 +161,79 @@ Examples:
 //decrypt directory of encrypted files with multiple possible extensions
     {{.Program}} -d -r -ext "myext,otherext,{{.Ext}}" /path/to/directory
 
+//decrypt data piped in on stdin, writing the plaintext to stdout
+    cat /path/to/file.txt.{{.Ext}} | {{.Program}} -d -password mypassword - > file.txt
+
+//decrypt a directory encrypted by another user, without restoring file owners
+    {{.Program}} -d -r -noowner /path/to/directory
+
+//compress a log file with zstd before encrypting it
+    {{.Program}} -e -compress zstd /path/to/file.log
+
+//decrypt a file that was encrypted with a very high memory cost
+    {{.Program}} -d -maxcostmem 8192 /path/to/file.txt.{{.Ext}}
+
+//encrypt a file with a cost tuned to take 3 seconds to unlock on this machine
+    {{.Program}} -e -cost auto -costtarget 3s /path/to/file.txt
+
+//encrypt a file with a scrypt derived key, for systems that require it
+    {{.Program}} -e -kdf scrypt /path/to/file.txt
+
+//pad encrypted files so their sizes don't give away the size of the plaintext
+    {{.Program}} -e -r -pad padme /path/to/directory
+
+//encrypt a backup with 10% parity, and later repair any bit rot it picked up
+    {{.Program}} -e -parity 10% /path/to/backup.tar
+    {{.Program}} -repair /path/to/backup.tar.{{.Ext}}
+
+//encrypt a file as text that can be pasted into a chat, then decrypt it again
+    {{.Program}} -e -armor /path/to/secret.txt
+    {{.Program}} -d /path/to/secret.txt.{{.Ext}}.asc
+
+//encrypt a large file with 8 threads
+    {{.Program}} -e -threads 8 /path/to/disk.img
+
+//encrypt a directory of many small files, deriving the key only once
+    {{.Program}} -e -r -batch /path/to/directory
+
+//split an encrypted backup into 4GB volumes, and decrypt it from the first volume
+    {{.Program}} -e -split 4G /path/to/backup.tar
+    {{.Program}} -d /path/to/backup.tar.{{.Ext}}.001
+
+//encrypt a whole directory into one archive, list it, and extract it again
+    {{.Program}} -e -archive /path/to/photos.{{.Ext}} /path/to/photos
+    {{.Program}} -list /path/to/photos.{{.Ext}}
+    {{.Program}} -extract /path/to/photos.{{.Ext}}
+
+//change the password of all encrypted files in a directory
+    {{.Program}} -rekey -r /path/to/directory
+
+//move all encrypted files in a directory to the latest version
+    {{.Program}} -upgrade -r /path/to/directory
+
+//encrypt a file that can be decrypted with either of two passwords
+    {{.Program}} -e -keyslots 2 /path/to/file.txt
+
+//encrypt a file with a password and a keyfile
+    {{.Program}} -e -keyfile /path/to/keyfile /path/to/file.txt
+
+//decrypt a file with only a keyfile, without prompting for a password
+    {{.Program}} -d -keyfile /path/to/keyfile -keyfileonly /path/to/file.txt.{{.Ext}}
+
+//generate an identity, printing its public key
+    {{.Program}} keygen -o /path/to/identity.key
+
+//encrypt a file to one or more public keys
+    {{.Program}} -e -recipient lockdown-pub-... -recipient /path/to/team.pub /path/to/file.txt
+
+//decrypt a file with an identity
+    {{.Program}} -d -identity /path/to/identity.key /path/to/file.txt.{{.Ext}}
+
+//generate a signing key, sign a file with it, and only decrypt files signed by trusted keys
+    {{.Program}} keygen -sign -o /path/to/signing.key
+    {{.Program}} -e -sign /path/to/signing.key /path/to/file.txt
+    {{.Program}} -d -trust /path/to/trusted.pub /path/to/file.txt.{{.Ext}}
+
 
 Options:
 `